@@ -5,8 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"strings"
 	"sync"
+	"time"
 )
 
 var (
@@ -16,27 +17,50 @@ var (
 	ErrInvalidResponse = errors.New("invalid response")
 	ErrRetryTimeout    = errors.New("retries exceeded")
 	ErrReadTimeout     = errors.New("read timeout")
+	ErrLinkDown        = errors.New("link down")
 
 	QueryRetryLimit = 3
 )
 
-type Amplifier struct {
-	writer     io.Writer
-	reader     *bufio.Reader
-	zones      []Zone
-	verboseLog bool
-	mutex      sync.Mutex
-	ignoreEOF  bool
-}
+// AmpError is returned when an exchange with the amplifier fails.  Err is
+// one of the package's sentinel errors, so callers can use errors.Is
+type AmpError struct {
+	Err  error
+	Zone ZoneID
 
-type Option func(*Amplifier)
+	// Command is the two letter command, "query" for a zone query or
+	// empty for a raw line
+	Command string
 
-func VerboseOption() Option {
-	return func(amp *Amplifier) {
-		amp.verboseLog = true
+	// Request and Response are the raw bytes sent to and received from
+	// the amplifier
+	Request  string
+	Response string
+}
+
+func (e *AmpError) Error() string {
+	if e.Zone == 0 {
+		return fmt.Sprintf("%v (sent %q, received %q)", e.Err, e.Request, e.Response)
 	}
+	return fmt.Sprintf("zone %d %s: %v (sent %q, received %q)", e.Zone, e.Command, e.Err, e.Request, e.Response)
 }
 
+func (e *AmpError) Unwrap() error {
+	return e.Err
+}
+
+type Amplifier struct {
+	writer    io.Writer
+	reader    *bufio.Reader
+	zones     []Zone
+	logger    Logger
+	mutex     sync.Mutex
+	received  strings.Builder
+	ignoreEOF bool
+}
+
+type Option func(*Amplifier)
+
 func New(port io.ReadWriter, options ...Option) (*Amplifier, error) {
 	amp := &Amplifier{
 		writer:    port,
@@ -57,7 +81,7 @@ func (amp *Amplifier) Zones() (zones []Zone) {
 }
 
 func (amp *Amplifier) initZones() error {
-	log.Printf("Initializing amplifier zones")
+	amp.log().Debug("initializing amplifier zones")
 	amp.zones = []Zone{}
 	for i := 1; i < 4; i++ {
 		for j := 1; j < 7; j++ {
@@ -65,9 +89,9 @@ func (amp *Amplifier) initZones() error {
 			_, err := amp.QueryState(id)
 			if err == nil {
 				amp.zones = append(amp.zones, newZone(id, amp))
-				log.Printf("Found Zone %d", id)
-			} else if err == ErrInvalidZone {
-				log.Printf("Zone %d is not attached", id)
+				amp.log().Info("found zone", "zone", id)
+			} else if errors.Is(err, ErrInvalidZone) {
+				amp.log().Debug("zone is not attached", "zone", id)
 			} else {
 				return err
 			}
@@ -79,39 +103,247 @@ func (amp *Amplifier) initZones() error {
 
 func (amp *Amplifier) readResponse() (string, error) {
 	str, err := amp.reader.ReadString('#')
-	if amp.verboseLog {
-		log.Printf("RX %q (err: %v)", str, err)
+	amp.received.WriteString(str)
+	if err == nil {
+		amp.log().Debug("RX", "line", str)
+	} else {
+		amp.log().Debug("RX", "line", str, "error", err)
 	}
 	return str, err
 }
 
-func (amp *Amplifier) write(cmdStr string, resp Response) error {
+// write sends a command and reads the response.  Failures are returned
+// as an *AmpError carrying the zone, command and the raw lines sent and
+// received
+func (amp *Amplifier) write(zone ZoneID, cmd, cmdStr string, resp Response) error {
 	amp.mutex.Lock()
 	defer amp.mutex.Unlock()
-	cmdStr = cmdStr + "\r\n"
-	if amp.verboseLog {
-		log.Printf("TX %q", cmdStr)
+	return amp.writeLocked(zone, cmd, cmdStr, resp)
+}
+
+// writeLocked is write for callers that already hold the mutex
+func (amp *Amplifier) writeLocked(zone ZoneID, cmd, cmdStr string, resp Response) (err error) {
+	amp.received.Reset()
+
+	defer func() {
+		if err != nil {
+			err = &AmpError{Err: err, Zone: zone, Command: cmd, Request: cmdStr, Response: amp.received.String()}
+		}
+	}()
+
+	// a garbled response must never take down the caller
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w decoding response to %q: %v", ErrInvalidResponse, cmdStr, r)
+		}
+	}()
+
+	attrs := []any{}
+	if zone != 0 {
+		attrs = append(attrs, "zone", zone, "command", cmd)
 	}
-	_, err := amp.writer.Write([]byte(cmdStr))
-	if err == nil {
-		err = resp.Read(amp)
+
+	start := time.Now()
+	defer func() {
+		args := append(attrs, "line", strings.TrimSpace(cmdStr), "latency", time.Since(start))
+		if err != nil {
+			args = append(args, "error", err)
+		}
+		amp.log().Debug("command finished", args...)
+	}()
+
+	cmdStr = cmdStr + "\r\n"
+	amp.log().Debug("TX", append(attrs, "line", cmdStr)...)
+	_, err = amp.writer.Write([]byte(cmdStr))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrLinkDown, err)
 	}
-	if err == nil && resp.EchoString() != cmdStr {
+
+	err = resp.Read(amp)
+	if errors.Is(err, io.EOF) {
+		// the amplifier stopped answering before the response was complete
+		err = fmt.Errorf("%w: %w", ErrReadTimeout, err)
+	} else if err == nil && resp.EchoString() != cmdStr {
 		err = fmt.Errorf("%w wrong echo string, wanted %q got %q", ErrInvalidResponse, cmdStr, resp.EchoString())
 	}
 	return err
 }
 
-func (amp *Amplifier) QueryState(zone ZoneID) (State, error) {
+func (amp *Amplifier) QueryState(zone ZoneID) (state State, err error) {
+	err = amp.Transaction(func(tx *Tx) error {
+		state, err = tx.QueryState(zone)
+		return err
+	})
+	return state, err
+}
+
+func (amp *Amplifier) SendCommand(zone ZoneID, cmd Command, arg interface{}) error {
+	return amp.Transaction(func(tx *Tx) error {
+		return tx.SendCommand(zone, cmd, arg)
+	})
+}
+
+// Tx sends queries and commands during a Transaction
+type Tx struct {
+	amp *Amplifier
+}
+
+func (tx *Tx) QueryState(zone ZoneID) (State, error) {
 	resp := &QueryResponse{}
-	cmdStr := fmt.Sprintf("?%d", zone)
-	err := amp.write(cmdStr, resp)
+	err := tx.amp.writeLocked(zone, "query", fmt.Sprintf("?%d", zone), resp)
 	return resp.State, err
 }
 
-func (amp *Amplifier) SendCommand(zone ZoneID, cmd Command, arg interface{}) error {
-	argStr := cmd.format(arg)
-	cmdStr := fmt.Sprintf("<%d%s%s", zone, cmd, argStr)
-	resp := &EchoResponse{}
-	return amp.write(cmdStr, resp)
+// State queries a zone's state the way Zone.State does.  The query is
+// tried up to QueryRetryLimit times while the amplifier doesn't answer,
+// and ErrUnknownState is returned if it never does
+func (tx *Tx) State(zone ZoneID) (state State, err error) {
+	for i := 0; i < QueryRetryLimit; i++ {
+		state, err = tx.QueryState(zone)
+		if err == nil || !errors.Is(err, ErrInvalidZone) {
+			break
+		}
+
+		if i+1 < QueryRetryLimit {
+			tx.amp.log().Warn("retrying zone query", "zone", zone, "attempt", i+1, "error", err)
+		}
+	}
+	if errors.Is(err, ErrInvalidZone) {
+		err = ErrUnknownState
+	}
+	return
+}
+
+func (tx *Tx) SendCommand(zone ZoneID, cmd Command, arg interface{}) error {
+	if err := cmd.CheckRange(arg); err != nil {
+		return err
+	}
+
+	str, err := cmd.format(arg)
+	if err != nil {
+		return err
+	}
+	cmdStr := fmt.Sprintf("<%d%s%s", zone, cmd, str)
+	return tx.amp.writeLocked(zone, string(cmd), cmdStr, &EchoResponse{})
+}
+
+// Transaction calls fn with exclusive use of the amplifier, so nothing
+// else is sent between the queries and commands fn makes.  This allows
+// a command to depend on the state read before it.  The Tx must not be
+// used after fn returns
+func (amp *Amplifier) Transaction(fn func(tx *Tx) error) error {
+	amp.mutex.Lock()
+	defer amp.mutex.Unlock()
+	return fn(&Tx{amp: amp})
+}
+
+// Adjust adds delta to a zone's volume, treble, bass or balance and
+// returns the resulting state.  The level is clamped to the hardware
+// limits and the read and write happen in one Transaction, so concurrent
+// adjustments don't lose each other's changes.  The state is read with
+// Tx.State, so a missed query is retried
+func (amp *Amplifier) Adjust(zone ZoneID, cmd Command, delta int) (state State, err error) {
+	level, found := levels[cmd]
+	if !found {
+		return state, fmt.Errorf("%w %q can't be adjusted", ErrCommand, cmd)
+	}
+
+	err = amp.Transaction(func(tx *Tx) error {
+		state, err = tx.State(zone)
+		if err != nil {
+			return err
+		}
+
+		value := level.field(&state)
+		delta = min(max(delta, -level.max), level.max)
+		*value = min(max(*value+delta, 0), level.max)
+		return tx.SendCommand(zone, cmd, *value)
+	})
+	return state, err
+}
+
+// Toggle turns a zone's power or mute off if it is on, or on if it is
+// off, and returns the resulting state.  Like Adjust, the read and write
+// happen in one Transaction
+func (amp *Amplifier) Toggle(zone ZoneID, cmd Command) (state State, err error) {
+	field, found := toggles[cmd]
+	if !found {
+		return state, fmt.Errorf("%w %q can't be toggled", ErrCommand, cmd)
+	}
+
+	err = amp.Transaction(func(tx *Tx) error {
+		state, err = tx.State(zone)
+		if err != nil {
+			return err
+		}
+
+		value := field(&state)
+		*value = !*value
+		return tx.SendCommand(zone, cmd, boolMarshaler(*value)())
+	})
+	return state, err
+}
+
+// QueryUnit queries every zone attached to a unit, numbered 1 to 3, with a
+// single command
+func (amp *Amplifier) QueryUnit(unit int) ([]State, error) {
+	resp := &UnitResponse{}
+	for _, zone := range amp.zones {
+		if int(zone.ID())/10 == unit {
+			resp.Count++
+		}
+	}
+
+	if resp.Count == 0 {
+		return nil, fmt.Errorf("%w: unit %d has no zones", ErrInvalidZone, unit)
+	}
+
+	err := amp.write(ZoneID(unit*10), "query", fmt.Sprintf("?%d0", unit), resp)
+	return resp.States, err
+}
+
+// States returns the state of every zone, querying each unit once.  The
+// zones of a unit that doesn't answer the unit query are queried one at a
+// time
+func (amp *Amplifier) States() (map[ZoneID]State, error) {
+	states := make(map[ZoneID]State)
+	for unit := 1; unit <= 3; unit++ {
+		zones := []Zone{}
+		for _, zone := range amp.zones {
+			if int(zone.ID())/10 == unit {
+				zones = append(zones, zone)
+			}
+		}
+
+		if len(zones) == 0 {
+			continue
+		}
+
+		unitStates, err := amp.QueryUnit(unit)
+		if err == nil {
+			for _, state := range unitStates {
+				states[ZoneID(state.Zone)] = state
+			}
+			continue
+		}
+
+		amp.log().Warn("unit query failed, querying each zone", "unit", unit, "error", err)
+		for _, zone := range zones {
+			state, err := zone.State()
+			if err != nil {
+				return states, err
+			}
+			states[zone.ID()] = state
+		}
+	}
+	return states, nil
+}
+
+// SendRaw sends an arbitrary protocol line to the amplifier and returns
+// every line received in response.  This is intended for debugging and
+// for commands that are not modelled by Command
+func (amp *Amplifier) SendRaw(line string) ([]string, error) {
+	resp := &RawResponse{}
+	err := amp.write(0, "", line, resp)
+	return resp.Lines, err
 }
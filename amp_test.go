@@ -2,7 +2,13 @@ package monoprice
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"log"
+	"math"
+	"os"
 	"strings"
 	"testing"
 )
@@ -32,3 +38,396 @@ func TestAmpQueryState(t *testing.T) {
 		})
 	}
 }
+
+func TestAmpStates(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[ZoneID]int
+		wantErr error
+	}{
+		{"Unit", "?10\r\n#>1100000000130705100301\r\r\n#>1200000000200705100301\r\r\n#", map[ZoneID]int{11: 13, 12: 20}, nil},
+		{"Fallback", "?10\r\n#garbled\r\n#?11\r\n#>1100000000130705100301\r\r\n#?12\r\n#>1200000000200705100301\r\r\n#", map[ZoneID]int{11: 13, 12: 20}, nil},
+		{"Short", "?10\r\n#>1100000000130705100301\r\r\n#", map[ZoneID]int{}, ErrReadTimeout},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			amp := &Amplifier{
+				reader: bufio.NewReader(strings.NewReader(test.input)),
+				writer: io.Discard,
+			}
+			amp.zones = []Zone{newZone(11, amp), newZone(12, amp)}
+
+			states, gotErr := amp.States()
+			if !errors.Is(gotErr, test.wantErr) {
+				t.Fatalf("Wanted error %v got %v", test.wantErr, gotErr)
+			}
+
+			for zone, volume := range test.want {
+				if states[zone].Volume != volume {
+					t.Errorf("Wanted zone %d volume %d got %d", zone, volume, states[zone].Volume)
+				}
+			}
+		})
+	}
+}
+
+func TestAmpTransaction(t *testing.T) {
+	var written strings.Builder
+	amp := &Amplifier{
+		reader: bufio.NewReader(strings.NewReader("?11\r\n#>1100000000130705100301\r\r\n#<11VO14\r\n#")),
+		writer: &written,
+	}
+
+	err := amp.Transaction(func(tx *Tx) error {
+		state, err := tx.QueryState(11)
+		if err == nil {
+			err = tx.SendCommand(11, SetVolume, state.Volume+1)
+		}
+		return err
+	})
+
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if written.String() != "?11\r\n<11VO14\r\n" {
+		t.Errorf("Wanted query then command got %q", written.String())
+	}
+}
+
+func TestAmpAdjust(t *testing.T) {
+	query := "?11\r\n#>1100000000130705100301\r\r\n#"
+	tests := []struct {
+		name    string
+		cmd     Command
+		delta   int
+		input   string
+		want    string
+		wantErr error
+		missed  int
+	}{
+		{"Volume up", SetVolume, 2, query + "<11VO15\r\n#", "<11VO15", nil, 0},
+		{"Volume limit", SetVolume, 40, query + "<11VO38\r\n#", "<11VO38", nil, 0},
+		{"Huge step", SetVolume, math.MaxInt, query + "<11VO38\r\n#", "<11VO38", nil, 0},
+		{"Huge step down", SetVolume, math.MinInt, query + "<11VO00\r\n#", "<11VO00", nil, 0},
+		{"Treble floor", SetTreble, -10, query + "<11TR00\r\n#", "<11TR00", nil, 0},
+		{"Balance down", SetBalance, -1, query + "<11BL09\r\n#", "<11BL09", nil, 0},
+		{"Power toggle", SetPower, 0, query + "<11PR01\r\n#", "<11PR01", nil, 0},
+		{"Not a level", SetSource, 1, query, "", ErrCommand, 0},
+		{"Query failed", SetVolume, 1, "", "", ErrReadTimeout, 0},
+		{"Query missed", SetVolume, 2, query + "<11VO15\r\n#", "<11VO15", nil, 2},
+		{"Toggle query missed", SetPower, 0, query + "<11PR01\r\n#", "<11PR01", nil, 1},
+		{"Query never answered", SetVolume, 1, "", "", ErrUnknownState, QueryRetryLimit},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chunks := []string{}
+			for i := 0; i < test.missed; i++ {
+				chunks = append(chunks, "?11\r\n#")
+			}
+
+			var written strings.Builder
+			amp := &Amplifier{
+				reader: bufio.NewReader(&timeoutReader{chunks: append(chunks, test.input)}),
+				writer: &written,
+			}
+
+			var err error
+			if test.cmd == SetPower {
+				_, err = amp.Toggle(11, test.cmd)
+			} else {
+				_, err = amp.Adjust(11, test.cmd, test.delta)
+			}
+
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Wanted error %v got %v", test.wantErr, err)
+			}
+
+			lines := strings.Split(strings.TrimSpace(written.String()), "\r\n")
+			if got := lines[len(lines)-1]; test.want != "" && got != test.want {
+				t.Errorf("Wanted command %q got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestAmpSendCommandRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmd     Command
+		arg     interface{}
+		wantErr error
+	}{
+		{"Volume", SetVolume, MaxVolume, nil},
+		{"Volume too high", SetVolume, 99, ErrCommand},
+		{"Balance negative", SetBalance, -5, ErrCommand},
+		{"Treble too high", SetTreble, MaxTone + 1, ErrCommand},
+		{"Source", SetSource, MaxSource, nil},
+		{"Source zero", SetSource, 0, ErrCommand},
+		{"Source too high", SetSource, MaxSource + 1, ErrCommand},
+		{"Power", SetPower, "01", nil},
+		{"Power number", SetPower, 1, nil},
+		{"DND number", SetDND, 1, nil},
+		{"DND string", SetDND, "00", nil},
+		{"DND out of range", SetDND, 2, ErrCommand},
+		{"Mute bool", SetMute, true, ErrCommand},
+		{"Mute word", SetMute, "on", ErrCommand},
+		{"Volume string", SetVolume, "20", ErrCommand},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var written strings.Builder
+			amp := &Amplifier{
+				reader: bufio.NewReader(strings.NewReader("")),
+				writer: &written,
+			}
+
+			err := amp.SendCommand(11, test.cmd, test.arg)
+			if test.wantErr == nil {
+				if written.Len() == 0 {
+					t.Errorf("Wanted the command to be sent")
+				}
+			} else if !errors.Is(err, test.wantErr) {
+				t.Errorf("Wanted error %v got %v", test.wantErr, err)
+			} else if written.Len() != 0 {
+				t.Errorf("Wanted nothing sent got %q", written.String())
+			}
+		})
+	}
+}
+
+func TestCommandFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmd     Command
+		arg     interface{}
+		want    string
+		wantErr error
+	}{
+		{"Power string", SetPower, "01", "01", nil},
+		{"Power number", SetPower, 0, "00", nil},
+		{"DND number", SetDND, 1, "01", nil},
+		{"DND string", SetDND, "01", "01", nil},
+		{"Volume", SetVolume, 5, "05", nil},
+		{"DND bool", SetDND, true, "", ErrCommand},
+		{"Source string", SetSource, "2", "", ErrCommand},
+		{"No argument", PA, nil, "", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.cmd.format(test.arg)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Wanted error %v got %v", test.wantErr, err)
+			}
+
+			if got != test.want {
+				t.Errorf("Wanted %q got %q", test.want, got)
+			}
+		})
+	}
+}
+
+// timeoutReader returns each chunk followed by io.EOF, the way reads
+// from the serial port time out between responses
+type timeoutReader struct {
+	chunks []string
+}
+
+func (tr *timeoutReader) Read(p []byte) (int, error) {
+	if len(tr.chunks) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, tr.chunks[0])
+	tr.chunks[0] = tr.chunks[0][n:]
+	if tr.chunks[0] == "" {
+		tr.chunks = tr.chunks[1:]
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestTxState(t *testing.T) {
+	missed := "?11\r\n#"
+	answered := "?11\r\n#>1100000000130705100301\r\r\n#"
+	tests := []struct {
+		name    string
+		chunks  []string
+		wantErr error
+	}{
+		{"Answered", []string{answered}, nil},
+		{"Retried", []string{missed, missed, answered}, nil},
+		{"Never answered", []string{missed, missed, missed, answered}, ErrUnknownState},
+		{"Link down", nil, ErrReadTimeout},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			amp := &Amplifier{
+				reader: bufio.NewReader(&timeoutReader{chunks: test.chunks}),
+				writer: io.Discard,
+			}
+
+			var state State
+			err := amp.Transaction(func(tx *Tx) (err error) {
+				state, err = tx.State(11)
+				return err
+			})
+
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Wanted error %v got %v", test.wantErr, err)
+			}
+
+			if test.wantErr == nil && state.Volume != 13 {
+				t.Errorf("Wanted volume 13 got %d", state.Volume)
+			}
+		})
+	}
+}
+
+type failWriter struct{}
+
+func (failWriter) Write([]byte) (int, error) { return 0, io.ErrClosedPipe }
+
+func TestAmpErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		writer       io.Writer
+		input        string
+		query        bool
+		wantErr      error
+		wantCommand  string
+		wantResponse string
+	}{
+		{"Link Down", failWriter{}, "", false, ErrLinkDown, "VO", ""},
+		{"Read Timeout", io.Discard, "", false, ErrReadTimeout, "VO", ""},
+		{"Wrong Echo", io.Discard, "<11VO21\r\n#", false, ErrInvalidResponse, "VO", "<11VO21\r\n#"},
+		{"Invalid Zone", io.Discard, "?11\r\n#", true, ErrInvalidZone, "query", "?11\r\n#"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			amp := Amplifier{
+				reader: bufio.NewReader(strings.NewReader(test.input)),
+				writer: test.writer,
+			}
+
+			var gotErr error
+			if test.query {
+				_, gotErr = amp.QueryState(11)
+			} else {
+				gotErr = amp.SendCommand(11, SetVolume, 20)
+			}
+
+			if !errors.Is(gotErr, test.wantErr) {
+				t.Fatalf("Wanted error %v got %v", test.wantErr, gotErr)
+			}
+
+			ampErr := &AmpError{}
+			if !errors.As(gotErr, &ampErr) {
+				t.Fatalf("Wanted *AmpError got %T", gotErr)
+			}
+
+			if ampErr.Zone != 11 {
+				t.Errorf("Wanted zone 11 got %d", ampErr.Zone)
+			}
+
+			if ampErr.Command != test.wantCommand {
+				t.Errorf("Wanted command %q got %q", test.wantCommand, ampErr.Command)
+			}
+
+			if !strings.HasSuffix(ampErr.Request, "\r\n") {
+				t.Errorf("Wanted the raw request got %q", ampErr.Request)
+			}
+
+			if ampErr.Response != test.wantResponse {
+				t.Errorf("Wanted response %q got %q", test.wantResponse, ampErr.Response)
+			}
+		})
+	}
+}
+
+type panicResponse struct{ EchoResponse }
+
+func (*panicResponse) Read(ampReader) error { panic("garbled") }
+
+func TestAmpWriteRecover(t *testing.T) {
+	amp := Amplifier{
+		reader: bufio.NewReader(strings.NewReader("")),
+		writer: io.Discard,
+	}
+	gotErr := amp.write(11, "query", "?11", &panicResponse{})
+	if !errors.Is(gotErr, ErrInvalidResponse) {
+		t.Errorf("Wanted error %v got %v", ErrInvalidResponse, gotErr)
+	}
+
+	// the mutex must have been released
+	amp.mutex.Lock()
+	amp.mutex.Unlock()
+}
+
+type testLogger struct {
+	lines []string
+}
+
+func (tl *testLogger) log(level, msg string, args []any) {
+	tl.lines = append(tl.lines, fmt.Sprintf("%s %s %v", level, msg, args))
+}
+
+func (tl *testLogger) Debug(msg string, args ...any) { tl.log("DEBUG", msg, args) }
+func (tl *testLogger) Info(msg string, args ...any)  { tl.log("INFO", msg, args) }
+func (tl *testLogger) Warn(msg string, args ...any)  { tl.log("WARN", msg, args) }
+func (tl *testLogger) Error(msg string, args ...any) { tl.log("ERROR", msg, args) }
+
+func TestAmpLogging(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	input := "?11\r\n#>1100000000130705100301\r\r\n#"
+	amp := Amplifier{
+		reader: bufio.NewReader(strings.NewReader(input)),
+		writer: io.Discard,
+	}
+
+	// without a logger nothing is logged
+	if _, err := amp.QueryState(11); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if buf.Len() > 0 {
+		t.Errorf("Wanted no log output got %q", buf.String())
+	}
+
+	logger := &testLogger{}
+	LoggerOption(logger)(&amp)
+	amp.reader = bufio.NewReader(strings.NewReader(input))
+	if _, err := amp.QueryState(11); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	want := []string{
+		`DEBUG TX [zone 11 command query line ?11` + "\r\n" + `]`,
+		`DEBUG RX [line ?11` + "\r\n" + `#]`,
+		`DEBUG RX [line >1100000000130705100301` + "\r\r\n" + `#]`,
+	}
+
+	if len(logger.lines) != 4 {
+		t.Fatalf("Wanted 4 log lines got %q", logger.lines)
+	}
+
+	for i, line := range want {
+		if logger.lines[i] != line {
+			t.Errorf("Wanted %q got %q", line, logger.lines[i])
+		}
+	}
+
+	if !strings.HasPrefix(logger.lines[3], "DEBUG command finished [zone 11 command query line ?11 latency ") {
+		t.Errorf("Wanted command finished with latency got %q", logger.lines[3])
+	}
+}
@@ -1,13 +1,18 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/abates/monoprice"
 	"github.com/gorilla/mux"
@@ -28,31 +33,191 @@ func ParseInt(str string) (interface{}, error) {
 	return strconv.Atoi(str)
 }
 
+// Attribute is a part of a zone's state with its own route.  Every
+// attribute can be read with GET /{zone}/{name}, and those with a Decoder
+// can be set with PUT /{zone}/{name}/{value}
+type Attribute struct {
+	Name    string
+	Command monoprice.Command
+	Decoder func(string) (interface{}, error)
+	Value   func(monoprice.State) interface{}
+}
+
+// Attributes lists the attributes for every command the amplifier
+// understands.  The PA and keypad status are only reported by the
+// amplifier, so they can't be set
+var Attributes = []Attribute{
+	{"pa", monoprice.PA, nil, func(s monoprice.State) interface{} { return s.PA }},
+	{"power", monoprice.SetPower, ParseBool, func(s monoprice.State) interface{} { return s.Power }},
+	{"mute", monoprice.SetMute, ParseBool, func(s monoprice.State) interface{} { return s.Mute }},
+	{"dnd", monoprice.SetDND, ParseBool, func(s monoprice.State) interface{} { return s.DoNotDisturb }},
+	{"volume", monoprice.SetVolume, ParseInt, func(s monoprice.State) interface{} { return s.Volume }},
+	{"treble", monoprice.SetTreble, ParseInt, func(s monoprice.State) interface{} { return s.Treble }},
+	{"bass", monoprice.SetBass, ParseInt, func(s monoprice.State) interface{} { return s.Bass }},
+	{"balance", monoprice.SetBalance, ParseInt, func(s monoprice.State) interface{} { return s.Balance }},
+	{"source", monoprice.SetSource, ParseInt, func(s monoprice.State) interface{} { return s.Source }},
+	{"keypad", monoprice.GetKeypadStatus, nil, func(s monoprice.State) interface{} { return s.KeyPad }},
+}
+
 type api struct {
-	amp   *monoprice.Amplifier
-	zones sync.Map
+	name       string
+	amp        *monoprice.Amplifier
+	zones      sync.Map
+	raw        bool
+	onCommand  CommandFunc
+	zoneFilter ZoneFilterFunc
+	monitor    func(amp string) *monoprice.Monitor
+}
+
+type Option func(*api)
+
+// CommandFunc is called with the outcome of every command the API sends
+// to a zone, along with the name of the zone's amp
+type CommandFunc func(r *http.Request, amp string, zone monoprice.ZoneID, cmd monoprice.Command, arg interface{}, err error)
+
+// CommandOption sets a function to be called after every command, for
+// instance to keep an audit log
+func CommandOption(fn CommandFunc) Option {
+	return func(a *api) {
+		a.onCommand = fn
+	}
+}
+
+// ZoneFilterFunc reports whether a request may see a zone
+type ZoneFilterFunc func(r *http.Request, amp string, zone monoprice.ZoneID) bool
+
+// ZoneFilterOption limits the zones returned by GET /zones/status, for
+// instance to the zones an API key may use
+func ZoneFilterOption(fn ZoneFilterFunc) Option {
+	return func(a *api) {
+		a.zoneFilter = fn
+	}
+}
+
+// MonitorOption sets the function used to find an amplifier's monitor,
+// which lets GET /{zone}/status wait for the zone to change.  The
+// function is called for every request so monitors may be replaced
+func MonitorOption(fn func(amp string) *monoprice.Monitor) Option {
+	return func(a *api) {
+		a.monitor = fn
+	}
+}
+
+// MaxWait is the longest a status request will wait for a change
+const MaxWait = 5 * time.Minute
+
+type waitingKey struct{}
+
+// WithWaiting returns a copy of ctx that calls fn once a status request
+// has read the zone's state and starts waiting for it to change.  From
+// then on the request doesn't use the amplifier, so middleware limiting
+// requests to the amplifier can let it go
+func WithWaiting(ctx context.Context, fn func()) context.Context {
+	return context.WithValue(ctx, waitingKey{}, fn)
+}
+
+// RawOption enables the POST /raw endpoint that passes arbitrary
+// protocol lines to the amplifier.  The route is an admin route, see
+// AdminRoute
+func RawOption() Option {
+	return func(a *api) {
+		a.raw = true
+	}
+}
+
+// AdminRoute reports whether the request matched a route that requires
+// administrative access
+func AdminRoute(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	return route != nil && strings.HasPrefix(route.GetName(), "admin.")
+}
+
+// New creates the API for a single amplifier
+func New(amp *monoprice.Amplifier, options ...Option) *mux.Router {
+	return NewMulti(map[string]*monoprice.Amplifier{DefaultAmp: amp}, DefaultAmp, options...)
+}
+
+// DefaultAmp is the name given to the amplifier passed to New
+const DefaultAmp = "default"
+
+// NewMulti creates the API for several amplifiers.  Each amplifier's
+// routes are available under /amps/{name}, and the routes for the
+// default amplifier are also available at the top level
+func NewMulti(amps map[string]*monoprice.Amplifier, defaultAmp string, options ...Option) *mux.Router {
+	r := mux.NewRouter()
+	names := []string{}
+	for name := range amps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	r.HandleFunc("/amps", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(names)
+	}).Methods("GET")
+
+	apis := make(map[string]*api)
+	for _, name := range names {
+		apis[name] = newAPI(name, amps[name], options...)
+		// the name is a route variable so middleware can tell which amp
+		// a request is for
+		prefix := "/amps/{name:" + regexp.QuoteMeta(name) + "}"
+		apis[name].routes(r.PathPrefix(prefix).Subrouter(), "/zones", name+".")
+	}
+
+	if a, found := apis[defaultAmp]; found {
+		a.routes(r, "", "")
+	}
+	return r
 }
 
-func New(amp *monoprice.Amplifier) *mux.Router {
-	a := &api{amp: amp}
+func newAPI(name string, amp *monoprice.Amplifier, options ...Option) *api {
+	a := &api{name: name, amp: amp}
+
+	for _, option := range options {
+		option(a)
+	}
 
 	for _, zone := range a.amp.Zones() {
 		a.zones.Store(zone.ID(), zone)
 	}
+	return a
+}
 
-	r := mux.NewRouter()
+// routes registers the API routes.  Routes for individual zones are
+// registered beneath zonePrefix and route names are prefixed with
+// namePrefix
+func (a *api) routes(r *mux.Router, zonePrefix, namePrefix string) {
 	r.HandleFunc("/zones", http.HandlerFunc(a.listZones)).Methods("GET")
-	r.HandleFunc("/{zone}/status", a.zoneHandler(a.status)).Methods("GET")
-	r.HandleFunc("/{zone}/power/{power}", a.sendCommand(monoprice.SetPower, "power", ParseBool)).Methods("PUT")
-	r.HandleFunc("/{zone}/mute/{mute}", a.sendCommand(monoprice.SetMute, "power", ParseBool)).Methods("PUT")
-	r.HandleFunc("/{zone}/volume/{level}", a.sendCommand(monoprice.SetVolume, "level", ParseInt)).Methods("PUT")
-	r.HandleFunc("/{zone}/treble/{level}", a.sendCommand(monoprice.SetTreble, "level", ParseInt)).Methods("PUT")
-	r.HandleFunc("/{zone}/bass/{level}", a.sendCommand(monoprice.SetBass, "level", ParseInt)).Methods("PUT")
-	r.HandleFunc("/{zone}/balance/{level}", a.sendCommand(monoprice.SetBalance, "level", ParseInt)).Methods("PUT")
-	r.HandleFunc("/{zone}/source/{source}", a.sendCommand(monoprice.SetSource, "source", ParseInt)).Methods("PUT")
-	r.HandleFunc("/{zone}/restore", a.zoneHandler(a.restore)).Methods("PUT")
+	// registered before the zone routes so "status" isn't taken for a zone
+	r.HandleFunc("/zones/status", a.allStatus).Methods("GET")
+	r.HandleFunc(zonePrefix+"/{zone}/status", a.zoneHandler(a.status)).Methods("GET")
+	for _, attr := range Attributes {
+		r.HandleFunc(zonePrefix+"/{zone}/"+attr.Name, a.zoneHandler(a.attribute(attr))).Methods("GET")
+		if attr.Decoder != nil {
+			r.HandleFunc(zonePrefix+"/{zone}/"+attr.Name+"/{value}", a.sendCommand(attr.Command, "value", attr.Decoder)).Methods("PUT")
+		}
+	}
+	r.HandleFunc(zonePrefix+"/{zone}/restore", a.zoneHandler(a.restore)).Methods("PUT")
 
-	return r
+	// relative changes read and write the zone atomically and return its
+	// new state
+	r.HandleFunc(zonePrefix+"/{zone}/power/toggle", a.toggle(monoprice.SetPower)).Methods("POST")
+	r.HandleFunc(zonePrefix+"/{zone}/mute/toggle", a.toggle(monoprice.SetMute)).Methods("POST")
+	for name, cmd := range map[string]monoprice.Command{
+		"volume":  monoprice.SetVolume,
+		"treble":  monoprice.SetTreble,
+		"bass":    monoprice.SetBass,
+		"balance": monoprice.SetBalance,
+	} {
+		r.HandleFunc(zonePrefix+"/{zone}/"+name+"/up", a.adjust(cmd, 1)).Methods("POST")
+		r.HandleFunc(zonePrefix+"/{zone}/"+name+"/down", a.adjust(cmd, -1)).Methods("POST")
+	}
+
+	if a.raw {
+		r.HandleFunc("/raw", a.sendRaw).Methods("POST").Name("admin." + namePrefix + "raw")
+	}
 }
 
 func (a *api) listZones(w http.ResponseWriter, r *http.Request) {
@@ -67,6 +232,26 @@ func (a *api) listZones(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(ids)
 }
 
+// allStatus returns the state of every zone, keyed by zone id
+func (a *api) allStatus(w http.ResponseWriter, r *http.Request) {
+	states, err := a.amp.States()
+	if err != nil {
+		log.Printf("Failed to determine zone states: %v", err)
+		WriteError(w, err)
+		return
+	}
+
+	for zone := range states {
+		if a.zoneFilter != nil && !a.zoneFilter(r, a.name, zone) {
+			delete(states, zone)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(states)
+}
+
 func (a *api) zoneHandler(handler func(monoprice.Zone, http.ResponseWriter, *http.Request)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -76,11 +261,11 @@ func (a *api) zoneHandler(handler func(monoprice.Zone, http.ResponseWriter, *htt
 				handler(zone.(monoprice.Zone), w, r)
 			} else {
 				log.Printf("Zone %d not found", id)
-				http.Error(w, "Zone not found", http.StatusNotFound)
+				WriteZoneError(w, monoprice.ZoneID(id), fmt.Errorf("%w %d", monoprice.ErrInvalidZone, id))
 			}
 		} else {
 			log.Printf("Failed to convert zone %q to integer: %v", vars["zone"], err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			WriteError(w, fmt.Errorf("%w zone %q", ErrInvalidArgument, vars["zone"]))
 		}
 	}
 }
@@ -90,7 +275,14 @@ func (a *api) sendCommand(cmd monoprice.Command, v string, decoder func(string)
 		vars := mux.Vars(r)
 		arg, err := decoder(vars[v])
 		if err == nil {
-			err = zone.SendCommand(cmd, arg)
+			err = cmd.CheckRange(arg)
+		}
+
+		if err == nil {
+			err = SendIfMatch(r, a.amp, zone.ID(), func(tx *monoprice.Tx) error {
+				return tx.SendCommand(zone.ID(), cmd, arg)
+			})
+			a.commandSent(r, zone.ID(), cmd, arg, err)
 
 			if err == nil {
 				w.Header().Set("Content-Type", "application/json")
@@ -98,30 +290,246 @@ func (a *api) sendCommand(cmd monoprice.Command, v string, decoder func(string)
 				w.Write([]byte(`{}`))
 			} else {
 				log.Printf("Failed sending command to amp: %v", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				WriteZoneError(w, zone.ID(), err)
 			}
 		} else {
 			log.Printf("Failed decoding command variable %q: %v", vars[v], err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			WriteZoneError(w, zone.ID(), fmt.Errorf("%w %s %q: %w", ErrInvalidArgument, v, vars[v], err))
 		}
 	})
 }
 
 func (a *api) status(zone monoprice.Zone, w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Has("wait") {
+		a.waitStatus(zone, w, r)
+	} else {
+		a.writeStatus(zone, w)
+	}
+}
+
+// waitStatus long polls a zone's state.  It returns as soon as the state's
+// ETag differs from the since parameter, which may be sent with or
+// without its quotes and weak prefix, or with 304 Not Modified once the
+// wait has passed.  Changes are found by the amplifier's monitor, so they
+// are seen at most one poll interval after they happen.  If the monitor
+// is stopped the current state is returned
+func (a *api) waitStatus(zone monoprice.Zone, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	wait, err := time.ParseDuration(query.Get("wait"))
+	if err != nil || wait <= 0 {
+		log.Printf("Invalid wait %q", query.Get("wait"))
+		WriteZoneError(w, zone.ID(), fmt.Errorf("%w wait %q, must be a positive duration", ErrInvalidArgument, query.Get("wait")))
+		return
+	}
+	wait = min(wait, MaxWait)
+
+	var monitor *monoprice.Monitor
+	if a.monitor != nil {
+		monitor = a.monitor(a.name)
+	}
+
+	since := query.Get("since")
+	if monitor == nil || since == "" {
+		a.writeStatus(zone, w)
+		return
+	}
+
+	// subscribe before reading the state so a change in between isn't
+	// missed
+	events, unsubscribe := monitor.Subscribe()
+	defer unsubscribe()
+
+	since = opaqueTag(since)
+	state, err := zone.State()
+	if err != nil || opaqueTag(ETag(state)) != since {
+		a.writeState(zone, w, state, err)
+		return
+	}
+
+	if waiting, ok := r.Context().Value(waitingKey{}).(func()); ok {
+		waiting()
+	}
+
+	// the server's write timeout would otherwise end the wait early
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + 10*time.Second))
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timer.C:
+			w.Header().Set("ETag", ETag(state))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case event, ok := <-events:
+			if !ok {
+				// the monitor was stopped, so report whatever the zone is now
+				a.writeStatus(zone, w)
+				return
+			}
+
+			for _, change := range event.Changes {
+				if change.Zone == zone.ID() && opaqueTag(ETag(change.Current)) != since {
+					a.writeState(zone, w, change.Current, nil)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (a *api) writeStatus(zone monoprice.Zone, w http.ResponseWriter) {
 	state, err := zone.State()
-	if err == nil || errors.Is(monoprice.ErrUnknownState, err) {
+	a.writeState(zone, w, state, err)
+}
+
+func (a *api) writeState(zone monoprice.Zone, w http.ResponseWriter, state monoprice.State, err error) {
+	if err == nil || errors.Is(err, monoprice.ErrUnknownState) {
 		w.Header().Set("Content-Type", "application/json")
 		status := http.StatusOK
-		if err != nil {
+		if err == nil {
+			w.Header().Set("ETag", ETag(state))
+		} else {
 			status = http.StatusServiceUnavailable
 		}
 		w.WriteHeader(status)
 		json.NewEncoder(w).Encode(state)
 	} else {
 		log.Printf("Failed to determine zone status: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		WriteZoneError(w, zone.ID(), err)
 	}
 }
 
+// adjust moves a level up (sign 1) or down (sign -1) by the request's
+// step, which defaults to 1
+func (a *api) adjust(cmd monoprice.Command, sign int) func(w http.ResponseWriter, r *http.Request) {
+	return a.zoneHandler(func(zone monoprice.Zone, w http.ResponseWriter, r *http.Request) {
+		step := 1
+		if str := r.URL.Query().Get("step"); str != "" {
+			var err error
+			step, err = strconv.Atoi(str)
+			if err != nil || step < 1 {
+				log.Printf("Invalid step %q", str)
+				WriteZoneError(w, zone.ID(), fmt.Errorf("%w step %q, must be a positive integer", ErrInvalidArgument, str))
+				return
+			}
+		}
+
+		// a step past the whole range only reaches the limit, and capping
+		// it keeps the level's arithmetic from overflowing
+		if _, hi, ok := cmd.Range(); ok {
+			step = min(step, hi)
+		}
+
+		state, err := a.amp.Adjust(zone.ID(), cmd, sign*step)
+		a.relativeSent(w, r, zone.ID(), cmd, state, err)
+	})
+}
+
+func (a *api) toggle(cmd monoprice.Command) func(w http.ResponseWriter, r *http.Request) {
+	return a.zoneHandler(func(zone monoprice.Zone, w http.ResponseWriter, r *http.Request) {
+		state, err := a.amp.Toggle(zone.ID(), cmd)
+		a.relativeSent(w, r, zone.ID(), cmd, state, err)
+	})
+}
+
+// relativeSent reports the value a relative change sent and responds
+// with the zone's resulting state
+func (a *api) relativeSent(w http.ResponseWriter, r *http.Request, zone monoprice.ZoneID, cmd monoprice.Command, state monoprice.State, err error) {
+	var arg interface{}
+	switch cmd {
+	case monoprice.SetPower:
+		arg, _ = ParseBool(strconv.FormatBool(state.Power))
+	case monoprice.SetMute:
+		arg, _ = ParseBool(strconv.FormatBool(state.Mute))
+	case monoprice.SetVolume:
+		arg = state.Volume
+	case monoprice.SetTreble:
+		arg = state.Treble
+	case monoprice.SetBass:
+		arg = state.Bass
+	case monoprice.SetBalance:
+		arg = state.Balance
+	}
+
+	if err != nil {
+		log.Printf("Failed sending command to amp: %v", err)
+		if state.Zone == 0 {
+			// the zone was never read, so nothing was sent
+			arg = nil
+		}
+		a.commandSent(r, zone, cmd, arg, err)
+		WriteZoneError(w, zone, err)
+		return
+	}
+
+	a.commandSent(r, zone, cmd, arg, nil)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", ETag(state))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(state)
+}
+
+// attribute returns a handler that reads one attribute of a zone's
+// state, returned as an object with the attribute's name as the only key
+func (a *api) attribute(attr Attribute) func(monoprice.Zone, http.ResponseWriter, *http.Request) {
+	return func(zone monoprice.Zone, w http.ResponseWriter, r *http.Request) {
+		state, err := zone.State()
+		if err != nil {
+			log.Printf("Failed to determine zone status: %v", err)
+			WriteZoneError(w, zone.ID(), err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", ETag(state))
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{attr.Name: attr.Value(state)})
+	}
+}
+
+func (a *api) commandSent(r *http.Request, zone monoprice.ZoneID, cmd monoprice.Command, arg interface{}, err error) {
+	if a.onCommand != nil {
+		a.onCommand(r, a.name, zone, cmd, arg, err)
+	}
+}
+
+// restore isn't implemented, nothing is sent to the zone so nothing is
+// reported to the CommandFunc
 func (a *api) restore(zone monoprice.Zone, w http.ResponseWriter, r *http.Request) {
+	WriteErrorCode(w, http.StatusNotImplemented, "not_implemented", "restore is not implemented")
+}
+
+type rawRequest struct {
+	Line string `json:"line"`
+}
+
+type rawResponse struct {
+	Lines []monoprice.ResponseLine `json:"lines"`
+}
+
+func (a *api) sendRaw(w http.ResponseWriter, r *http.Request) {
+	req := rawRequest{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Line == "" {
+		log.Printf("Invalid raw request from %s: %v", r.RemoteAddr, err)
+		WriteError(w, fmt.Errorf("%w, request must contain a protocol line", ErrInvalidArgument))
+		return
+	}
+
+	lines, err := a.amp.SendRaw(req.Line)
+	log.Printf("Raw command %q from %s returned %q (err: %v)", req.Line, r.RemoteAddr, lines, err)
+	if err == nil {
+		resp := rawResponse{Lines: []monoprice.ResponseLine{}}
+		for _, line := range lines {
+			resp.Lines = append(resp.Lines, monoprice.ParseLine(line))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	} else {
+		WriteError(w, err)
+	}
 }
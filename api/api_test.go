@@ -0,0 +1,245 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abates/monoprice"
+	"github.com/abates/monoprice/internal/fakeamp"
+)
+
+func TestAPI(t *testing.T) {
+	fake := fakeamp.New(11, 12)
+	fake.Update(12, func(state *monoprice.State) {
+		state.PA = true
+		state.KeyPad = true
+	})
+
+	amp, err := monoprice.New(fake)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	commands := []string{}
+	handler := New(amp, RawOption(), CommandOption(func(r *http.Request, amp string, zone monoprice.ZoneID, cmd monoprice.Command, arg interface{}, err error) {
+		commands = append(commands, string(cmd))
+	}))
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		want     int
+		wantBody string
+	}{
+		{"Amps", "GET", "/amps", "", http.StatusOK, `["default"]`},
+		{"Zones", "GET", "/zones", "", http.StatusOK, `[11,12]`},
+		{"Bulk status", "GET", "/zones/status", "", http.StatusOK, `"12":{"zone":12,"pa":true`},
+		{"Status", "GET", "/11/status", "", http.StatusOK, `{"zone":11,"pa":false,"power":false`},
+		{"PA", "GET", "/12/pa", "", http.StatusOK, `{"pa":true}`},
+		{"Keypad", "GET", "/12/keypad", "", http.StatusOK, `{"keypad":true}`},
+		{"Set power", "PUT", "/11/power/true", "", http.StatusOK, `{}`},
+		{"Power", "GET", "/11/power", "", http.StatusOK, `{"power":true}`},
+		{"Set mute", "PUT", "/11/mute/true", "", http.StatusOK, `{}`},
+		{"Mute", "GET", "/11/mute", "", http.StatusOK, `{"mute":true}`},
+		{"Set DND", "PUT", "/11/dnd/true", "", http.StatusOK, `{}`},
+		{"DND", "GET", "/11/dnd", "", http.StatusOK, `{"dnd":true}`},
+		{"Set volume", "PUT", "/11/volume/20", "", http.StatusOK, `{}`},
+		{"Volume", "GET", "/11/volume", "", http.StatusOK, `{"volume":20}`},
+		{"Set treble", "PUT", "/11/treble/9", "", http.StatusOK, `{}`},
+		{"Treble", "GET", "/11/treble", "", http.StatusOK, `{"treble":9}`},
+		{"Set bass", "PUT", "/11/bass/5", "", http.StatusOK, `{}`},
+		{"Bass", "GET", "/11/bass", "", http.StatusOK, `{"bass":5}`},
+		{"Set balance", "PUT", "/11/balance/12", "", http.StatusOK, `{}`},
+		{"Balance", "GET", "/11/balance", "", http.StatusOK, `{"balance":12}`},
+		{"Set source", "PUT", "/11/source/3", "", http.StatusOK, `{}`},
+		{"Source", "GET", "/11/source", "", http.StatusOK, `{"source":3}`},
+		{"Volume up", "POST", "/11/volume/up?step=2", "", http.StatusOK, `"volume":22`},
+		{"Bass down", "POST", "/11/bass/down", "", http.StatusOK, `"bass":4`},
+		{"Treble up huge step", "POST", "/11/treble/up?step=9223372036854775807", "", http.StatusOK, `"treble":14`},
+		{"Treble down huge step", "POST", "/11/treble/down?step=9223372036854775807", "", http.StatusOK, `"treble":0`},
+		{"Treble back", "PUT", "/11/treble/9", "", http.StatusOK, `{}`},
+		{"Mute toggle", "POST", "/11/mute/toggle", "", http.StatusOK, `"mute":false`},
+		{"Power toggle", "POST", "/11/power/toggle", "", http.StatusOK, `"power":false`},
+		{"Restore", "PUT", "/11/restore", "", http.StatusNotImplemented, `"code":"not_implemented"`},
+		{"Raw", "POST", "/raw", `{"line":"?12"}`, http.StatusOK, `"lines":[`},
+		{"Set PA", "PUT", "/12/pa/true", "", http.StatusNotFound, ``},
+		{"Set keypad", "PUT", "/12/keypad/true", "", http.StatusNotFound, ``},
+		{"Invalid value", "PUT", "/11/mute/maybe", "", http.StatusBadRequest, `"code":"invalid_argument"`},
+		{"Volume too high", "PUT", "/11/volume/99", "", http.StatusBadRequest, `"code":"invalid_argument"`},
+		{"Balance negative", "PUT", "/11/balance/-5", "", http.StatusBadRequest, `"code":"invalid_argument"`},
+		{"Source zero", "PUT", "/11/source/0", "", http.StatusBadRequest, `"code":"invalid_argument"`},
+		{"Source too high", "PUT", "/11/source/7", "", http.StatusBadRequest, `"code":"invalid_argument"`},
+		{"Invalid zone", "GET", "/13/volume", "", http.StatusNotFound, `"code":"invalid_zone"`},
+		{"Invalid zone id", "GET", "/kitchen/volume", "", http.StatusBadRequest, `"code":"invalid_argument"`},
+		{"Invalid raw", "POST", "/raw", `{}`, http.StatusBadRequest, `"code":"invalid_argument"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != test.want {
+				t.Errorf("Wanted status %d got %d (%s)", test.want, w.Code, w.Body.String())
+			} else if !strings.Contains(w.Body.String(), test.wantBody) {
+				t.Errorf("Wanted body containing %q got %q", test.wantBody, w.Body.String())
+			}
+		})
+	}
+
+	want := monoprice.State{Zone: 11, DoNotDisturb: true, Volume: 22, Treble: 9, Bass: 4, Balance: 12, Source: 3}
+	if got := fake.State(11); got != want {
+		t.Errorf("Wanted zone 11 state %+v got %+v", want, got)
+	}
+
+	wantCommands := "PR MU DT VO TR BS BL CH VO BS TR TR TR MU PR"
+	if got := strings.Join(commands, " "); got != wantCommands {
+		t.Errorf("Wanted commands %q got %q", wantCommands, got)
+	}
+}
+
+func TestSendIfMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		ifMatch  bool
+		etag     string
+		missed   int
+		wantErr  error
+		wantSent bool
+	}{
+		{"No If-Match", false, "", monoprice.QueryRetryLimit, nil, true},
+		{"Match", true, "", 0, nil, true},
+		{"Match after missed queries", true, "", monoprice.QueryRetryLimit - 1, nil, true},
+		{"Never answered", true, "", monoprice.QueryRetryLimit, monoprice.ErrUnknownState, false},
+		{"Stale", true, `"0000"`, 0, ErrPreconditionFailed, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := fakeamp.New(11)
+			amp, err := monoprice.New(fake)
+			if err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+
+			req := httptest.NewRequest("PUT", "/11/volume/20", nil)
+			if test.ifMatch {
+				etag := test.etag
+				if etag == "" {
+					etag = ETag(fake.State(11))
+				}
+				req.Header.Set("If-Match", etag)
+			}
+			fake.Miss(11, test.missed)
+
+			sent := false
+			err = SendIfMatch(req, amp, 11, func(tx *monoprice.Tx) error {
+				sent = true
+				return nil
+			})
+
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("Wanted error %v got %v", test.wantErr, err)
+			}
+
+			if sent != test.wantSent {
+				t.Errorf("Wanted sent %v got %v", test.wantSent, sent)
+			}
+		})
+	}
+}
+
+func TestAPIWait(t *testing.T) {
+	fake := fakeamp.New(11)
+	amp, err := monoprice.New(fake)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	monitor := monoprice.NewMonitor(amp.Zones(), time.Hour)
+	monitor.Poll()
+	handler := New(amp, MonitorOption(func(string) *monoprice.Monitor { return monitor }))
+
+	etag := ETag(fake.State(11))
+	tests := []struct {
+		name     string
+		query    string
+		change   bool
+		want     int
+		wantBody string
+	}{
+		{"Invalid wait", "wait=soon&since=" + etag, false, http.StatusBadRequest, `"code":"invalid_argument"`},
+		{"No since", "wait=1s", false, http.StatusOK, `"volume":10`},
+		{"Stale", `wait=1s&since="0000"`, false, http.StatusOK, `"volume":10`},
+		{"Timeout", "wait=20ms&since=" + etag, false, http.StatusNotModified, ""},
+		{"Unquoted", "wait=20ms&since=" + strings.Trim(etag, `"`), false, http.StatusNotModified, ""},
+		{"Weak", "wait=20ms&since=W/" + etag, false, http.StatusNotModified, ""},
+		{"Changed", "wait=10s&since=" + etag, true, http.StatusOK, `"volume":25`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			done := make(chan struct{})
+			if test.change {
+				go func() {
+					// change the zone once the request is likely waiting
+					time.Sleep(20 * time.Millisecond)
+					fake.Update(11, func(state *monoprice.State) { state.Volume = 25 })
+
+					// keep polling until the request has subscribed and
+					// seen the change
+					for {
+						monitor.Poll()
+						select {
+						case <-done:
+							return
+						case <-time.After(10 * time.Millisecond):
+						}
+					}
+				}()
+			}
+
+			req := httptest.NewRequest("GET", "/11/status?"+test.query, nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			close(done)
+
+			if w.Code != test.want {
+				t.Errorf("Wanted status %d got %d (%s)", test.want, w.Code, w.Body.String())
+			} else if !strings.Contains(w.Body.String(), test.wantBody) {
+				t.Errorf("Wanted body containing %q got %q", test.wantBody, w.Body.String())
+			}
+
+			if w.Header().Get("ETag") == "" && test.want != http.StatusBadRequest {
+				t.Errorf("Wanted an ETag got none")
+			} else if got := w.Header().Get("ETag"); test.want == http.StatusNotModified && got != etag {
+				t.Errorf("Wanted ETag %s got %s", etag, got)
+			}
+		})
+	}
+
+	t.Run("Stopped", func(t *testing.T) {
+		// a stopped monitor won't see any more changes, so the wait ends
+		// with the current state
+		stopped := monoprice.NewMonitor(amp.Zones(), time.Hour)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		stopped.Run(ctx)
+
+		handler := New(amp, MonitorOption(func(string) *monoprice.Monitor { return stopped }))
+		req := httptest.NewRequest("GET", "/11/status?wait=1s&since="+ETag(fake.State(11)), nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("Wanted status %d got %d (%s)", http.StatusOK, w.Code, w.Body.String())
+		}
+	})
+}
@@ -0,0 +1,282 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abates/monoprice"
+	"github.com/abates/monoprice/api"
+)
+
+var (
+	ErrUnauthorized = errors.New("not authorized")
+	ErrRateLimited  = errors.New("rate limited")
+	ErrServer       = errors.New("server error")
+)
+
+// commandPaths maps the amplifier commands to the path segment of the
+// corresponding ampserver route
+var commandPaths = map[monoprice.Command]string{
+	monoprice.SetPower:   "power",
+	monoprice.SetMute:    "mute",
+	monoprice.SetDND:     "dnd",
+	monoprice.SetVolume:  "volume",
+	monoprice.SetTreble:  "treble",
+	monoprice.SetBass:    "bass",
+	monoprice.SetBalance: "balance",
+	monoprice.SetSource:  "source",
+}
+
+// Client talks to a remote ampserver.  It mirrors the methods of
+// monoprice.Amplifier so that code written against a local amplifier
+// can be pointed at a server instead
+type Client struct {
+	baseURL    *url.URL
+	zonesPath  string
+	zonePath   string
+	apiKey     string
+	plainKey   bool
+	httpClient *http.Client
+	retries    int
+	retryDelay time.Duration
+	zones      []monoprice.Zone
+}
+
+type Option func(*Client)
+
+// APIKeyOption sets the key used to sign requests.  The key itself is
+// never sent to the server
+func APIKeyOption(key string) Option {
+	return func(c *Client) {
+		c.apiKey = key
+	}
+}
+
+// PlainKeyOption sends the key in the X-Auth-Key header instead of
+// signing requests.  It is for servers that only have the hash of the
+// key, which can check a plain key but not a signature
+func PlainKeyOption() Option {
+	return func(c *Client) {
+		c.plainKey = true
+	}
+}
+
+// AmpOption selects one of the amplifiers on a server with more than
+// one.  Without it the server's default amplifier is used
+func AmpOption(name string) Option {
+	return func(c *Client) {
+		if name != "" {
+			c.zonesPath = "/amps/" + url.PathEscape(name) + "/zones"
+			c.zonePath = c.zonesPath
+		}
+	}
+}
+
+// HTTPClientOption replaces the default http.Client
+func HTTPClientOption(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// RetryOption sets the number of times a request is retried when the
+// server can't be reached or is temporarily unavailable
+func RetryOption(retries int, delay time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.retryDelay = delay
+	}
+}
+
+// New creates a client for the ampserver at baseURL and retrieves the
+// list of zones from the server
+func New(baseURL string, options ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimRight(baseURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		baseURL:    u,
+		zonesPath:  "/zones",
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		retries:    monoprice.QueryRetryLimit,
+		retryDelay: 500 * time.Millisecond,
+	}
+
+	for _, option := range options {
+		option(c)
+	}
+
+	err = c.initZones()
+	return c, err
+}
+
+func (c *Client) Zones() []monoprice.Zone {
+	return c.zones
+}
+
+func (c *Client) initZones() error {
+	ids := []int{}
+	err := c.do(http.MethodGet, c.zonesPath, &ids)
+	if err == nil {
+		c.zones = []monoprice.Zone{}
+		for _, id := range ids {
+			c.zones = append(c.zones, &zone{id: monoprice.ZoneID(id), client: c})
+		}
+	}
+	return err
+}
+
+func (c *Client) QueryState(id monoprice.ZoneID) (state monoprice.State, err error) {
+	err = c.do(http.MethodGet, fmt.Sprintf("%s/%d/status", c.zonePath, id), &state)
+	return state, err
+}
+
+// States returns the state of every zone with a single request
+func (c *Client) States() (states map[monoprice.ZoneID]monoprice.State, err error) {
+	err = c.do(http.MethodGet, c.zonesPath+"/status", &states)
+	return states, err
+}
+
+func (c *Client) SendCommand(id monoprice.ZoneID, cmd monoprice.Command, arg interface{}) error {
+	path, found := commandPaths[cmd]
+	if !found {
+		return fmt.Errorf("%w %q is not supported by the API", monoprice.ErrCommand, cmd)
+	}
+
+	value, err := formatArg(cmd, arg)
+	if err == nil {
+		err = c.do(http.MethodPut, fmt.Sprintf("%s/%d/%s/%s", c.zonePath, id, path, url.PathEscape(value)), nil)
+	}
+	return err
+}
+
+// formatArg converts a command argument, in any of the forms accepted by
+// Amplifier.SendCommand, into the representation used in the API path
+func formatArg(cmd monoprice.Command, arg interface{}) (string, error) {
+	if cmd == monoprice.SetPower || cmd == monoprice.SetMute || cmd == monoprice.SetDND {
+		switch v := arg.(type) {
+		case bool:
+			return strconv.FormatBool(v), nil
+		case string:
+			switch v {
+			case "01":
+				return "true", nil
+			case "00":
+				return "false", nil
+			}
+			if b, err := strconv.ParseBool(v); err == nil {
+				return strconv.FormatBool(b), nil
+			}
+		}
+	} else {
+		switch v := arg.(type) {
+		case int:
+			return strconv.Itoa(v), nil
+		case string:
+			if _, err := strconv.Atoi(v); err == nil {
+				return v, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%w invalid argument %v for %s", monoprice.ErrCommand, arg, cmd)
+}
+
+func (c *Client) do(method, path string, v interface{}) (err error) {
+	for i := 0; i <= c.retries; i++ {
+		if i > 0 {
+			time.Sleep(c.retryDelay)
+		}
+
+		var retry bool
+		retry, err = c.request(method, path, v)
+		if !retry {
+			break
+		}
+	}
+	return err
+}
+
+// request performs a single HTTP request and reports whether a failure
+// is worth retrying
+func (c *Client) request(method, path string, v interface{}) (retry bool, err error) {
+	req, err := http.NewRequest(method, c.baseURL.String()+path, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if c.apiKey != "" && c.plainKey {
+		req.Header.Set("X-Auth-Key", c.apiKey)
+	} else if c.apiKey != "" {
+		api.SignRequest(req, c.apiKey, nil)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		if v != nil {
+			err = json.NewDecoder(resp.Body).Decode(v)
+		}
+		return false, err
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	msg := strings.TrimSpace(string(body))
+	apiErr := api.ErrorResponse{}
+	if json.Unmarshal(body, &apiErr) == nil && apiErr.Error.Message != "" {
+		msg = apiErr.Error.Message
+	}
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		err = fmt.Errorf("%w: %s", monoprice.ErrInvalidZone, msg)
+	case http.StatusBadRequest:
+		err = fmt.Errorf("%w: %s", monoprice.ErrCommand, msg)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		err = fmt.Errorf("%w: %s", ErrUnauthorized, msg)
+	case http.StatusTooManyRequests:
+		err = fmt.Errorf("%w, retry after %ss", ErrRateLimited, resp.Header.Get("Retry-After"))
+	case http.StatusServiceUnavailable:
+		retry = true
+		err = monoprice.ErrUnknownState
+		if apiErr.Error.Code == "link_down" {
+			err = fmt.Errorf("%w: %s", monoprice.ErrLinkDown, msg)
+		}
+	case http.StatusGatewayTimeout:
+		retry = true
+		err = fmt.Errorf("%w: %s", monoprice.ErrReadTimeout, msg)
+	default:
+		retry = resp.StatusCode == http.StatusBadGateway
+		err = fmt.Errorf("%w %d: %s", ErrServer, resp.StatusCode, msg)
+	}
+	return retry, err
+}
+
+type zone struct {
+	id     monoprice.ZoneID
+	client *Client
+}
+
+func (z *zone) ID() monoprice.ZoneID {
+	return z.id
+}
+
+func (z *zone) State() (monoprice.State, error) {
+	return z.client.QueryState(z.id)
+}
+
+func (z *zone) SendCommand(cmd monoprice.Command, arg interface{}) error {
+	return z.client.SendCommand(z.id, cmd, arg)
+}
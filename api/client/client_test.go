@@ -0,0 +1,194 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/abates/monoprice"
+	"github.com/abates/monoprice/api"
+)
+
+func testServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/zones", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]int{11, 12})
+	})
+	mux.HandleFunc("/", handler)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestClientZones(t *testing.T) {
+	srv := testServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	c, err := New(srv.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	zones := c.Zones()
+	if len(zones) != 2 || zones[0].ID() != 11 || zones[1].ID() != 12 {
+		t.Errorf("Wanted zones 11 and 12 got %v", zones)
+	}
+}
+
+func TestClientQueryState(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		code     string
+		want     monoprice.State
+		wantErr  error
+		wantReqs int
+	}{
+		{"Good", http.StatusOK, "", monoprice.State{Zone: 11, Power: true, Volume: 13}, nil, 1},
+		{"Not Found", http.StatusNotFound, "invalid_zone", monoprice.State{}, monoprice.ErrInvalidZone, 1},
+		{"Unavailable", http.StatusServiceUnavailable, "unknown_state", monoprice.State{}, monoprice.ErrUnknownState, 3},
+		{"Link Down", http.StatusServiceUnavailable, "link_down", monoprice.State{}, monoprice.ErrLinkDown, 3},
+		{"Timeout", http.StatusGatewayTimeout, "read_timeout", monoprice.State{}, monoprice.ErrReadTimeout, 3},
+		{"Unauthorized", http.StatusUnauthorized, "unauthorized", monoprice.State{}, ErrUnauthorized, 1},
+		{"Rate Limited", http.StatusTooManyRequests, "rate_limited", monoprice.State{}, ErrRateLimited, 1},
+		{"Server Error", http.StatusInternalServerError, "internal", monoprice.State{}, ErrServer, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reqs := 0
+			srv := testServer(t, func(w http.ResponseWriter, r *http.Request) {
+				reqs++
+				if r.URL.Path != "/11/status" {
+					t.Errorf("Wanted path /11/status got %q", r.URL.Path)
+				}
+				secret := api.KeySecret("secret")
+				if sig := api.Signature(secret, r, nil); r.Header.Get(api.SignatureHeader) != sig {
+					t.Errorf("Wanted signature %q got %q", sig, r.Header.Get(api.SignatureHeader))
+				}
+				if r.Header.Get("X-Auth-Key") != "" {
+					t.Errorf("Expected the key not to be sent")
+				}
+				if test.status == http.StatusOK {
+					json.NewEncoder(w).Encode(test.want)
+				} else {
+					api.WriteErrorCode(w, test.status, test.code, "failed")
+				}
+			})
+
+			c, _ := New(srv.URL, APIKeyOption("secret"), RetryOption(2, 0))
+			got, gotErr := c.Zones()[0].State()
+			if !errors.Is(gotErr, test.wantErr) {
+				t.Errorf("Wanted error %v got %v", test.wantErr, gotErr)
+			} else if gotErr == nil && got != test.want {
+				t.Errorf("Wanted %+v got %+v", test.want, got)
+			}
+
+			if reqs != test.wantReqs {
+				t.Errorf("Wanted %d requests got %d", test.wantReqs, reqs)
+			}
+		})
+	}
+}
+
+func TestClientSendCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		cmd      monoprice.Command
+		arg      interface{}
+		wantPath string
+		wantErr  error
+	}{
+		{"Power bool", monoprice.SetPower, true, "/11/power/true", nil},
+		{"Power string", monoprice.SetPower, "00", "/11/power/false", nil},
+		{"Mute", monoprice.SetMute, false, "/11/mute/false", nil},
+		{"DND", monoprice.SetDND, "01", "/11/dnd/true", nil},
+		{"Volume", monoprice.SetVolume, 20, "/11/volume/20", nil},
+		{"Source string", monoprice.SetSource, "3", "/11/source/3", nil},
+		{"Bad arg", monoprice.SetVolume, "loud", "", monoprice.ErrCommand},
+		{"Unsupported", monoprice.GetKeypadStatus, nil, "", monoprice.ErrCommand},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gotPath := ""
+			srv := testServer(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPut {
+					t.Errorf("Wanted method PUT got %s", r.Method)
+				}
+				gotPath = r.URL.Path
+				w.Write([]byte(`{}`))
+			})
+
+			c, _ := New(srv.URL)
+			gotErr := c.SendCommand(11, test.cmd, test.arg)
+			if !errors.Is(gotErr, test.wantErr) {
+				t.Errorf("Wanted error %v got %v", test.wantErr, gotErr)
+			}
+
+			if gotPath != test.wantPath {
+				t.Errorf("Wanted path %q got %q", test.wantPath, gotPath)
+			}
+		})
+	}
+}
+
+func TestClientPlainKeyOption(t *testing.T) {
+	srv := testServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("X-Auth-Key"); got != "secret" {
+			t.Errorf("Wanted key %q got %q", "secret", got)
+		}
+
+		if r.Header.Get(api.SignatureHeader) != "" {
+			t.Errorf("Expected the request not to be signed")
+		}
+		w.Write([]byte(`{}`))
+	})
+
+	c, err := New(srv.URL, APIKeyOption("secret"), PlainKeyOption())
+	if err == nil {
+		err = c.SendCommand(11, monoprice.SetVolume, 10)
+	}
+
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestClientAmpOption(t *testing.T) {
+	paths := []string{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if r.URL.Path == "/amps/pool/zones" {
+			json.NewEncoder(w).Encode([]int{11})
+		} else {
+			w.Write([]byte(`{}`))
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	c, err := New(srv.URL, AmpOption("pool"))
+	if err == nil {
+		_, err = c.Zones()[0].State()
+	}
+
+	if err == nil {
+		err = c.Zones()[0].SendCommand(monoprice.SetVolume, 10)
+	}
+
+	if err == nil {
+		_, err = c.States()
+	}
+
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	want := []string{"/amps/pool/zones", "/amps/pool/zones/11/status", "/amps/pool/zones/11/volume/10", "/amps/pool/zones/status"}
+	if !reflect.DeepEqual(want, paths) {
+		t.Errorf("Wanted paths %v got %v", want, paths)
+	}
+}
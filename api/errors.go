@@ -0,0 +1,95 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/abates/monoprice"
+)
+
+var (
+	// ErrInvalidArgument is returned when a request contains a value
+	// that can't be decoded
+	ErrInvalidArgument = errors.New("invalid argument")
+
+	// ErrNotFound is returned for a resource, other than a zone, that
+	// doesn't exist
+	ErrNotFound = errors.New("not found")
+
+	// ErrPreconditionFailed is returned when a request's If-Match header
+	// doesn't match the zone's current state
+	ErrPreconditionFailed = errors.New("zone state has changed")
+)
+
+// Error describes a failed request.  Zone is only set when the failure
+// concerned a single zone
+type Error struct {
+	Code    string           `json:"code"`
+	Message string           `json:"message"`
+	Zone    monoprice.ZoneID `json:"zone,omitempty"`
+}
+
+// ErrorResponse is the body of every failed request
+type ErrorResponse struct {
+	Error Error `json:"error"`
+}
+
+// errorCodes maps errors to the code and HTTP status returned for them.
+// The first match wins
+var errorCodes = []struct {
+	err    error
+	code   string
+	status int
+}{
+	{monoprice.ErrInvalidZone, "invalid_zone", http.StatusNotFound},
+	{ErrNotFound, "not_found", http.StatusNotFound},
+	{ErrInvalidArgument, "invalid_argument", http.StatusBadRequest},
+	{ErrPreconditionFailed, "precondition_failed", http.StatusPreconditionFailed},
+	{monoprice.ErrCommand, "invalid_argument", http.StatusBadRequest},
+	{monoprice.ErrReadTimeout, "read_timeout", http.StatusGatewayTimeout},
+	{monoprice.ErrLinkDown, "link_down", http.StatusServiceUnavailable},
+	{monoprice.ErrUnknownState, "unknown_state", http.StatusServiceUnavailable},
+	{monoprice.ErrInvalidResponse, "invalid_response", http.StatusBadGateway},
+}
+
+// ErrorStatus returns the code and HTTP status for err
+func ErrorStatus(err error) (code string, status int) {
+	for _, ec := range errorCodes {
+		if errors.Is(err, ec.err) {
+			return ec.code, ec.status
+		}
+	}
+	return "internal", http.StatusInternalServerError
+}
+
+// WriteError writes err with the status from ErrorStatus.  The zone is
+// taken from err when it is a *monoprice.AmpError
+func WriteError(w http.ResponseWriter, err error) {
+	code, status := ErrorStatus(err)
+	body := Error{Code: code, Message: err.Error()}
+	var ampErr *monoprice.AmpError
+	if errors.As(err, &ampErr) {
+		body.Zone = ampErr.Zone
+	}
+	writeError(w, status, body)
+}
+
+// WriteZoneError writes an error concerning a single zone
+func WriteZoneError(w http.ResponseWriter, zone monoprice.ZoneID, err error) {
+	code, status := ErrorStatus(err)
+	writeError(w, status, Error{Code: code, Message: err.Error(), Zone: zone})
+}
+
+// WriteErrorCode writes an error that isn't a Go error, such as a failed
+// authentication
+func WriteErrorCode(w http.ResponseWriter, status int, code, message string) {
+	writeError(w, status, Error{Code: code, Message: message})
+}
+
+func writeError(w http.ResponseWriter, status int, body Error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: body})
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/abates/monoprice"
+)
+
+// ETag returns the entity tag for a zone's state.  It changes whenever
+// any part of the state does
+func ETag(state monoprice.State) string {
+	str, _ := state.Marshal()
+	sum := sha256.Sum256([]byte(str))
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// opaqueTag strips the quotes and weak prefix from an entity tag, so a
+// tag matches however the client copied it
+func opaqueTag(tag string) string {
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+	return strings.Trim(tag, `"`)
+}
+
+// IfMatch returns ErrPreconditionFailed if the request has an If-Match
+// header that doesn't match the state's ETag.  Weak tags never match
+func IfMatch(r *http.Request, state monoprice.State) error {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return nil
+	}
+
+	etag := ETag(state)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return nil
+		}
+	}
+	return ErrPreconditionFailed
+}
+
+// SendIfMatch calls fn during an amplifier transaction.  When the request
+// has an If-Match header the zone's state is checked first, retrying the
+// query like Zone.State does.  Nothing else is sent to the amplifier
+// during the transaction, so no other client can change the zone between
+// the check and fn's commands
+func SendIfMatch(r *http.Request, amp *monoprice.Amplifier, zone monoprice.ZoneID, fn func(tx *monoprice.Tx) error) error {
+	return amp.Transaction(func(tx *monoprice.Tx) error {
+		if r.Header.Get("If-Match") != "" {
+			state, err := tx.State(zone)
+			if err == nil {
+				err = IfMatch(r, state)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+		return fn(tx)
+	})
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers used by signed requests.  A signed request carries the id of
+// the key instead of the key itself, along with the time it was signed, a
+// random nonce and an HMAC-SHA256 over the method, path, timestamp, nonce
+// and a hash of the body
+const (
+	KeyIDHeader     = "X-Auth-Key-Id"
+	TimestampHeader = "X-Auth-Timestamp"
+	NonceHeader     = "X-Auth-Nonce"
+	SignatureHeader = "X-Auth-Signature"
+)
+
+// KeySecret returns the secret used to sign requests with an API key.  It
+// is an HMAC of a fixed label keyed with the key, so it can't be worked
+// out from the SHA-256 hash the server uses to check plain keys
+func KeySecret(key string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("ampserver-sign"))
+	return mac.Sum(nil)
+}
+
+// KeyID identifies the key a request was signed with without revealing
+// the secret
+func KeyID(secret []byte) string {
+	sum := sha256.Sum256(secret)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Signature computes the signature of a request from its method, path
+// and query, timestamp and nonce headers and body
+func Signature(secret []byte, r *http.Request, body []byte) string {
+	bodySum := sha256.Sum256(body)
+	msg := strings.Join([]string{
+		r.Method,
+		r.URL.RequestURI(),
+		r.Header.Get(TimestampHeader),
+		r.Header.Get(NonceHeader),
+		hex.EncodeToString(bodySum[:]),
+	}, "\n")
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(msg))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest adds the signature headers for key to a request.  The body
+// must be the same bytes that will be sent with the request
+func SignRequest(r *http.Request, key string, body []byte) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+
+	secret := KeySecret(key)
+	r.Header.Set(KeyIDHeader, KeyID(secret))
+	r.Header.Set(TimestampHeader, strconv.FormatInt(time.Now().Unix(), 10))
+	r.Header.Set(NonceHeader, hex.EncodeToString(nonce))
+	r.Header.Set(SignatureHeader, Signature(secret, r, body))
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/abates/monoprice"
+	"github.com/abates/monoprice/api"
+)
+
+// Origins of audit entries
+const (
+	originAPI      = "api"
+	originSchedule = "schedule"
+	originRestore  = "restore"
+	originKeypad   = "keypad"
+	originHomekit  = "homekit"
+)
+
+// AuditEntry is one line of the audit log
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Origin   string    `json:"origin"`
+	Key      string    `json:"key,omitempty"`
+	Client   string    `json:"client,omitempty"`
+	Amp      string    `json:"amp"`
+	Zone     int       `json:"zone"`
+	Command  string    `json:"command"`
+	Argument string    `json:"argument,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// auditLog appends entries to a JSON lines file and rotates it when it
+// grows too large
+type auditLog struct {
+	cfg     AuditConfig
+	maxSize int64
+
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64
+	commands map[string]time.Time
+}
+
+func openAuditLog(cfg AuditConfig) (*auditLog, error) {
+	al := &auditLog{
+		cfg:      cfg,
+		maxSize:  int64(cfg.MaxSize) << 20,
+		commands: make(map[string]time.Time),
+	}
+	return al, al.open()
+}
+
+func (al *auditLog) open() (err error) {
+	al.file, err = os.OpenFile(al.cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err == nil {
+		var info os.FileInfo
+		info, err = al.file.Stat()
+		if err == nil {
+			al.size = info.Size()
+		}
+	}
+	return err
+}
+
+func (al *auditLog) Close() error {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	return al.file.Close()
+}
+
+// backup returns the name of the nth rotated log
+func (al *auditLog) backup(n int) string {
+	return fmt.Sprintf("%s.%d", al.cfg.File, n)
+}
+
+func (al *auditLog) rotate() error {
+	if err := al.file.Close(); err != nil {
+		return err
+	}
+
+	os.Remove(al.backup(al.cfg.MaxBackups))
+	for n := al.cfg.MaxBackups - 1; n > 0; n-- {
+		os.Rename(al.backup(n), al.backup(n+1))
+	}
+
+	if al.cfg.MaxBackups > 0 {
+		os.Rename(al.cfg.File, al.backup(1))
+	} else {
+		os.Remove(al.cfg.File)
+	}
+	return al.open()
+}
+
+func (al *auditLog) record(entry AuditEntry) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to encode audit entry: %v", err)
+		return
+	}
+	b = append(b, '\n')
+
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+
+	if entry.Origin != originKeypad {
+		al.commands[fmt.Sprintf("%s:%d", entry.Amp, entry.Zone)] = entry.Time
+	}
+
+	if al.size > 0 && al.size+int64(len(b)) > al.maxSize {
+		if err := al.rotate(); err != nil {
+			log.Printf("Failed to rotate audit log: %v", err)
+		}
+	}
+
+	n, err := al.file.Write(b)
+	al.size += int64(n)
+	if err != nil {
+		log.Printf("Failed to write audit entry: %v", err)
+	}
+}
+
+// commandName is the attribute name used for a command in the audit log
+func commandName(cmd monoprice.Command) string {
+	for name, attr := range attributes {
+		if attr.cmd == cmd {
+			return name
+		}
+	}
+	return string(cmd)
+}
+
+func argString(arg interface{}) string {
+	switch arg {
+	case nil:
+		return ""
+	case "01":
+		return "true"
+	case "00":
+		return "false"
+	}
+	return fmt.Sprint(arg)
+}
+
+// newAuditEntry creates the entry for a command
+func newAuditEntry(origin, amp string, zone monoprice.ZoneID, cmd monoprice.Command, arg interface{}, err error) AuditEntry {
+	entry := AuditEntry{
+		Time:     time.Now(),
+		Origin:   origin,
+		Amp:      amp,
+		Zone:     int(zone),
+		Command:  commandName(cmd),
+		Argument: argString(arg),
+	}
+
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	return entry
+}
+
+// recordRequest records a command sent through the API along with the
+// key and client that sent it
+func (al *auditLog) recordRequest(r *http.Request, amp string, zone monoprice.ZoneID, cmd monoprice.Command, arg interface{}, err error) {
+	if al == nil {
+		return
+	}
+
+	entry := newAuditEntry(originAPI, amp, zone, cmd, arg, err)
+	entry.Client = r.RemoteAddr
+	if key, found := requestKey(r); found {
+		entry.Key = key.Name
+	}
+	al.record(entry)
+}
+
+// apiCommand returns the api.CommandFunc that records commands sent
+// through the API
+func (al *auditLog) apiCommand() api.CommandFunc {
+	return al.recordRequest
+}
+
+// auditZone records the commands sent to a zone.  Commands sent for an
+// API request also record the request's key and client
+type auditZone struct {
+	monoprice.Zone
+	log     *auditLog
+	amp     string
+	origin  string
+	request *http.Request
+}
+
+func (az *auditZone) SendCommand(cmd monoprice.Command, arg interface{}) error {
+	err := az.Zone.SendCommand(cmd, arg)
+	if az.request != nil {
+		az.log.recordRequest(az.request, az.amp, az.Zone.ID(), cmd, arg, err)
+	} else {
+		az.log.record(newAuditEntry(az.origin, az.amp, az.Zone.ID(), cmd, arg, err))
+	}
+	return err
+}
+
+type auditController struct {
+	zones []monoprice.Zone
+}
+
+func (ac *auditController) Zones() []monoprice.Zone {
+	return ac.zones
+}
+
+// controller wraps ctrl so that commands sent to its zones are recorded
+// with the given origin
+func (al *auditLog) controller(amp, origin string, ctrl controller) controller {
+	if al == nil || ctrl == nil {
+		return ctrl
+	}
+
+	ac := &auditController{}
+	for _, zone := range ctrl.Zones() {
+		ac.zones = append(ac.zones, &auditZone{Zone: zone, log: al, amp: amp, origin: origin})
+	}
+	return ac
+}
+
+// requestController wraps ctrl so that commands sent to its zones are
+// recorded as sent through the API by the request's key and client
+func (al *auditLog) requestController(r *http.Request, amp string, ctrl controller) controller {
+	if al == nil {
+		return ctrl
+	}
+
+	ac := &auditController{}
+	for _, zone := range ctrl.Zones() {
+		ac.zones = append(ac.zones, &auditZone{Zone: zone, log: al, amp: amp, origin: originAPI, request: r})
+	}
+	return ac
+}
+
+// stateAttributes are the parts of a zone's state that can be changed at
+// a keypad
+var stateAttributes = []struct {
+	name  string
+	value func(monoprice.State) string
+}{
+	{"power", func(s monoprice.State) string { return strconv.FormatBool(s.Power) }},
+	{"mute", func(s monoprice.State) string { return strconv.FormatBool(s.Mute) }},
+	{"dnd", func(s monoprice.State) string { return strconv.FormatBool(s.DoNotDisturb) }},
+	{"pa", func(s monoprice.State) string { return strconv.FormatBool(s.PA) }},
+	{"volume", func(s monoprice.State) string { return strconv.Itoa(s.Volume) }},
+	{"treble", func(s monoprice.State) string { return strconv.Itoa(s.Treble) }},
+	{"bass", func(s monoprice.State) string { return strconv.Itoa(s.Bass) }},
+	{"balance", func(s monoprice.State) string { return strconv.Itoa(s.Balance) }},
+	{"source", func(s monoprice.State) string { return strconv.Itoa(s.Source) }},
+}
+
+// recordChanges records the changes seen by an amp's monitor that weren't
+// caused by a command sent within window of the poll.  They were made at
+// a keypad
+func (al *auditLog) recordChanges(amp string, event monoprice.MonitorEvent, window time.Duration) {
+	if event.Initial || event.Reconnected {
+		return
+	}
+
+	for _, change := range event.Changes {
+		al.mutex.Lock()
+		last, found := al.commands[fmt.Sprintf("%s:%d", amp, change.Zone)]
+		al.mutex.Unlock()
+		if found && event.Time.Sub(last) < window {
+			continue
+		}
+
+		for _, attr := range stateAttributes {
+			if value := attr.value(change.Current); value != attr.value(change.Previous) {
+				al.record(AuditEntry{
+					Time:     event.Time,
+					Origin:   originKeypad,
+					Amp:      amp,
+					Zone:     int(change.Zone),
+					Command:  attr.name,
+					Argument: value,
+				})
+			}
+		}
+	}
+}
+
+// query returns the entries, oldest first, for an amp (or every amp if
+// amp is empty) and zone (or every zone if zone is 0) since a time
+func (al *auditLog) query(amp string, zone int, since time.Time) ([]AuditEntry, error) {
+	// the files are opened under the lock so a rotation can't happen part
+	// way through, but scanned without it so commands aren't held up.  An
+	// open file keeps its contents if it is renamed by a later rotation
+	al.mutex.Lock()
+	files := []*os.File{}
+	for n := al.cfg.MaxBackups; n >= 0; n-- {
+		filename := al.cfg.File
+		if n > 0 {
+			filename = al.backup(n)
+		}
+
+		f, err := os.Open(filename)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			al.mutex.Unlock()
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	al.mutex.Unlock()
+
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	entries := []AuditEntry{}
+	for _, f := range files {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			entry := AuditEntry{}
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+				continue
+			}
+
+			if entry.Time.Before(since) || (amp != "" && entry.Amp != amp) || (zone != 0 && entry.Zone != zone) {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// handler serves GET /audit.  The zone parameter takes a zone id or
+// name and since takes either a time in RFC 3339 format or a duration
+// before now
+func (al *auditLog) handler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		amp := query.Get("amp")
+		if amp != "" && cfg.amp(amp) == nil {
+			api.WriteError(w, fmt.Errorf("%w amp %q", api.ErrNotFound, amp))
+			return
+		}
+
+		zone := 0
+		if str := query.Get("zone"); str != "" {
+			if amp == "" {
+				amp = cfg.DefaultAmp
+			}
+
+			id, found := cfg.resolveZone(amp, str)
+			if !found {
+				api.WriteError(w, fmt.Errorf("%w zone %q", api.ErrInvalidArgument, str))
+				return
+			}
+			zone = int(id)
+		}
+
+		since := time.Time{}
+		if str := query.Get("since"); str != "" {
+			var err error
+			since, err = time.Parse(time.RFC3339, str)
+			if err != nil {
+				d, e := time.ParseDuration(str)
+				if e != nil {
+					api.WriteError(w, fmt.Errorf("%w since %q, expected a time or duration", api.ErrInvalidArgument, str))
+					return
+				}
+				since = time.Now().Add(-d)
+			}
+		}
+
+		entries, err := al.query(amp, zone, since)
+		if err != nil {
+			log.Printf("Failed to read audit log: %v", err)
+			api.WriteError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(entries)
+	}
+}
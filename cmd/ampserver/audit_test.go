@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/abates/monoprice"
+	"github.com/abates/monoprice/api"
+)
+
+func TestAuditLog(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	al, err := openAuditLog(AuditConfig{File: filename, MaxSize: 1, MaxBackups: 3})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer al.Close()
+	// small enough that every entry rotates the log
+	al.maxSize = 100
+
+	cfg := defaultConfig()
+	cfg.Amps = append(cfg.Amps, AmpConfig{Name: "pool"})
+	amps := map[string]*monoprice.Amplifier{cfg.DefaultAmp: testAmp(t), "pool": testAmp(t)}
+	router := api.NewMulti(amps, cfg.DefaultAmp, api.CommandOption(al.apiCommand()))
+	router.HandleFunc("/audit", al.handler(cfg))
+
+	for _, path := range []string{"/11/power/true", "/amps/pool/zones/11/power/true"} {
+		req := httptest.NewRequest("PUT", path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), keyContextKey, KeyConfig{Name: "tablet"}))
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// a change right after a command isn't from the keypad, a change to
+	// another zone is
+	now := time.Now()
+	al.recordChanges(api.DefaultAmp, monoprice.MonitorEvent{
+		Time: now,
+		Changes: []monoprice.StateChange{
+			{Zone: 11, Current: monoprice.State{Zone: 11, Power: true}},
+			{Zone: 12, Previous: monoprice.State{Zone: 12, Volume: 10}, Current: monoprice.State{Zone: 12, Power: true, Volume: 12}},
+		},
+	}, time.Minute)
+
+	if _, err := os.Stat(filename + ".1"); err != nil {
+		t.Errorf("Expected the log to be rotated: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []AuditEntry
+	}{
+		{"Zone", "?zone=11", []AuditEntry{{Origin: originAPI, Key: "tablet", Client: "192.0.2.1:1234", Amp: api.DefaultAmp, Zone: 11, Command: "power", Argument: "true"}}},
+		{"Keypad", "?zone=12&since=1m", []AuditEntry{
+			{Origin: originKeypad, Amp: api.DefaultAmp, Zone: 12, Command: "power", Argument: "true"},
+			{Origin: originKeypad, Amp: api.DefaultAmp, Zone: 12, Command: "volume", Argument: "12"},
+		}},
+		{"Amp", "?amp=pool", []AuditEntry{{Origin: originAPI, Key: "tablet", Client: "192.0.2.1:1234", Amp: "pool", Zone: 11, Command: "power", Argument: "true"}}},
+		{"Since", "?since=" + now.Add(time.Hour).Format(time.RFC3339), []AuditEntry{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/audit"+test.query, nil))
+			got := []AuditEntry{}
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+
+			if len(got) != len(test.want) {
+				t.Fatalf("Wanted %d entries got %d: %+v", len(test.want), len(got), got)
+			}
+
+			for i, entry := range got {
+				if entry.Time.IsZero() {
+					t.Errorf("Expected entry %d to have a time", i)
+				}
+				// the replayed transcript doesn't expect the command
+				if entry.Origin == originAPI && entry.Error == "" {
+					t.Errorf("Expected entry %d to record the error", i)
+				}
+				entry.Time = time.Time{}
+				entry.Error = ""
+				if entry != test.want[i] {
+					t.Errorf("Wanted %+v got %+v", test.want[i], entry)
+				}
+			}
+		})
+	}
+}
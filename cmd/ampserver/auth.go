@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/abates/monoprice"
+	"github.com/abates/monoprice/api"
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v3"
+)
+
+// Key scopes, each one includes the scopes before it
+const (
+	scopeRead    = "read"
+	scopeControl = "control"
+	scopeAdmin   = "admin"
+)
+
+var scopeLevels = map[string]int{
+	"":           1,
+	scopeRead:    0,
+	scopeControl: 1,
+	scopeAdmin:   2,
+}
+
+const hashPrefix = "sha256:"
+
+// maxSignedBody is the largest request body that will be read to check
+// a signature
+const maxSignedBody = 1 << 20
+
+func validScope(scope string) bool {
+	_, found := scopeLevels[scope]
+	return found
+}
+
+// hashKey returns the form of a key used to check plain X-Auth-Key
+// headers.  Keys are long random strings, so a single SHA-256 is enough
+// to keep the hash from being usable as the key.  The signing secret
+// stored next to it is a credential though, since signatures are checked
+// with it, so the keystore has to be kept as private as the keys
+// themselves
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hashPrefix + hex.EncodeToString(sum[:])
+}
+
+func validHash(hash string) bool {
+	b, err := hex.DecodeString(strings.TrimPrefix(hash, hashPrefix))
+	return strings.HasPrefix(hash, hashPrefix) && err == nil && len(b) == sha256.Size
+}
+
+// validSecret reports whether secret is a hex encoded signing secret, see
+// api.KeySecret
+func validSecret(secret string) bool {
+	b, err := hex.DecodeString(secret)
+	return err == nil && len(b) == sha256.Size
+}
+
+func (key *KeyConfig) hash() string {
+	if key.Hash != "" {
+		return key.Hash
+	}
+	return hashKey(key.Key)
+}
+
+func (key *KeyConfig) scope() string {
+	if key.Scope == "" {
+		return scopeControl
+	}
+	return key.Scope
+}
+
+func loadKeystore(filename string) ([]KeyConfig, error) {
+	keys := []KeyConfig{}
+	b, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return keys, nil
+	} else if err == nil {
+		err = yaml.Unmarshal(b, &keys)
+	}
+
+	secrets := false
+	if err == nil {
+		for _, key := range keys {
+			if !validHash(key.Hash) || !validScope(key.Scope) || (key.Secret != "" && !validSecret(key.Secret)) {
+				return nil, fmt.Errorf("%w: %s: invalid entry for key %q", ErrConfig, filename, key.Name)
+			}
+			secrets = secrets || key.Secret != ""
+		}
+	}
+
+	if info, e := os.Stat(filename); err == nil && e == nil && secrets && info.Mode().Perm()&0077 != 0 {
+		log.Printf("Keystore %s holds signing secrets but can be read by other users, it should be mode 0600", filename)
+	}
+	return keys, err
+}
+
+func saveKeystore(filename string, keys []KeyConfig) error {
+	b, err := yaml.Marshal(keys)
+	if err == nil {
+		err = writeFile(filename, b, 0600)
+	}
+	return err
+}
+
+// authKeys returns the keys from the config file followed by the keys
+// in the keystore
+func (cfg *Config) authKeys() ([]KeyConfig, error) {
+	keys := append([]KeyConfig{}, cfg.Auth.Keys...)
+	if cfg.Auth.Keystore == "" {
+		return keys, nil
+	}
+
+	stored, err := loadKeystore(cfg.Auth.Keystore)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load keystore: %w", err)
+	}
+
+	for _, key := range stored {
+		for _, k := range keys {
+			if k.Name == key.Name {
+				return nil, fmt.Errorf("%w: key %q is in both the config file and the keystore", ErrConfig, key.Name)
+			}
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// secret returns the key used to verify signed requests, see
+// api.KeySecret.  Hashed keys can only sign requests if their secret was
+// stored alongside the hash
+func (key *KeyConfig) secret() []byte {
+	if key.Key != "" {
+		return api.KeySecret(key.Key)
+	}
+	b, _ := hex.DecodeString(key.Secret)
+	return b
+}
+
+// nonceCache remembers the nonces of signed requests until their
+// timestamps are too old to be accepted anyway
+type nonceCache struct {
+	mutex     sync.Mutex
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+// add records a nonce and reports whether it was new
+func (nc *nonceCache) add(nonce string, expires time.Time) bool {
+	nc.mutex.Lock()
+	defer nc.mutex.Unlock()
+
+	now := time.Now()
+	if nc.seen == nil {
+		nc.seen = make(map[string]time.Time)
+	}
+
+	if now.Sub(nc.lastPrune) > time.Minute {
+		for n, exp := range nc.seen {
+			if now.After(exp) {
+				delete(nc.seen, n)
+			}
+		}
+		nc.lastPrune = now
+	}
+
+	if _, found := nc.seen[nonce]; found {
+		return false
+	}
+	nc.seen[nonce] = expires
+	return true
+}
+
+// verifySignature finds the key a request was signed with and checks the
+// signature, the timestamp and that the nonce hasn't been used before
+func verifySignature(keys []KeyConfig, r *http.Request, skew time.Duration, nonces *nonceCache) (KeyConfig, bool) {
+	id := r.Header.Get(api.KeyIDHeader)
+	nonce := r.Header.Get(api.NonceHeader)
+	if id == "" || nonce == "" || len(nonce) > 64 {
+		return KeyConfig{}, false
+	}
+
+	ts, err := strconv.ParseInt(r.Header.Get(api.TimestampHeader), 10, 64)
+	if err != nil {
+		return KeyConfig{}, false
+	}
+
+	signed := time.Unix(ts, 0)
+	if d := time.Since(signed); d > skew || d < -skew {
+		return KeyConfig{}, false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBody))
+	if err != nil {
+		return KeyConfig{}, false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	sig, err := hex.DecodeString(r.Header.Get(api.SignatureHeader))
+	if err != nil {
+		return KeyConfig{}, false
+	}
+
+	for _, key := range keys {
+		if key.Subject != "" {
+			continue
+		}
+
+		secret := key.secret()
+		if len(secret) == 0 || api.KeyID(secret) != id {
+			continue
+		}
+
+		want, _ := hex.DecodeString(api.Signature(secret, r, body))
+		if hmac.Equal(sig, want) && nonces.add(id+":"+nonce, signed.Add(skew)) {
+			return key, true
+		}
+		break
+	}
+	return KeyConfig{}, false
+}
+
+func findKey(keys []KeyConfig, token string) (KeyConfig, bool) {
+	if token == "" {
+		return KeyConfig{}, false
+	}
+
+	hash := hashKey(token)
+	for _, key := range keys {
+		if subtle.ConstantTimeCompare([]byte(key.hash()), []byte(hash)) == 1 {
+			return key, true
+		}
+	}
+	return KeyConfig{}, false
+}
+
+// findSubject finds the key mapped to the subject of the request's client
+// certificate.  A key's subject matches either the certificate's common
+// name or its full distinguished name
+func findSubject(keys []KeyConfig, r *http.Request) (KeyConfig, bool) {
+	cn, dn, found := certSubject(r.TLS)
+	if !found {
+		return KeyConfig{}, false
+	}
+
+	for _, key := range keys {
+		if key.Subject != "" && (key.Subject == cn || key.Subject == dn) {
+			return key, true
+		}
+	}
+	return KeyConfig{}, false
+}
+
+// publicRoute reports whether the request matched a route that doesn't
+// need a key, such as the web UI's static files
+func publicRoute(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	return route != nil && strings.HasPrefix(route.GetName(), "public.")
+}
+
+// requiredScope is the scope needed for a request.  Reads only need the
+// read scope, anything that changes a zone needs control
+func requiredScope(r *http.Request) string {
+	if api.AdminRoute(r) {
+		return scopeAdmin
+	} else if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return scopeRead
+	}
+	return scopeControl
+}
+
+// allowsZone reports whether the key may use a zone.  Zones listed
+// directly are on the key's amp, zones from groups on the group's amp
+func (cfg *Config) allowsZone(key KeyConfig, amp string, id monoprice.ZoneID) bool {
+	if len(key.Zones) == 0 && len(key.Groups) == 0 {
+		return true
+	}
+
+	for _, zone := range key.Zones {
+		if cfg.ampName(key.Amp) == amp && monoprice.ZoneID(zone) == id {
+			return true
+		}
+	}
+
+	for _, name := range key.Groups {
+		for _, group := range cfg.Groups {
+			if group.Name != name || cfg.ampName(group.Amp) != amp {
+				continue
+			}
+
+			for _, zone := range group.Zones {
+				if monoprice.ZoneID(zone) == id {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// requestZone returns the amp and zone a request is for, if any
+func (cfg *Config) requestZone(r *http.Request) (amp, zone string, found bool) {
+	vars := mux.Vars(r)
+	zone, found = vars["zone"]
+	amp = cfg.DefaultAmp
+	if name, ok := vars["name"]; ok {
+		amp = name
+	}
+	return amp, zone, found
+}
+
+// allows reports whether the key has the scope and zone access needed
+// for the request
+func (cfg *Config) allows(key KeyConfig, r *http.Request) bool {
+	if scopeLevels[key.scope()] < scopeLevels[requiredScope(r)] {
+		return false
+	}
+
+	amp, zone, found := cfg.requestZone(r)
+	if !found {
+		return true
+	}
+
+	id, err := strconv.Atoi(zone)
+	return err == nil && cfg.allowsZone(key, amp, monoprice.ZoneID(id))
+}
+
+// authMiddleware accepts signed requests, plain X-Auth-Key headers
+// unless signatures are required, and client certificates
+func authMiddleware(cfg *Config, keys []KeyConfig, nonces *nonceCache) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if publicRoute(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var key KeyConfig
+			var found bool
+			if r.Header.Get(api.SignatureHeader) != "" {
+				key, found = verifySignature(keys, r, cfg.Auth.ClockSkew, nonces)
+			} else if token := r.Header.Get("X-Auth-Key"); token != "" {
+				if !cfg.Auth.RequireSigned {
+					key, found = findKey(keys, token)
+				}
+			} else {
+				key, found = findSubject(keys, r)
+			}
+
+			if !found {
+				api.WriteErrorCode(w, http.StatusUnauthorized, "unauthorized", "not authorized")
+			} else if !cfg.allows(key, r) {
+				api.WriteErrorCode(w, http.StatusForbidden, "forbidden", "forbidden")
+			} else {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), keyContextKey, key)))
+			}
+		})
+	}
+}
+
+type contextKey int
+
+const keyContextKey contextKey = iota
+
+// requestKey returns the key that authorized a request
+func requestKey(r *http.Request) (KeyConfig, bool) {
+	key, found := r.Context().Value(keyContextKey).(KeyConfig)
+	return key, found
+}
+
+func generateKey() string {
+	b := make([]byte, 64)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func keygen(args []string) {
+	if len(args) == 0 {
+		fmt.Println(generateKey())
+		return
+	}
+
+	if cfg.Auth.Keystore == "" {
+		log.Fatal("keygen requires a keystore, set auth.keystore in the config file or KEYSTORE_FILE")
+	}
+
+	keys, err := loadKeystore(cfg.Auth.Keystore)
+	if err != nil {
+		log.Fatalf("Failed to load keystore: %v", err)
+	}
+
+	switch args[0] {
+	case "add":
+		keys = keygenAdd(keys, args[1:])
+	case "list":
+		keygenList(keys)
+		return
+	case "revoke":
+		keys = keygenRevoke(keys, args[1:])
+	default:
+		usage()
+		os.Exit(-1)
+	}
+
+	if err := saveKeystore(cfg.Auth.Keystore, keys); err != nil {
+		log.Fatalf("Failed to save keystore: %v", err)
+	}
+}
+
+func keygenAdd(keys []KeyConfig, args []string) []KeyConfig {
+	flags := flag.NewFlagSet("keygen add", flag.ExitOnError)
+	scope := flags.String("scope", scopeControl, "key scope, one of read, control or admin")
+	zones := flags.String("zones", "", "comma separated list of zones the key may use")
+	groups := flags.String("groups", "", "comma separated list of groups the key may use")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		log.Fatal("Usage: keygen add [-scope scope] [-zones zones] [-groups groups] <name>")
+	}
+
+	key := KeyConfig{Name: flags.Arg(0), Scope: *scope, Amp: ampFlag, Created: time.Now().Truncate(time.Second)}
+	if !validScope(key.Scope) {
+		log.Fatalf("Invalid scope %q, expected one of read,control,admin", key.Scope)
+	}
+
+	for _, k := range append(append([]KeyConfig{}, keys...), cfg.Auth.Keys...) {
+		if k.Name == key.Name {
+			log.Fatalf("Key %q already exists", key.Name)
+		}
+	}
+
+	for _, str := range split(*zones) {
+		id, found := cfg.resolveZone(ampName, str)
+		if !found {
+			log.Fatalf("Invalid zone %q", str)
+		}
+		key.Zones = append(key.Zones, int(id))
+	}
+
+	for _, group := range split(*groups) {
+		if cfg.groupZones(group) == nil {
+			log.Fatalf("Unknown group %q", group)
+		}
+		key.Groups = append(key.Groups, group)
+	}
+
+	token := generateKey()
+	key.Hash = hashKey(token)
+	key.Secret = hex.EncodeToString(api.KeySecret(token))
+	fmt.Println(token)
+	return append(keys, key)
+}
+
+func keygenList(keys []KeyConfig) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSCOPE\tZONES\tGROUPS\tCREATED")
+	for _, key := range keys {
+		zones := []string{}
+		for _, zone := range key.Zones {
+			if key.Amp != "" {
+				zones = append(zones, key.Amp+":"+strconv.Itoa(zone))
+			} else {
+				zones = append(zones, strconv.Itoa(zone))
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", key.Name, key.scope(), strings.Join(zones, ","), strings.Join(key.Groups, ","), key.Created.Format(time.RFC3339))
+	}
+	w.Flush()
+}
+
+func keygenRevoke(keys []KeyConfig, args []string) []KeyConfig {
+	if len(args) != 1 {
+		log.Fatal("Usage: keygen revoke <name>")
+	}
+
+	for i, key := range keys {
+		if key.Name == args[0] {
+			return append(keys[:i], keys[i+1:]...)
+		}
+	}
+	log.Fatalf("Key %q not found in %s", args[0], cfg.Auth.Keystore)
+	return nil
+}
+
+func split(str string) []string {
+	values := []string{}
+	for _, value := range strings.Split(str, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abates/monoprice"
+	"github.com/abates/monoprice/api"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Groups = []GroupConfig{{Name: "kids", Zones: []int{12}}, {Name: "pool", Amp: "pool", Zones: []int{12}}}
+	keys := []KeyConfig{
+		{Name: "read", Key: "read", Scope: scopeRead},
+		{Name: "control", Hash: hashKey("control")},
+		{Name: "zone", Key: "zone", Zones: []int{11}},
+		{Name: "group", Key: "group", Groups: []string{"kids"}},
+		{Name: "admin", Key: "admin", Scope: scopeAdmin},
+		{Name: "pool zone", Key: "pool zone", Amp: "pool", Zones: []int{11}},
+		{Name: "pool group", Key: "pool group", Groups: []string{"pool"}},
+	}
+
+	amps := map[string]*monoprice.Amplifier{cfg.DefaultAmp: testAmp(t), "pool": testAmp(t)}
+	router := api.NewMulti(amps, cfg.DefaultAmp, api.RawOption())
+	router.Use(authMiddleware(cfg, keys, &nonceCache{}))
+
+	tests := []struct {
+		name   string
+		key    string
+		method string
+		path   string
+		want   int
+	}{
+		{"Unknown key", "other", "GET", "/zones", http.StatusUnauthorized},
+		{"No key", "", "GET", "/zones", http.StatusUnauthorized},
+		{"Read", "read", "GET", "/zones", http.StatusOK},
+		{"Read control", "read", "PUT", "/11/volume/10", http.StatusForbidden},
+		{"Control", "control", "PUT", "/11/volume/10", 0},
+		{"Control admin", "control", "POST", "/raw", http.StatusForbidden},
+		{"Zone", "zone", "PUT", "/11/volume/10", 0},
+		{"Other zone", "zone", "PUT", "/12/volume/10", http.StatusForbidden},
+		{"Group", "group", "PUT", "/12/volume/10", 0},
+		{"Other group zone", "group", "GET", "/11/status", http.StatusForbidden},
+		{"Admin", "admin", "POST", "/raw", 0},
+		{"Zone other amp", "zone", "PUT", "/amps/pool/zones/11/volume/10", http.StatusForbidden},
+		{"Amp zone", "pool zone", "PUT", "/amps/pool/zones/11/volume/10", 0},
+		{"Amp zone default amp", "pool zone", "PUT", "/11/volume/10", http.StatusForbidden},
+		{"Amp group", "pool group", "PUT", "/amps/pool/zones/12/volume/10", 0},
+		{"Amp group default amp", "pool group", "PUT", "/12/volume/10", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.path, nil)
+			req.Header.Set("X-Auth-Key", test.key)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if test.want == 0 {
+				if w.Code == http.StatusUnauthorized || w.Code == http.StatusForbidden {
+					t.Errorf("Wanted request to be authorized got status %d", w.Code)
+				}
+			} else if w.Code != test.want {
+				t.Errorf("Wanted status %d got %d", test.want, w.Code)
+			}
+		})
+	}
+}
+
+func TestKeystore(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "keys.yaml")
+	want := KeyConfig{Name: "tablet", Hash: hashKey("secret"), Scope: scopeControl, Zones: []int{14, 15}}
+	if err := saveKeystore(filename, []KeyConfig{want}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	cfg := defaultConfig()
+	cfg.Auth.Keys = []KeyConfig{{Name: "default", Key: "default"}}
+	cfg.Auth.Keystore = filename
+	keys, err := cfg.authKeys()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if key, found := findKey(keys, "secret"); !found || key.Name != want.Name {
+		t.Errorf("Wanted key %q got %q", want.Name, key.Name)
+	}
+
+	cfg.Auth.Keys[0].Name = "tablet"
+	if _, err := cfg.authKeys(); err == nil {
+		t.Errorf("Expected an error for a duplicate key name")
+	}
+}
+
+func TestSignedRequests(t *testing.T) {
+	cfg := defaultConfig()
+	keys := []KeyConfig{
+		{Name: "plain", Key: "plain"},
+		{Name: "hashed", Hash: hashKey("hashed"), Secret: hex.EncodeToString(api.KeySecret("hashed")), Scope: scopeRead},
+		{Name: "hash only", Hash: hashKey("hash only")},
+	}
+
+	router := api.New(testAmp(t))
+	router.Use(authMiddleware(cfg, keys, &nonceCache{}))
+
+	signed := func(method, path, key string) *http.Request {
+		req := httptest.NewRequest(method, path, nil)
+		api.SignRequest(req, key, nil)
+		return req
+	}
+
+	replayed := signed("GET", "/zones", "plain")
+	stale := signed("GET", "/zones", "plain")
+	stale.Header.Set(api.TimestampHeader, strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+	tampered := signed("GET", "/zones", "plain")
+	tampered.URL.Path = "/amps"
+
+	// the hash in the keystore must not be usable as the signing secret
+	hash, _ := hex.DecodeString(strings.TrimPrefix(hashKey("hashed"), hashPrefix))
+	forged := httptest.NewRequest("GET", "/zones", nil)
+	forged.Header.Set(api.KeyIDHeader, api.KeyID(hash))
+	forged.Header.Set(api.TimestampHeader, strconv.FormatInt(time.Now().Unix(), 10))
+	forged.Header.Set(api.NonceHeader, "forged")
+	forged.Header.Set(api.SignatureHeader, api.Signature(hash, forged, nil))
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{"Signed", signed("GET", "/zones", "plain"), http.StatusOK},
+		{"Hashed key", signed("GET", "/zones", "hashed"), http.StatusOK},
+		{"Hashed key scope", signed("PUT", "/11/volume/10", "hashed"), http.StatusForbidden},
+		{"Unknown key", signed("GET", "/zones", "other"), http.StatusUnauthorized},
+		{"Hash without secret", signed("GET", "/zones", "hash only"), http.StatusUnauthorized},
+		{"Forged from hash", forged, http.StatusUnauthorized},
+		{"First use", replayed, http.StatusOK},
+		{"Replay", replayed, http.StatusUnauthorized},
+		{"Stale", stale, http.StatusUnauthorized},
+		{"Tampered", tampered, http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, test.req)
+			if w.Code != test.want {
+				t.Errorf("Wanted status %d got %d", test.want, w.Code)
+			}
+		})
+	}
+
+	cfg.Auth.RequireSigned = true
+	req := httptest.NewRequest("GET", "/zones", nil)
+	req.Header.Set("X-Auth-Key", "plain")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Wanted status %d for an unsigned request got %d", http.StatusUnauthorized, w.Code)
+	}
+}
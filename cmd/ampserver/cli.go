@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/abates/monoprice"
+	"github.com/abates/monoprice/api"
+	"github.com/abates/monoprice/api/client"
+)
+
+// controller is implemented by both a local monoprice.Amplifier and a
+// remote client.Client
+type controller interface {
+	Zones() []monoprice.Zone
+}
+
+type attribute struct {
+	cmd    monoprice.Command
+	parser func(string) (interface{}, error)
+}
+
+var attributes = map[string]attribute{
+	"power":   {monoprice.SetPower, api.ParseBool},
+	"mute":    {monoprice.SetMute, api.ParseBool},
+	"dnd":     {monoprice.SetDND, api.ParseBool},
+	"volume":  {monoprice.SetVolume, api.ParseInt},
+	"treble":  {monoprice.SetTreble, api.ParseInt},
+	"bass":    {monoprice.SetBass, api.ParseInt},
+	"balance": {monoprice.SetBalance, api.ParseInt},
+	"source":  {monoprice.SetSource, api.ParseInt},
+}
+
+func connect() controller {
+	if ampURL == "" {
+		return mustOpenAmp(cfg.amp(ampName))
+	}
+
+	options := []client.Option{client.APIKeyOption(getEnv("API_KEY", "")), client.AmpOption(ampFlag)}
+	if plainKey {
+		options = append(options, client.PlainKeyOption())
+	}
+	tlsConfig, err := clientTLS(caCertFile, clientCertFile, clientKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to load TLS settings: %v", err)
+	} else if tlsConfig != nil {
+		httpClient := &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		}
+		options = append(options, client.HTTPClientOption(httpClient))
+	}
+
+	c, err := client.New(ampURL, options...)
+	if err != nil {
+		log.Fatalf("Failed to connect to %s: %v", ampURL, err)
+	}
+	return c
+}
+
+// errUsage is returned by the commands when they are given the wrong
+// arguments, main prints the usage for it
+var errUsage = errors.New("invalid arguments")
+
+func findZone(ctrl controller, arg string) (monoprice.Zone, error) {
+	id, found := cfg.resolveZone(ampName, arg)
+	if !found {
+		return nil, fmt.Errorf("invalid zone %q", arg)
+	}
+
+	for _, zone := range ctrl.Zones() {
+		if zone.ID() == id {
+			return zone, nil
+		}
+	}
+	return nil, fmt.Errorf("zone %d not found", id)
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return fmt.Errorf("failed to encode output: %w", err)
+	}
+	return nil
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+func printStates(out io.Writer, states []monoprice.State) error {
+	if jsonOutput {
+		return printJSON(out, states)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ZONE\tPOWER\tMUTE\tDND\tVOLUME\tTREBLE\tBASS\tBALANCE\tSOURCE\tKEYPAD\tPA")
+	for _, s := range states {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s\t%s\n", s.Zone, onOff(s.Power), onOff(s.Mute), onOff(s.DoNotDisturb), s.Volume, s.Treble, s.Bass, s.Balance, s.Source, onOff(s.KeyPad), onOff(s.PA))
+	}
+	return w.Flush()
+}
+
+func listZones(w io.Writer, ctrl controller) error {
+	ids := []int{}
+	for _, zone := range ctrl.Zones() {
+		ids = append(ids, int(zone.ID()))
+	}
+
+	if jsonOutput {
+		return printJSON(w, ids)
+	}
+
+	for _, id := range ids {
+		fmt.Fprintln(w, id)
+	}
+	return nil
+}
+
+// stateLister is a controller that can return every zone's state at once
+type stateLister interface {
+	States() (map[monoprice.ZoneID]monoprice.State, error)
+}
+
+func status(w io.Writer, ctrl controller, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+
+	zones := ctrl.Zones()
+	if len(args) > 0 {
+		zone, err := findZone(ctrl, args[0])
+		if err != nil {
+			return err
+		}
+		zones = []monoprice.Zone{zone}
+	} else if lister, ok := ctrl.(stateLister); ok {
+		all, err := lister.States()
+		if err != nil {
+			return fmt.Errorf("failed to query zones: %w", err)
+		}
+
+		states := []monoprice.State{}
+		for _, zone := range zones {
+			if state, found := all[zone.ID()]; found {
+				states = append(states, state)
+			}
+		}
+		return printStates(w, states)
+	}
+
+	states := []monoprice.State{}
+	for _, zone := range zones {
+		state, err := zone.State()
+		if err != nil {
+			return fmt.Errorf("failed to query zone %d: %w", zone.ID(), err)
+		}
+		states = append(states, state)
+	}
+	return printStates(w, states)
+}
+
+func set(ctrl controller, args []string) error {
+	if len(args) != 3 {
+		return errUsage
+	}
+
+	zone, err := findZone(ctrl, args[0])
+	if err != nil {
+		return err
+	}
+
+	attr, found := attributes[strings.ToLower(args[1])]
+	if !found {
+		names := []string{}
+		for name := range attributes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown attribute %q, expected one of %s", args[1], strings.Join(names, ","))
+	}
+
+	arg, err := attr.parser(args[2])
+	if err == nil {
+		err = zone.SendCommand(attr.cmd, arg)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to set %s on zone %d: %w", args[1], zone.ID(), err)
+	}
+	return nil
+}
+
+func loadScenes(filename string) (map[string]monoprice.Scene, error) {
+	scenes := []monoprice.Scene{}
+	b, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	} else if err == nil {
+		err = json.Unmarshal(b, &scenes)
+	}
+
+	sceneMap := make(map[string]monoprice.Scene)
+	for _, scene := range scenes {
+		sceneMap[scene.Name] = scene
+	}
+	return sceneMap, err
+}
+
+func saveScene(filename string, scene monoprice.Scene) error {
+	scenes, err := loadScenes(filename)
+	if err != nil {
+		return err
+	}
+	scenes[scene.Name] = scene
+
+	list := []monoprice.Scene{}
+	for _, s := range scenes {
+		list = append(list, s)
+	}
+
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filename, b, 0644)
+	}
+	return err
+}
+
+func scene(ctrl controller, args []string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "recall":
+		if len(args) != 2 {
+			return errUsage
+		}
+
+		scenes, err := loadScenes(scenesFile)
+		if err != nil {
+			return fmt.Errorf("failed to load scenes from %s: %w", scenesFile, err)
+		}
+
+		scene, found := scenes[args[1]]
+		if !found {
+			return fmt.Errorf("scene %q not found in %s", args[1], scenesFile)
+		}
+
+		if err := scene.Recall(ctrl.Zones()); err != nil {
+			return fmt.Errorf("failed to recall scene %q: %w", args[1], err)
+		}
+	case "save":
+		zones := ctrl.Zones()
+		if len(args) > 2 {
+			zones = nil
+			for _, arg := range args[2:] {
+				zone, err := findZone(ctrl, arg)
+				if err != nil {
+					return err
+				}
+				zones = append(zones, zone)
+			}
+		}
+
+		scene, err := monoprice.NewScene(args[1], zones)
+		if err == nil {
+			err = saveScene(scenesFile, scene)
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to save scene %q: %w", args[1], err)
+		}
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+// watch polls every zone and prints the state of any zone that changed
+// since the last poll
+func watch(w io.Writer, ctrl controller) {
+	last := make(map[monoprice.ZoneID]monoprice.State)
+	for {
+		watchPoll(w, ctrl, last)
+		time.Sleep(watchInterval)
+	}
+}
+
+// watchPoll prints the zones whose state differs from last and records
+// their new state
+func watchPoll(w io.Writer, ctrl controller, last map[monoprice.ZoneID]monoprice.State) {
+	changed := []monoprice.State{}
+	for _, zone := range ctrl.Zones() {
+		state, err := zone.State()
+		if err != nil {
+			log.Printf("Failed to query zone %d: %v", zone.ID(), err)
+			continue
+		}
+
+		if prev, found := last[zone.ID()]; !found || prev != state {
+			last[zone.ID()] = state
+			changed = append(changed, state)
+		}
+	}
+
+	if len(changed) == 0 {
+		return
+	}
+
+	if jsonOutput {
+		enc := json.NewEncoder(w)
+		for _, state := range changed {
+			enc.Encode(state)
+		}
+	} else {
+		fmt.Fprintf(w, "%s\n", time.Now().Format(time.RFC3339))
+		printStates(w, changed)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/abates/monoprice"
+	"github.com/abates/monoprice/internal/fakeamp"
+)
+
+// testCLI points the command line at a fake amplifier with zones 11 and
+// 12, where zone 11 is named Kitchen
+func testCLI(t *testing.T) (*fakeamp.Amp, *monoprice.Amplifier) {
+	cfg = defaultConfig()
+	cfg.Zones = []ZoneConfig{{ID: 11, Name: "Kitchen"}}
+	ampName = cfg.DefaultAmp
+	jsonOutput = false
+	scenesFile = filepath.Join(t.TempDir(), "scenes.json")
+
+	fake := fakeamp.New(11, 12)
+	amp, err := monoprice.New(fake)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	return fake, amp
+}
+
+func TestCLISet(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    string
+		wantErr string
+		want    func(monoprice.State) bool
+	}{
+		{"Volume", "11 volume 20", "", func(s monoprice.State) bool { return s.Volume == 20 }},
+		{"Zone name", "kitchen power true", "", func(s monoprice.State) bool { return s.Power }},
+		{"Attribute case", "11 MUTE true", "", func(s monoprice.State) bool { return s.Mute }},
+		{"Too few", "11 volume", "invalid arguments", nil},
+		{"Too many", "11 volume 20 30", "invalid arguments", nil},
+		{"Unknown attribute", "11 loudness 20", `unknown attribute "loudness", expected one of balance,bass,dnd,mute,power,source,treble,volume`, nil},
+		{"Invalid value", "11 volume loud", "failed to set volume on zone 11", nil},
+		{"Out of range", "11 volume 99", "failed to set volume on zone 11", nil},
+		{"Invalid zone", "den volume 20", `invalid zone "den"`, nil},
+		{"Missing zone", "13 volume 20", "zone 13 not found", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, amp := testCLI(t)
+			err := set(amp, strings.Fields(test.args))
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			} else if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("Wanted error %q got %v", test.wantErr, err)
+			}
+
+			if test.want != nil && !test.want(fake.State(11)) {
+				t.Errorf("Zone 11 wasn't changed, got %+v", fake.State(11))
+			}
+		})
+	}
+}
+
+func TestCLIStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		json     bool
+		wantErr  error
+		want     []string
+		wantNone string
+	}{
+		{"All zones", nil, false, nil, []string{"ZONE", "11  ", "12  "}, ""},
+		{"One zone", []string{"12"}, false, nil, []string{"12  "}, "11  "},
+		{"Zone name", []string{"Kitchen"}, false, nil, []string{"11  "}, "12  "},
+		{"JSON", []string{"11"}, true, nil, []string{`"zone": 11`, `"volume": 10`}, "ZONE"},
+		{"Too many", []string{"11", "12"}, false, errUsage, nil, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, amp := testCLI(t)
+			jsonOutput = test.json
+
+			var out strings.Builder
+			err := status(&out, amp, test.args)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Wanted error %v got %v", test.wantErr, err)
+			}
+
+			for _, want := range test.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("Wanted output containing %q got %q", want, out.String())
+				}
+			}
+
+			if test.wantNone != "" && strings.Contains(out.String(), test.wantNone) {
+				t.Errorf("Wanted output without %q got %q", test.wantNone, out.String())
+			}
+		})
+	}
+
+	t.Run("Missing zone", func(t *testing.T) {
+		_, amp := testCLI(t)
+		if err := status(&strings.Builder{}, amp, []string{"13"}); err == nil || err.Error() != "zone 13 not found" {
+			t.Errorf("Wanted zone 13 not found got %v", err)
+		}
+	})
+}
+
+func TestCLIListZones(t *testing.T) {
+	tests := []struct {
+		name string
+		json bool
+		want string
+	}{
+		{"Text", false, "11\n12\n"},
+		{"JSON", true, "[\n  11,\n  12\n]\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, amp := testCLI(t)
+			jsonOutput = test.json
+
+			var out strings.Builder
+			if err := listZones(&out, amp); err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+
+			if out.String() != test.want {
+				t.Errorf("Wanted %q got %q", test.want, out.String())
+			}
+		})
+	}
+}
+
+func TestCLIScene(t *testing.T) {
+	fake, amp := testCLI(t)
+	fake.Update(11, func(state *monoprice.State) { state.Volume = 25 })
+
+	tests := []struct {
+		name    string
+		args    string
+		before  func()
+		wantErr string
+	}{
+		{"Too few", "save", nil, "invalid arguments"},
+		{"Unknown action", "delete dinner", nil, "invalid arguments"},
+		{"Recall extra", "recall dinner 11", nil, "invalid arguments"},
+		{"Save invalid zone", "save dinner den", nil, `invalid zone "den"`},
+		{"Recall missing", "recall dinner", nil, `scene "dinner" not found`},
+		{"Save", "save dinner kitchen", nil, ""},
+		{"Recall", "recall dinner", func() { fake.Update(11, func(state *monoprice.State) { state.Volume = 5 }) }, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.before != nil {
+				test.before()
+			}
+
+			err := scene(amp, strings.Fields(test.args))
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			} else if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("Wanted error %q got %v", test.wantErr, err)
+			}
+		})
+	}
+
+	if volume := fake.State(11).Volume; volume != 25 {
+		t.Errorf("Wanted the recalled volume 25 got %d", volume)
+	}
+}
+
+func TestCLIWatchPoll(t *testing.T) {
+	fake, amp := testCLI(t)
+	last := make(map[monoprice.ZoneID]monoprice.State)
+
+	var out strings.Builder
+	watchPoll(&out, amp, last)
+	if !strings.Contains(out.String(), "11  ") || !strings.Contains(out.String(), "12  ") {
+		t.Errorf("Wanted both zones on the first poll got %q", out.String())
+	}
+
+	out.Reset()
+	watchPoll(&out, amp, last)
+	if out.Len() != 0 {
+		t.Errorf("Wanted nothing printed without changes got %q", out.String())
+	}
+
+	fake.Update(12, func(state *monoprice.State) { state.Volume = 30 })
+	watchPoll(&out, amp, last)
+	if strings.Contains(out.String(), "11  ") || !strings.Contains(out.String(), "12  ") {
+		t.Errorf("Wanted only zone 12 after it changed got %q", out.String())
+	}
+}
@@ -0,0 +1,719 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abates/monoprice"
+	"github.com/abates/monoprice/api"
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v3"
+)
+
+var ErrConfig = errors.New("invalid configuration")
+
+// ConfigError is a configuration problem found at a specific line of
+// the config file
+type ConfigError struct {
+	Filename string
+	Line     int
+	Msg      string
+}
+
+func (ce *ConfigError) Error() string {
+	if ce.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", ce.Filename, ce.Line, ce.Msg)
+	}
+	return fmt.Sprintf("%s: %s", ce.Filename, ce.Msg)
+}
+
+func (ce *ConfigError) Unwrap() error {
+	return ErrConfig
+}
+
+// ConfigErrors is the list of every problem found in a config file
+type ConfigErrors []*ConfigError
+
+func (ce ConfigErrors) Error() string {
+	msgs := []string{}
+	for _, err := range ce {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (ce ConfigErrors) Unwrap() error {
+	return ErrConfig
+}
+
+type TransportConfig struct {
+	Port        string        `yaml:"port"`
+	Speed       int           `yaml:"speed"`
+	ReadTimeout time.Duration `yaml:"read_timeout"`
+}
+
+type ListenConfig struct {
+	Port int       `yaml:"port"`
+	TLS  TLSConfig `yaml:"tls"`
+}
+
+// TLSConfig enables HTTPS when a certificate and key are given.  With
+// SelfSigned a certificate is generated the first time the server starts
+// if the files don't exist.  ClientCA enables client certificates, which
+// are required if RequireClientCert is set
+type TLSConfig struct {
+	Cert              string `yaml:"cert"`
+	Key               string `yaml:"key"`
+	SelfSigned        bool   `yaml:"self_signed"`
+	ClientCA          string `yaml:"client_ca"`
+	RequireClientCert bool   `yaml:"require_client_cert"`
+}
+
+// AmpConfig is one amplifier stack.  Zones, groups and schedules
+// belong to the default amp unless they name another one
+type AmpConfig struct {
+	Name      string          `yaml:"name"`
+	Transport TransportConfig `yaml:"transport"`
+}
+
+type MonitorConfig struct {
+	Interval time.Duration `yaml:"interval"`
+}
+
+// LimitsConfig sets the request rate allowed for each API key and the
+// command rate allowed for each zone, in requests per second with bursts
+// of up to the burst size.  MaxPending caps the requests waiting for the
+// amplifier.  A zero rate or cap disables that limit
+type LimitsConfig struct {
+	KeyRate    float64 `yaml:"key_rate"`
+	KeyBurst   int     `yaml:"key_burst"`
+	ZoneRate   float64 `yaml:"zone_rate"`
+	ZoneBurst  int     `yaml:"zone_burst"`
+	MaxPending int     `yaml:"max_pending"`
+}
+
+// AuditConfig enables the audit log.  The log is rotated once it grows
+// beyond MaxSize megabytes, keeping MaxBackups old logs
+type AuditConfig struct {
+	File       string `yaml:"file"`
+	MaxSize    int    `yaml:"max_size"`
+	MaxBackups int    `yaml:"max_backups"`
+}
+
+// StateConfig controls saving the last known state of every zone and
+// restoring it when the amplifier loses power
+type StateConfig struct {
+	File        string `yaml:"file"`
+	AutoRestore bool   `yaml:"auto_restore"`
+}
+
+type ZoneConfig struct {
+	Amp  string `yaml:"amp"`
+	ID   int    `yaml:"id"`
+	Name string `yaml:"name"`
+}
+
+// SourceConfig names one of an amp's six inputs
+type SourceConfig struct {
+	Amp  string `yaml:"amp"`
+	ID   int    `yaml:"id"`
+	Name string `yaml:"name"`
+}
+
+type GroupConfig struct {
+	Amp   string `yaml:"amp"`
+	Name  string `yaml:"name"`
+	Zones []int  `yaml:"zones"`
+}
+
+// KeyConfig is an API key.  Either the key itself, its hash, as printed
+// by keygen, or the subject of a client certificate may be given.  Keys
+// without a scope have the control scope, and keys without zones or groups
+// may use every zone
+type KeyConfig struct {
+	Name    string    `yaml:"name"`
+	Key     string    `yaml:"key,omitempty"`
+	Hash    string    `yaml:"hash,omitempty"`
+	Secret  string    `yaml:"secret,omitempty"`
+	Subject string    `yaml:"subject,omitempty"`
+	Scope   string    `yaml:"scope,omitempty"`
+	Amp     string    `yaml:"amp,omitempty"`
+	Zones   []int     `yaml:"zones,omitempty"`
+	Groups  []string  `yaml:"groups,omitempty"`
+	Created time.Time `yaml:"created,omitempty"`
+}
+
+// AuthConfig lists the API keys.  Signed requests are accepted if their
+// timestamp is within ClockSkew of the server's clock, and RequireSigned
+// rejects plain X-Auth-Key headers
+type AuthConfig struct {
+	Disabled      bool          `yaml:"disabled"`
+	Keystore      string        `yaml:"keystore"`
+	ClockSkew     time.Duration `yaml:"clock_skew"`
+	RequireSigned bool          `yaml:"require_signed"`
+	Keys          []KeyConfig   `yaml:"keys"`
+}
+
+// ScheduleConfig runs either a scene recall or a set of attribute
+// changes at a time of day
+type ScheduleConfig struct {
+	Amp    string            `yaml:"amp"`
+	Name   string            `yaml:"name"`
+	Time   string            `yaml:"time"`
+	Days   []string          `yaml:"days"`
+	Scene  string            `yaml:"scene"`
+	Zones  []int             `yaml:"zones"`
+	Groups []string          `yaml:"groups"`
+	Set    map[string]string `yaml:"set"`
+}
+
+type Config struct {
+	Transport    TransportConfig      `yaml:"transport"`
+	Amps         []AmpConfig          `yaml:"amps"`
+	DefaultAmp   string               `yaml:"default_amp"`
+	Listen       ListenConfig         `yaml:"listen"`
+	Monitor      MonitorConfig        `yaml:"monitor"`
+	Limits       LimitsConfig         `yaml:"limits"`
+	Audit        AuditConfig          `yaml:"audit"`
+	State        StateConfig          `yaml:"state"`
+	Zones        []ZoneConfig         `yaml:"zones"`
+	Sources      []SourceConfig       `yaml:"sources"`
+	Groups       []GroupConfig        `yaml:"groups"`
+	Auth         AuthConfig           `yaml:"auth"`
+	Schedules    []ScheduleConfig     `yaml:"schedules"`
+	Integrations map[string]yaml.Node `yaml:"integrations"`
+
+	filename string
+	root     *yaml.Node
+}
+
+// integration is an optional feature configured in the integrations
+// section of the config file
+type integration struct {
+	// validate checks the integration's settings
+	validate func(node *yaml.Node) error
+
+	// setup is called each time an instance is built from a config
+	// that includes the integration.  It may add routes to the router
+	setup func(inst *instance, router *mux.Router, node *yaml.Node) error
+}
+
+// integrations lists the names that are allowed in the integrations
+// section of the config file.  Integrations register themselves from
+// their init functions
+var integrations = map[string]integration{}
+
+// decodeStrict decodes an integration's settings, rejecting unknown
+// fields
+func decodeStrict(node *yaml.Node, v interface{}) error {
+	b, err := yaml.Marshal(node)
+	if err == nil {
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		err = dec.Decode(v)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	}
+	return err
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func defaultTransport() TransportConfig {
+	return TransportConfig{
+		Port:        "/dev/ttyUSB0",
+		Speed:       9600,
+		ReadTimeout: time.Second,
+	}
+}
+
+// newConfig returns a config with the default settings, before the
+// amps list is filled in by normalize
+func newConfig(filename string) *Config {
+	return &Config{
+		filename:  filename,
+		Transport: defaultTransport(),
+		Listen:    ListenConfig{Port: 8000},
+		Monitor:   MonitorConfig{Interval: 5 * time.Second},
+		Limits:    LimitsConfig{KeyRate: 20, KeyBurst: 40, ZoneRate: 5, ZoneBurst: 10, MaxPending: 32},
+		Audit:     AuditConfig{MaxSize: 10, MaxBackups: 5},
+		Auth:      AuthConfig{ClockSkew: 5 * time.Minute},
+	}
+}
+
+func defaultConfig() *Config {
+	cfg := newConfig("<defaults>")
+	cfg.normalize()
+	return cfg
+}
+
+// normalize fills in the amps list for single amplifier configs and
+// sets the defaults of each amp's transport
+func (cfg *Config) normalize() {
+	if len(cfg.Amps) == 0 {
+		cfg.Amps = []AmpConfig{{Name: api.DefaultAmp, Transport: cfg.Transport}}
+	}
+
+	for i := range cfg.Amps {
+		transport := &cfg.Amps[i].Transport
+		if transport.Speed == 0 {
+			transport.Speed = defaultTransport().Speed
+		}
+
+		if transport.ReadTimeout == 0 {
+			transport.ReadTimeout = defaultTransport().ReadTimeout
+		}
+	}
+
+	if cfg.DefaultAmp == "" {
+		cfg.DefaultAmp = cfg.Amps[0].Name
+	}
+}
+
+// loadConfig reads and validates a config file.  Any errors found are
+// returned as ConfigErrors
+func loadConfig(filename string) (*Config, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(filename, b)
+}
+
+func parseConfig(filename string, b []byte) (*Config, error) {
+	cfg := newConfig(filename)
+	cfg.root = &yaml.Node{}
+
+	if err := yaml.Unmarshal(b, cfg.root); err != nil {
+		return nil, ConfigErrors{yamlError(filename, err)}
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		errs := ConfigErrors{}
+		if typeErr, ok := err.(*yaml.TypeError); ok {
+			for _, msg := range typeErr.Errors {
+				errs = append(errs, yamlError(filename, errors.New(msg)))
+			}
+		} else {
+			errs = append(errs, yamlError(filename, err))
+		}
+		return nil, errs
+	}
+
+	explicitAmps := len(cfg.Amps) > 0
+	cfg.normalize()
+	if errs := cfg.validate(explicitAmps); len(errs) > 0 {
+		return nil, errs
+	}
+	return cfg, nil
+}
+
+// yamlError converts the "yaml: line N: msg" and "line N: msg" errors
+// from the yaml package into a ConfigError
+func yamlError(filename string, err error) *ConfigError {
+	ce := &ConfigError{Filename: filename, Msg: err.Error()}
+	msg := strings.TrimPrefix(err.Error(), "yaml: ")
+	if n, _ := fmt.Sscanf(msg, "line %d:", &ce.Line); n == 1 {
+		ce.Msg = strings.TrimSpace(msg[strings.Index(msg, ":")+1:])
+	}
+	return ce
+}
+
+// has reports whether the top level of the config file has the given key
+func (cfg *Config) has(key string) bool {
+	if cfg.root == nil || len(cfg.root.Content) == 0 {
+		return false
+	}
+
+	node := cfg.root.Content[0]
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return true
+		}
+	}
+	return false
+}
+
+// line finds the line number of the node at the given path, where each
+// element of the path is either a mapping key or a sequence index.  If
+// the full path doesn't exist the line of the deepest node found is
+// returned
+func (cfg *Config) line(path ...interface{}) int {
+	if cfg.root == nil || len(cfg.root.Content) == 0 {
+		return 0
+	}
+
+	node := cfg.root.Content[0]
+	for _, elem := range path {
+		var next *yaml.Node
+		switch e := elem.(type) {
+		case string:
+			if node.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(node.Content); i += 2 {
+					if node.Content[i].Value == e {
+						next = node.Content[i+1]
+						break
+					}
+				}
+			}
+		case int:
+			if node.Kind == yaml.SequenceNode && e < len(node.Content) {
+				next = node.Content[e]
+			}
+		}
+
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return node.Line
+}
+
+func validZoneID(id int) bool {
+	return id/10 >= 1 && id/10 <= 3 && id%10 >= 1 && id%10 <= 6
+}
+
+func (cfg *Config) validate(explicitAmps bool) (errs ConfigErrors) {
+	errorf := func(path []interface{}, format string, args ...interface{}) {
+		errs = append(errs, &ConfigError{Filename: cfg.filename, Line: cfg.line(path...), Msg: fmt.Sprintf(format, args...)})
+	}
+	path := func(elems ...interface{}) []interface{} { return elems }
+
+	if explicitAmps && cfg.has("transport") {
+		errorf(path("transport"), "transport can't be used with amps, give each amp its own transport")
+	}
+
+	amps := make(map[string]bool)
+	for i, amp := range cfg.Amps {
+		transportPath := path("transport")
+		if explicitAmps {
+			transportPath = path("amps", i, "transport")
+			if amp.Name == "" || strings.ContainsAny(amp.Name, "/?#") {
+				errorf(path("amps", i), "amp name %q must not be empty or contain /, ? or #", amp.Name)
+			} else if amps[amp.Name] {
+				errorf(path("amps", i, "name"), "duplicate amp name %q", amp.Name)
+			}
+		}
+		amps[amp.Name] = true
+
+		if amp.Transport.Port == "" {
+			errorf(append(transportPath, "port"), "transport port is required")
+		}
+
+		if amp.Transport.Speed <= 0 {
+			errorf(append(transportPath, "speed"), "transport speed must be positive")
+		}
+	}
+
+	if !amps[cfg.DefaultAmp] {
+		errorf(path("default_amp"), "unknown amp %q", cfg.DefaultAmp)
+	}
+
+	checkAmp := func(name string, elems ...interface{}) string {
+		if name == "" {
+			return cfg.DefaultAmp
+		} else if !amps[name] {
+			errorf(elems, "unknown amp %q", name)
+		}
+		return name
+	}
+
+	if cfg.Listen.Port < 1 || cfg.Listen.Port > 65535 {
+		errorf(path("listen", "port"), "listen port %d is out of range", cfg.Listen.Port)
+	}
+
+	if cfg.Monitor.Interval < 100*time.Millisecond {
+		errorf(path("monitor", "interval"), "monitor interval must be at least 100ms")
+	}
+
+	limits := cfg.Limits
+	if limits.KeyRate < 0 || limits.KeyBurst < 0 || limits.ZoneRate < 0 || limits.ZoneBurst < 0 || limits.MaxPending < 0 {
+		errorf(path("limits"), "limits can't be negative")
+	}
+
+	if cfg.Audit.MaxSize < 1 {
+		errorf(path("audit", "max_size"), "audit max_size must be at least 1 megabyte")
+	}
+
+	if cfg.Audit.MaxBackups < 0 {
+		errorf(path("audit", "max_backups"), "audit max_backups can't be negative")
+	}
+
+	if cfg.State.AutoRestore && cfg.State.File == "" {
+		errorf(path("state", "auto_restore"), "auto_restore requires a state file")
+	}
+
+	tlsCfg := cfg.Listen.TLS
+	if (tlsCfg.Cert == "") != (tlsCfg.Key == "") {
+		errorf(path("listen", "tls"), "tls requires both a cert and a key")
+	} else if tlsCfg.Cert == "" && (tlsCfg.SelfSigned || tlsCfg.ClientCA != "") {
+		errorf(path("listen", "tls"), "tls options require a cert and key")
+	}
+
+	if tlsCfg.RequireClientCert && tlsCfg.ClientCA == "" {
+		errorf(path("listen", "tls", "require_client_cert"), "require_client_cert requires a client_ca")
+	}
+
+	zoneIDs := make(map[string]bool)
+	names := make(map[string]bool)
+	for i, zone := range cfg.Zones {
+		amp := checkAmp(zone.Amp, "zones", i, "amp")
+		key := fmt.Sprintf("%s/%d", amp, zone.ID)
+		if !validZoneID(zone.ID) {
+			errorf(path("zones", i, "id"), "invalid zone id %d", zone.ID)
+		} else if zoneIDs[key] {
+			errorf(path("zones", i, "id"), "zone %d is defined more than once", zone.ID)
+		}
+		zoneIDs[key] = true
+
+		if zone.Name == "" {
+			errorf(path("zones", i), "zone %d has no name", zone.ID)
+		} else if names[zone.Name] {
+			errorf(path("zones", i, "name"), "duplicate name %q", zone.Name)
+		}
+		names[zone.Name] = true
+	}
+
+	sourceIDs := make(map[string]bool)
+	for i, source := range cfg.Sources {
+		amp := checkAmp(source.Amp, "sources", i, "amp")
+		key := fmt.Sprintf("%s/%d", amp, source.ID)
+		if source.ID < 1 || source.ID > 6 {
+			errorf(path("sources", i, "id"), "invalid source id %d", source.ID)
+		} else if sourceIDs[key] {
+			errorf(path("sources", i, "id"), "source %d is defined more than once", source.ID)
+		}
+		sourceIDs[key] = true
+
+		if source.Name == "" {
+			errorf(path("sources", i), "source %d has no name", source.ID)
+		}
+	}
+
+	checkZones := func(zones []int, elems ...interface{}) {
+		for i, id := range zones {
+			if !validZoneID(id) {
+				errorf(append(elems, i), "invalid zone id %d", id)
+			}
+		}
+	}
+
+	groups := make(map[string]string)
+	for i, group := range cfg.Groups {
+		groups[group.Name] = checkAmp(group.Amp, "groups", i, "amp")
+		if group.Name == "" {
+			errorf(path("groups", i), "group has no name")
+		} else if names[group.Name] {
+			errorf(path("groups", i, "name"), "duplicate name %q", group.Name)
+		}
+		names[group.Name] = true
+
+		if len(group.Zones) == 0 {
+			errorf(path("groups", i), "group %q has no zones", group.Name)
+		}
+		checkZones(group.Zones, "groups", i, "zones")
+	}
+
+	if cfg.Auth.ClockSkew <= 0 {
+		errorf(path("auth", "clock_skew"), "clock_skew must be positive")
+	}
+
+	keyNames := make(map[string]bool)
+	for i, key := range cfg.Auth.Keys {
+		if key.Name == "" {
+			errorf(path("auth", "keys", i), "key has no name")
+		} else if keyNames[key.Name] {
+			errorf(path("auth", "keys", i, "name"), "duplicate key name %q", key.Name)
+		}
+		keyNames[key.Name] = true
+
+		values := 0
+		for _, value := range []string{key.Key, key.Hash, key.Subject} {
+			if value != "" {
+				values++
+			}
+		}
+
+		if values == 0 {
+			errorf(path("auth", "keys", i), "key %q has no value", key.Name)
+		} else if values > 1 {
+			errorf(path("auth", "keys", i), "key %q must have only one of key, hash or subject", key.Name)
+		} else if key.Subject != "" && cfg.Listen.TLS.ClientCA == "" {
+			errorf(path("auth", "keys", i, "subject"), "key %q: client certificates require listen.tls.client_ca", key.Name)
+		} else if key.Hash != "" && !validHash(key.Hash) {
+			errorf(path("auth", "keys", i, "hash"), "invalid hash for key %q", key.Name)
+		}
+
+		if key.Secret != "" && (key.Hash == "" || !validSecret(key.Secret)) {
+			errorf(path("auth", "keys", i, "secret"), "key %q: secret must be a signing secret for a hashed key", key.Name)
+		}
+
+		if !validScope(key.Scope) {
+			errorf(path("auth", "keys", i, "scope"), "invalid scope %q, expected one of read,control,admin", key.Scope)
+		}
+
+		checkAmp(key.Amp, "auth", "keys", i, "amp")
+		checkZones(key.Zones, "auth", "keys", i, "zones")
+		for j, group := range key.Groups {
+			if _, found := groups[group]; !found {
+				errorf(path("auth", "keys", i, "groups", j), "key %q: unknown group %q", key.Name, group)
+			}
+		}
+	}
+
+	for i, schedule := range cfg.Schedules {
+		amp := checkAmp(schedule.Amp, "schedules", i, "amp")
+		if _, err := time.Parse("15:04", schedule.Time); err != nil {
+			errorf(path("schedules", i, "time"), "schedule %q: time %q must be formatted as HH:MM", schedule.Name, schedule.Time)
+		}
+
+		for j, day := range schedule.Days {
+			if _, found := weekdays[strings.ToLower(day)]; !found {
+				errorf(path("schedules", i, "days", j), "schedule %q: unknown day %q", schedule.Name, day)
+			}
+		}
+
+		if (schedule.Scene == "") == (len(schedule.Set) == 0) {
+			errorf(path("schedules", i), "schedule %q must have exactly one of scene or set", schedule.Name)
+		}
+
+		if len(schedule.Set) > 0 && len(schedule.Zones) == 0 && len(schedule.Groups) == 0 {
+			errorf(path("schedules", i), "schedule %q must list the zones or groups to set", schedule.Name)
+		}
+
+		checkZones(schedule.Zones, "schedules", i, "zones")
+		for j, group := range schedule.Groups {
+			if groupAmp, found := groups[group]; !found {
+				errorf(path("schedules", i, "groups", j), "schedule %q: unknown group %q", schedule.Name, group)
+			} else if groupAmp != amp {
+				errorf(path("schedules", i, "groups", j), "schedule %q: group %q belongs to amp %q", schedule.Name, group, groupAmp)
+			}
+		}
+
+		for name, value := range schedule.Set {
+			attr, found := attributes[name]
+			if !found {
+				errorf(path("schedules", i, "set", name), "schedule %q: unknown attribute %q", schedule.Name, name)
+			} else if _, err := attr.parser(value); err != nil {
+				errorf(path("schedules", i, "set", name), "schedule %q: invalid %s value %q", schedule.Name, name, value)
+			}
+		}
+	}
+
+	for name, node := range cfg.Integrations {
+		integration, found := integrations[name]
+		if !found {
+			errorf(path("integrations", name), "unknown integration %q", name)
+		} else if err := integration.validate(&node); err != nil {
+			errorf(path("integrations", name), "integration %q: %v", name, err)
+		}
+	}
+
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Line < errs[j].Line })
+	return errs
+}
+
+// applyEnv overrides the configuration with any of the environment
+// variables used before the config file existed
+func (cfg *Config) applyEnv() {
+	transport := &cfg.amp(cfg.DefaultAmp).Transport
+	transport.Port = getEnv("AMP_PORT", transport.Port)
+	transport.Speed = getIntEnv("AMP_SPEED", transport.Speed)
+	cfg.Listen.Port = getIntEnv("LISTEN_PORT", cfg.Listen.Port)
+	cfg.Auth.Keystore = getEnv("KEYSTORE_FILE", cfg.Auth.Keystore)
+
+	if key := getEnv("API_KEY", ""); key != "" {
+		cfg.Auth.setKey(KeyConfig{Name: "default", Key: key})
+	}
+
+	if key := getEnv("ADMIN_API_KEY", ""); key != "" {
+		cfg.Auth.setKey(KeyConfig{Name: "admin", Key: key, Scope: scopeAdmin})
+	}
+}
+
+func (ac *AuthConfig) setKey(key KeyConfig) {
+	for i, k := range ac.Keys {
+		if k.Name == key.Name {
+			ac.Keys[i] = key
+			return
+		}
+	}
+	ac.Keys = append(ac.Keys, key)
+}
+
+func (cfg *Config) amp(name string) *AmpConfig {
+	for i := range cfg.Amps {
+		if cfg.Amps[i].Name == name {
+			return &cfg.Amps[i]
+		}
+	}
+	return nil
+}
+
+// ampName returns the amp a zone, group or schedule belongs to
+func (cfg *Config) ampName(name string) string {
+	if name == "" {
+		return cfg.DefaultAmp
+	}
+	return name
+}
+
+func (cfg *Config) zoneName(amp string, id monoprice.ZoneID) string {
+	for _, zone := range cfg.Zones {
+		if cfg.ampName(zone.Amp) == amp && zone.ID == int(id) {
+			return zone.Name
+		}
+	}
+	return ""
+}
+
+func (cfg *Config) sourceName(amp string, id int) string {
+	for _, source := range cfg.Sources {
+		if cfg.ampName(source.Amp) == amp && source.ID == id {
+			return source.Name
+		}
+	}
+	return ""
+}
+
+// groupZones returns the zone ids for the named group
+func (cfg *Config) groupZones(name string) []int {
+	for _, group := range cfg.Groups {
+		if group.Name == name {
+			return group.Zones
+		}
+	}
+	return nil
+}
+
+// resolveZone converts a zone name or number on the given amp into a
+// zone id
+func (cfg *Config) resolveZone(amp, str string) (monoprice.ZoneID, bool) {
+	for _, zone := range cfg.Zones {
+		if cfg.ampName(zone.Amp) == amp && strings.EqualFold(zone.Name, str) {
+			return monoprice.ZoneID(zone.ID), true
+		}
+	}
+
+	id, err := strconv.Atoi(str)
+	return monoprice.ZoneID(id), err == nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseConfigExample(t *testing.T) {
+	cfg, err := loadConfig("../../ampserver.example.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if cfg.Transport.ReadTimeout != time.Second {
+		t.Errorf("Wanted read timeout %v got %v", time.Second, cfg.Transport.ReadTimeout)
+	}
+
+	if name := cfg.zoneName(cfg.DefaultAmp, 12); name != "Living Room" {
+		t.Errorf("Wanted zone name %q got %q", "Living Room", name)
+	}
+
+	if zones := cfg.groupZones("downstairs"); !reflect.DeepEqual(zones, []int{11, 12}) {
+		t.Errorf("Wanted group zones %v got %v", []int{11, 12}, zones)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		wantLines []int
+	}{
+		{"Empty", "", nil},
+		{"Syntax", "transport:\n  port: [\n", []int{2}},
+		{"Unknown field", "transport:\n  baud: 9600\n", []int{2}},
+		{"Type", "listen:\n  port: eighty\n", []int{2}},
+		{"Zone id", "zones:\n  - id: 11\n    name: a\n  - id: 17\n    name: b\n", []int{4}},
+		{"Duplicate name", "zones:\n  - id: 11\n    name: a\ngroups:\n  - name: a\n    zones: [11]\n", []int{5}},
+		{"Source", "sources:\n  - id: 7\n    name: a\n  - id: 1\n  - id: 1\n    name: b\n", []int{2, 4, 5}},
+		{"Group zone", "groups:\n  - name: a\n    zones: [11, 40]\n", []int{3}},
+		{"Key", "auth:\n  keys:\n    - name: a\n", []int{3}},
+		{"Key scope", "auth:\n  keys:\n    - name: a\n      key: b\n      scope: everything\n      zones: [11, 40]\n      groups: [c]\n", []int{5, 6, 7}},
+		{"TLS", "listen:\n  tls:\n    cert: a.pem\n    require_client_cert: true\n", []int{3, 4}},
+		{"Key amp", "auth:\n  keys:\n    - name: a\n      key: b\n      amp: pool\n      zones: [11]\n", []int{5}},
+		{"Key subject", "auth:\n  keys:\n    - name: a\n      subject: b\n", []int{4}},
+		{"Key hash", "auth:\n  keys:\n    - name: a\n      hash: b\n", []int{4}},
+		{"Schedule", "schedules:\n  - name: a\n    time: '7am'\n    days: [mon, someday]\n    zones: [11]\n    set:\n      volume: loud\n      color: red\n", []int{3, 4, 7, 8}},
+		{"Schedule action", "schedules:\n  - name: a\n    time: '07:00'\n", []int{2}},
+		{"Schedule group", "schedules:\n  - name: a\n    time: '07:00'\n    scene: b\n    groups: [c]\n", []int{5}},
+		{"Amps and transport", "transport:\n  port: /dev/ttyUSB0\namps:\n  - name: house\n    transport:\n      port: /dev/ttyUSB1\n", []int{2}},
+		{"Amp transport", "amps:\n  - name: house\n    transport:\n      speed: 9600\n", []int{4}},
+		{"Amp name", "amps:\n  - name: house\n    transport: {port: a}\n  - name: house\n    transport: {port: b}\n", []int{4}},
+		{"Default amp", "default_amp: pool\n", []int{1}},
+		{"Zone amp", "zones:\n  - id: 11\n    name: a\n    amp: pool\n", []int{4}},
+		{"Schedule group amp", "amps:\n  - name: house\n    transport: {port: a}\n  - name: pool\n    transport: {port: b}\ngroups:\n  - name: g\n    amp: pool\n    zones: [11]\nschedules:\n  - name: s\n    time: '07:00'\n    groups: [g]\n    set: {power: 'true'}\n", []int{13}},
+		{"Integration", "integrations:\n  carrier-pigeon:\n    enabled: true\n", []int{3}},
+		{"Web integration", "integrations:\n  web:\n    colour: red\n", []int{3}},
+		{"HomeKit setup code", "integrations:\n  homekit:\n    setup_code: 123-45-678\n", []int{3}},
+		{"HomeKit source", "integrations:\n  homekit:\n    sources:\n      7: Radio\n", []int{3}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseConfig("test.yaml", []byte(test.input))
+			gotLines := []int(nil)
+			if err != nil {
+				if !errors.Is(err, ErrConfig) {
+					t.Fatalf("Wanted %v got %v", ErrConfig, err)
+				}
+
+				for _, ce := range err.(ConfigErrors) {
+					gotLines = append(gotLines, ce.Line)
+				}
+			}
+
+			if !reflect.DeepEqual(test.wantLines, gotLines) {
+				t.Errorf("Wanted errors on lines %v got %v (%v)", test.wantLines, gotLines, err)
+			}
+		})
+	}
+}
+
+func TestParseConfigAmps(t *testing.T) {
+	input := "amps:\n  - name: house\n    transport: {port: /dev/ttyUSB0}\n  - name: pool\n    transport: {port: /dev/ttyUSB1, speed: 19200}\ndefault_amp: pool\nzones:\n  - {id: 11, name: Kitchen}\n  - {id: 11, name: Cabana, amp: house}\n"
+	cfg, err := parseConfig("test.yaml", []byte(input))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	want := []AmpConfig{
+		{"house", TransportConfig{"/dev/ttyUSB0", 9600, time.Second}},
+		{"pool", TransportConfig{"/dev/ttyUSB1", 19200, time.Second}},
+	}
+	if !reflect.DeepEqual(want, cfg.Amps) {
+		t.Errorf("Wanted amps %+v got %+v", want, cfg.Amps)
+	}
+
+	if name := cfg.zoneName("pool", 11); name != "Kitchen" {
+		t.Errorf("Wanted zone name %q got %q", "Kitchen", name)
+	}
+
+	if id, found := cfg.resolveZone("pool", "cabana"); found {
+		t.Errorf("Zone name resolved on the wrong amp to %d", id)
+	}
+}
+
+func TestConfigApplyEnv(t *testing.T) {
+	t.Setenv("AMP_PORT", "/dev/ttyS0")
+	t.Setenv("API_KEY", "secret")
+
+	cfg := defaultConfig()
+	cfg.Auth.Keys = []KeyConfig{{Name: "default", Key: "old"}}
+	cfg.applyEnv()
+
+	if port := cfg.amp(cfg.DefaultAmp).Transport.Port; port != "/dev/ttyS0" {
+		t.Errorf("Wanted port %q got %q", "/dev/ttyS0", port)
+	}
+
+	want := []KeyConfig{{Name: "default", Key: "secret"}}
+	if !reflect.DeepEqual(want, cfg.Auth.Keys) {
+		t.Errorf("Wanted keys %+v got %+v", want, cfg.Auth.Keys)
+	}
+}
+
+func TestScheduleDue(t *testing.T) {
+	monday := time.Date(2023, 1, 16, 7, 0, 0, 0, time.Local)
+	tests := []struct {
+		name     string
+		schedule ScheduleConfig
+		input    time.Time
+		want     bool
+	}{
+		{"Every day", ScheduleConfig{Time: "07:00"}, monday, true},
+		{"Wrong time", ScheduleConfig{Time: "07:01"}, monday, false},
+		{"Single digit hour", ScheduleConfig{Time: "7:00"}, monday, true},
+		{"Weekday", ScheduleConfig{Time: "07:00", Days: []string{"Mon"}}, monday, true},
+		{"Weekend", ScheduleConfig{Time: "07:00", Days: []string{"sat", "sun"}}, monday, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.schedule.due(test.input); got != test.want {
+				t.Errorf("Wanted %v got %v", test.want, got)
+			}
+		})
+	}
+}
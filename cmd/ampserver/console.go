@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abates/monoprice"
+	"github.com/chzyer/readline"
+)
+
+const consoleHelp = `Commands:
+  ?11, <11VO20         send a raw protocol line, tab completes the commands
+  11                   query the state of zone 11
+  11 volume 20         set an attribute (power, mute, dnd, volume, treble, bass, balance, source)
+  zones                list the attached zones
+  help                 show this help
+  quit                 exit the console
+`
+
+// console is an interactive shell for sending commands to the amplifier
+// over the serial port
+func console() {
+	historyFile := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		historyFile = filepath.Join(home, ".ampserver_history")
+	}
+
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:          "amp> ",
+		HistoryFile:     historyFile,
+		InterruptPrompt: "^C",
+		EOFPrompt:       "quit",
+	})
+	if err != nil {
+		log.Fatalf("Failed to start console: %v", err)
+	}
+	defer rl.Close()
+
+	// the console always shows the TX/RX traffic.  Logging goes through
+	// readline so it doesn't garble the prompt, and is set up before the
+	// amplifier is opened since the amplifier keeps the logger it's given
+	if err := setupConsoleLogging(rl.Stderr(), logFormat); err != nil {
+		log.Fatalf("%v", err)
+	}
+	amp := mustOpenAmp(cfg.amp(ampName))
+	rl.Config.AutoComplete = consoleCompleter(amp)
+
+	fmt.Fprint(rl.Stdout(), consoleHelp)
+	for {
+		line, err := rl.Readline()
+		if err == readline.ErrInterrupt {
+			continue
+		} else if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Printf("Failed to read input: %v", err)
+			break
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "quit" || line == "exit" {
+			break
+		}
+		consoleExec(rl.Stdout(), amp, line)
+	}
+}
+
+// consoleCompleter completes the console commands, the friendly zone
+// commands and the raw protocol lines for each zone, such as <11VO
+func consoleCompleter(ctrl controller) readline.AutoCompleter {
+	names := []string{}
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	attrs := []readline.PrefixCompleterInterface{readline.PcItem("status")}
+	for _, name := range names {
+		attrs = append(attrs, readline.PcItem(name))
+	}
+
+	items := []readline.PrefixCompleterInterface{
+		readline.PcItem("zones"),
+		readline.PcItem("help"),
+		readline.PcItem("quit"),
+	}
+	for _, zone := range ctrl.Zones() {
+		id := strconv.Itoa(int(zone.ID()))
+		items = append(items, readline.PcItem(id, attrs...), readline.PcItem("?"+id))
+		for _, name := range names {
+			items = append(items, readline.PcItem("<"+id+string(attributes[name].cmd)))
+		}
+	}
+	return readline.NewPrefixCompleter(items...)
+}
+
+func consoleExec(w io.Writer, amp *monoprice.Amplifier, line string) {
+	start := time.Now()
+	var err error
+
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 0:
+		return
+	case line == "help":
+		fmt.Fprint(w, consoleHelp)
+		return
+	case line == "zones":
+		listZones(w, amp)
+		return
+	case strings.HasPrefix(line, "?") || strings.HasPrefix(line, "<"):
+		var lines []string
+		lines, err = amp.SendRaw(line)
+		printRaw(w, lines)
+	case len(fields) == 1 || (len(fields) == 2 && fields[1] == "status"):
+		var id int
+		id, err = strconv.Atoi(fields[0])
+		if err == nil {
+			var state monoprice.State
+			state, err = amp.QueryState(monoprice.ZoneID(id))
+			if err == nil {
+				printStates(w, []monoprice.State{state})
+			}
+		}
+	case len(fields) == 3:
+		err = consoleSet(amp, fields)
+	default:
+		err = fmt.Errorf("%w %q, type help for a list of commands", monoprice.ErrCommand, line)
+	}
+
+	if err == nil {
+		fmt.Fprintf(w, "OK (%v)\n", time.Since(start).Round(time.Millisecond))
+	} else {
+		fmt.Fprintf(w, "Error: %v (%v)\n", err, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+func consoleSet(amp *monoprice.Amplifier, fields []string) error {
+	id, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return err
+	}
+
+	attr, found := attributes[strings.ToLower(fields[1])]
+	if !found {
+		return fmt.Errorf("%w unknown attribute %q", monoprice.ErrCommand, fields[1])
+	}
+
+	arg, err := attr.parser(fields[2])
+	if err == nil {
+		err = amp.SendCommand(monoprice.ZoneID(id), attr.cmd, arg)
+	}
+	return err
+}
+
+// printRaw prints the lines received from the amplifier, decoding any
+// state responses
+func printRaw(w io.Writer, lines []string) {
+	states := []monoprice.State{}
+	for _, line := range lines {
+		state := monoprice.State{}
+		if strings.HasPrefix(line, ">") && state.Unmarshal(line[1:]) == nil {
+			states = append(states, state)
+		} else {
+			fmt.Fprintln(w, line)
+		}
+	}
+
+	if len(states) > 0 {
+		printStates(w, states)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/abates/monoprice"
+)
+
+func TestConsoleCompleter(t *testing.T) {
+	_, amp := testCLI(t)
+	completer := consoleCompleter(amp)
+
+	tests := []struct {
+		name string
+		line string
+		want []string
+	}{
+		{"Commands", "z", []string{"zones "}},
+		{"Zones", "1", []string{"11 ", "12 "}},
+		{"Attributes", "11 b", []string{"11 balance ", "11 bass "}},
+		{"Query", "?1", []string{"?11 ", "?12 "}},
+		{"Raw commands", "<11", []string{"<11BL ", "<11BS ", "<11CH ", "<11DT ", "<11MU ", "<11PR ", "<11TR ", "<11VO "}},
+		{"Raw command", "<12V", []string{"<12VO "}},
+		{"Unknown zone", "<13", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			suffixes, _ := completer.Do([]rune(test.line), len(test.line))
+			got := []string{}
+			for _, suffix := range suffixes {
+				got = append(got, test.line+string(suffix))
+			}
+			sort.Strings(got)
+
+			if strings.Join(got, "|") != strings.Join(test.want, "|") {
+				t.Errorf("Wanted %q got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestConsoleExec(t *testing.T) {
+	fake, amp := testCLI(t)
+
+	tests := []struct {
+		name  string
+		line  string
+		want  []string
+		check func(monoprice.State) bool
+	}{
+		{"Empty", "  ", nil, nil},
+		{"Help", "help", []string{"Commands:"}, nil},
+		{"Zones", "zones", []string{"11\n12\n"}, nil},
+		{"Raw query", "?11", []string{"ZONE", "11  ", "OK ("}, nil},
+		{"Raw command", "<11VO15", []string{"OK ("}, func(s monoprice.State) bool { return s.Volume == 15 }},
+		{"Status", "12", []string{"12  ", "OK ("}, nil},
+		{"Status word", "12 status", []string{"12  ", "OK ("}, nil},
+		{"Set", "11 treble 3", []string{"OK ("}, func(s monoprice.State) bool { return s.Treble == 3 }},
+		{"Set DND", "11 dnd true", []string{"OK ("}, func(s monoprice.State) bool { return s.DoNotDisturb }},
+		{"Invalid zone", "kitchen", []string{"Error: "}, nil},
+		{"Unknown attribute", "11 loudness 3", []string{`Error: invalid Command unknown attribute "loudness"`}, nil},
+		{"Out of range", "11 volume 99", []string{"Error: "}, nil},
+		{"Unknown command", "turn it up please", []string{"type help for a list of commands"}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out strings.Builder
+			consoleExec(&out, amp, test.line)
+			if test.want == nil && out.Len() != 0 {
+				t.Errorf("Wanted no output got %q", out.String())
+			}
+
+			for _, want := range test.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("Wanted output containing %q got %q", want, out.String())
+				}
+			}
+
+			if test.check != nil && !test.check(fake.State(11)) {
+				t.Errorf("Zone 11 wasn't changed, got %+v", fake.State(11))
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/abates/monoprice"
+	"github.com/abates/monoprice/api"
+)
+
+// zoneEvent is sent on the event stream whenever a zone's state changes
+type zoneEvent struct {
+	Amp   string           `json:"amp"`
+	Zone  monoprice.ZoneID `json:"zone"`
+	Name  string           `json:"name,omitempty"`
+	State monoprice.State  `json:"state"`
+}
+
+// keepAlive is how often a comment is sent on an idle event stream so
+// proxies don't close it
+const keepAlive = 15 * time.Second
+
+// events serves GET /events, a server-sent event stream of zone states.
+// The current state of every zone is sent first, followed by each change
+// seen by the amps' monitors.  Keys limited to some zones only see those
+// zones.  The stream ends when the configuration is reloaded or an amp's
+// monitor stops, and clients are expected to reconnect
+func (inst *instance) events(w http.ResponseWriter, r *http.Request) {
+	key, limited := requestKey(r)
+	allowed := func(amp string, zone monoprice.ZoneID) bool {
+		return !limited || inst.cfg.allowsZone(key, amp, zone)
+	}
+
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		api.WriteErrorCode(w, http.StatusInternalServerError, "internal", "streaming not supported")
+		return
+	}
+
+	names := []string{}
+	for name := range inst.amps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ctx := r.Context()
+	merged := make(chan zoneEvent, 64)
+	done := make(chan struct{}, len(names))
+	initial := []zoneEvent{}
+	for _, name := range names {
+		monitor := inst.amps[name].monitor.Load()
+		if monitor == nil {
+			continue
+		}
+
+		ch, unsubscribe := monitor.Subscribe()
+		defer unsubscribe()
+
+		states := monitor.States()
+		for _, zone := range inst.amps[name].amp.Zones() {
+			if state, found := states[zone.ID()]; found && allowed(name, zone.ID()) {
+				initial = append(initial, zoneEvent{Amp: name, Zone: zone.ID(), Name: inst.cfg.zoneName(name, zone.ID()), State: state})
+			}
+		}
+
+		go func(name string) {
+			defer func() { done <- struct{}{} }()
+			for event := range ch {
+				for _, change := range event.Changes {
+					if !allowed(name, change.Zone) {
+						continue
+					}
+
+					select {
+					case merged <- zoneEvent{Amp: name, Zone: change.Zone, Name: inst.cfg.zoneName(name, change.Zone), State: change.Current}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}(name)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event zoneEvent) error {
+		b, _ := json.Marshal(event)
+		_, err := fmt.Fprintf(w, "event: state\ndata: %s\n\n", b)
+		if err == nil {
+			err = rc.Flush()
+		}
+		return err
+	}
+
+	for _, event := range initial {
+		if send(event) != nil {
+			return
+		}
+	}
+	rc.Flush()
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case <-inst.retired:
+			return
+		case <-done:
+			// a monitor was stopped
+			return
+		case event := <-merged:
+			err = send(event)
+		case <-ticker.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+			if err == nil {
+				err = rc.Flush()
+			}
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/abates/monoprice"
+	"github.com/abates/monoprice/homekit"
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v3"
+)
+
+// homekitConfig is the configuration of the homekit integration, which
+// runs a HomeKit bridge with an accessory for every zone
+type homekitConfig struct {
+	Name      string         `yaml:"name"`
+	Port      int            `yaml:"port"`
+	SetupCode string         `yaml:"setup_code"`
+	Storage   string         `yaml:"storage"`
+	Sources   map[int]string `yaml:"sources"`
+}
+
+// differs reports whether hc has different bridge settings than other.
+// Source names are left out since they are applied on every reload
+func (hc homekitConfig) differs(other homekitConfig) bool {
+	return hc.Name != other.Name || hc.Port != other.Port || hc.SetupCode != other.SetupCode || hc.Storage != other.Storage
+}
+
+// bridge is the HomeKit bridge started by the first configuration that
+// enabled it.  It outlives reloads so controllers stay connected
+var bridge struct {
+	sync.Mutex
+	*homekit.Bridge
+	cfg homekitConfig
+}
+
+func init() {
+	integrations["homekit"] = integration{validate: validateHomekit, setup: setupHomekit}
+}
+
+func decodeHomekit(node *yaml.Node) (homekitConfig, error) {
+	hc := homekitConfig{Name: "Amplifier", Port: 51826, Storage: "homekit.json"}
+	err := decodeStrict(node, &hc)
+	return hc, err
+}
+
+func validateHomekit(node *yaml.Node) error {
+	hc, err := decodeHomekit(node)
+	if err != nil {
+		return err
+	}
+
+	if hc.Port < 1 || hc.Port > 65535 {
+		return fmt.Errorf("port %d is out of range", hc.Port)
+	}
+
+	if hc.SetupCode != "" && !homekit.ValidSetupCode(hc.SetupCode) {
+		return homekit.ErrSetupCode
+	}
+
+	if hc.Storage == "" {
+		return errors.New("storage can't be empty")
+	}
+
+	for source := range hc.Sources {
+		if source < 1 || source > 6 {
+			return fmt.Errorf("source %d must be between 1 and 6", source)
+		}
+	}
+	return nil
+}
+
+// setupHomekit starts the bridge the first time it is called, and gives
+// it the instance's zones every time.  Changes to anything but the
+// source names need a restart
+func setupHomekit(inst *instance, router *mux.Router, node *yaml.Node) error {
+	hc, err := decodeHomekit(node)
+	if err != nil {
+		return err
+	}
+
+	bridge.Lock()
+	defer bridge.Unlock()
+	if bridge.Bridge == nil {
+		options := []homekit.Option{homekit.NameOption(hc.Name), homekit.LoggerOption(slog.Default())}
+		if hc.SetupCode != "" {
+			options = append(options, homekit.SetupCodeOption(hc.SetupCode))
+		}
+
+		bridge.Bridge, err = homekit.NewBridge(hc.Storage, options...)
+		if err != nil {
+			return err
+		}
+		bridge.cfg = hc
+
+		b := bridge.Bridge
+		go func() {
+			log.Printf("HomeKit bridge started, listening on port %d", hc.Port)
+			if err := b.ListenAndServe(fmt.Sprintf(":%d", hc.Port)); err != nil {
+				log.Printf("HomeKit bridge stopped: %v", err)
+			}
+		}()
+
+		if !b.Paired() {
+			log.Printf("HomeKit bridge is not paired, add it in the Home app with setup code %s", b.SetupCode())
+		}
+	} else if hc.differs(bridge.cfg) {
+		log.Printf("HomeKit settings have changed, the server must be restarted for them to take effect")
+	}
+
+	names := []string{}
+	for name := range inst.amps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	zones := []homekit.Zone{}
+	known := make(map[string]monoprice.State)
+	for _, name := range names {
+		conn := inst.amps[name]
+
+		// the integration's source names take precedence over the ones
+		// in the sources section
+		sources := hc.Sources
+		if len(sources) == 0 {
+			sources = make(map[int]string)
+			for id := 1; id <= 6; id++ {
+				if source := inst.cfg.sourceName(name, id); source != "" {
+					sources[id] = source
+				}
+			}
+		}
+
+		for _, zone := range inst.audit.controller(name, originHomekit, conn.amp).Zones() {
+			zones = append(zones, homekit.Zone{
+				ID:      zoneKey(name, zone.ID()),
+				Name:    inst.cfg.zoneName(name, zone.ID()),
+				Zone:    zone,
+				Sources: sources,
+			})
+		}
+
+		if monitor := conn.monitor.Load(); monitor != nil {
+			for zone, state := range monitor.States() {
+				known[zoneKey(name, zone)] = state
+			}
+		}
+	}
+
+	if err := bridge.SetZones(zones); err != nil {
+		return err
+	}
+
+	// zones on amps that are already being monitored don't have to be
+	// queried when a controller reads them
+	for id, state := range known {
+		bridge.Update(id, state)
+	}
+
+	b := bridge.Bridge
+	inst.watchers = append(inst.watchers, func(amp string, event monoprice.MonitorEvent) {
+		for _, change := range event.Changes {
+			b.Update(zoneKey(amp, change.Zone), change.Current)
+		}
+	})
+	return nil
+}
+
+// zoneKey identifies a zone to the bridge
+func zoneKey(amp string, zone monoprice.ZoneID) string {
+	return amp + ":" + strconv.Itoa(int(zone))
+}
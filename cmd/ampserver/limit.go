@@ -0,0 +1,163 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abates/monoprice/api"
+	"github.com/gorilla/mux"
+)
+
+// tokenBucket holds up to burst tokens and gains rate tokens per second
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket for each key it is asked about.
+// Buckets that have been idle long enough to refill are dropped, since a
+// new bucket would behave the same
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{
+		rate:    rate,
+		burst:   math.Max(1, float64(burst)),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// take removes a token from the key's bucket.  If the bucket is empty it
+// returns how long until the next token is available
+func (rl *rateLimiter) take(key string, now time.Time) (bool, time.Duration) {
+	if rl == nil {
+		return true, 0
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	if fill := time.Duration(rl.burst / rl.rate * float64(time.Second)); now.Sub(rl.pruned) > fill {
+		rl.prune(now, fill)
+	}
+
+	bucket, found := rl.buckets[key]
+	if !found {
+		bucket = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(rl.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*rl.rate)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / rl.rate * float64(time.Second))
+}
+
+// prune drops the buckets that haven't been used for the time it takes
+// to refill an empty bucket
+func (rl *rateLimiter) prune(now time.Time, fill time.Duration) {
+	for key, bucket := range rl.buckets {
+		if now.Sub(bucket.last) >= fill {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.pruned = now
+}
+
+// zoneBucket returns the bucket key for the zone a request changes.  The
+// zone is only found for a configured amp and a valid zone id, so
+// requests for zones that don't exist can't add buckets
+func (cfg *Config) zoneBucket(r *http.Request) (string, bool) {
+	amp, zone, found := cfg.requestZone(r)
+	if !found || cfg.amp(amp) == nil {
+		return "", false
+	}
+
+	id, err := strconv.Atoi(zone)
+	if err != nil || !validZoneID(id) {
+		return "", false
+	}
+	return amp + ":" + strconv.Itoa(id), true
+}
+
+// serialRequest reports whether a request will wait for the amplifier.
+// Everything except reading the lists of amps, zone ids, groups, scenes
+// and sources does.  The bulk status and v1 zone lists query every zone
+func serialRequest(r *http.Request) bool {
+	_, zone := mux.Vars(r)["zone"]
+	allZones := strings.HasSuffix(r.URL.Path, "/zones/status") ||
+		(strings.HasPrefix(r.URL.Path, "/v1/") && path.Base(r.URL.Path) == "zones")
+	return zone || allZones || r.Method != http.MethodGet
+}
+
+func retryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+// limitMiddleware applies the per key and per zone rate limits and sheds
+// requests once too many are already waiting for the amplifier
+func limitMiddleware(cfg *Config) mux.MiddlewareFunc {
+	keys := newRateLimiter(cfg.Limits.KeyRate, cfg.Limits.KeyBurst)
+	zones := newRateLimiter(cfg.Limits.ZoneRate, cfg.Limits.ZoneBurst)
+
+	var pending chan struct{}
+	if cfg.Limits.MaxPending > 0 {
+		pending = make(chan struct{}, cfg.Limits.MaxPending)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			now := time.Now()
+			key, _ := requestKey(r)
+			if ok, wait := keys.take(key.Name, now); !ok {
+				retryAfter(w, wait)
+				api.WriteErrorCode(w, http.StatusTooManyRequests, "rate_limited", "too many requests")
+				return
+			}
+
+			if bucket, found := cfg.zoneBucket(r); found && r.Method != http.MethodGet {
+				if ok, wait := zones.take(bucket, now); !ok {
+					retryAfter(w, wait)
+					api.WriteErrorCode(w, http.StatusTooManyRequests, "rate_limited", "too many requests")
+					return
+				}
+			}
+
+			if pending != nil && serialRequest(r) {
+				select {
+				case pending <- struct{}{}:
+					// long polls give up their place once they are only
+					// waiting for the monitor
+					var once sync.Once
+					release := func() { once.Do(func() { <-pending }) }
+					defer release()
+					r = r.WithContext(api.WithWaiting(r.Context(), release))
+				default:
+					retryAfter(w, time.Second)
+					api.WriteErrorCode(w, http.StatusServiceUnavailable, "busy", "amplifier busy")
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abates/monoprice"
+	"github.com/abates/monoprice/api"
+	"github.com/abates/monoprice/internal/fakeamp"
+	"github.com/gorilla/mux"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(2, 2)
+	start := time.Now()
+
+	tests := []struct {
+		name     string
+		key      string
+		offset   time.Duration
+		want     bool
+		wantWait time.Duration
+	}{
+		{"First", "a", 0, true, 0},
+		{"Burst", "a", 0, true, 0},
+		{"Empty", "a", 0, false, 500 * time.Millisecond},
+		{"Other key", "b", 0, true, 0},
+		{"Partial refill", "a", 250 * time.Millisecond, false, 250 * time.Millisecond},
+		{"Refilled", "a", 500 * time.Millisecond, true, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, gotWait := rl.take(test.key, start.Add(test.offset))
+			if got != test.want || gotWait != test.wantWait {
+				t.Errorf("Wanted %v (%v) got %v (%v)", test.want, test.wantWait, got, gotWait)
+			}
+		})
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	rl := newRateLimiter(2, 2)
+	start := time.Now()
+	for _, key := range []string{"a", "b", "c"} {
+		rl.take(key, start)
+	}
+
+	// a's bucket is used again before it refills, the others are idle
+	rl.take("a", start.Add(900*time.Millisecond))
+	rl.take("a", start.Add(1500*time.Millisecond))
+	rl.take("d", start.Add(2500*time.Millisecond))
+
+	if len(rl.buckets) != 2 || rl.buckets["a"] == nil || rl.buckets["d"] == nil {
+		t.Errorf("Wanted buckets a and d got %v", rl.buckets)
+	}
+}
+
+func TestLimitMiddleware(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Amps = append(cfg.Amps, AmpConfig{Name: "pool"})
+	cfg.Limits = LimitsConfig{KeyRate: 0.1, KeyBurst: 9, ZoneRate: 0.1, ZoneBurst: 1, MaxPending: 1}
+
+	entered := make(chan struct{})
+	block := make(chan struct{})
+	router := mux.NewRouter()
+	router.HandleFunc("/zones", func(w http.ResponseWriter, r *http.Request) {})
+	router.HandleFunc("/zones/status", func(w http.ResponseWriter, r *http.Request) {})
+	router.HandleFunc("/{zone}/volume/{level}", func(w http.ResponseWriter, r *http.Request) {})
+	router.HandleFunc("/amps/{name}/zones/{zone}/volume/{level}", func(w http.ResponseWriter, r *http.Request) {})
+	router.HandleFunc("/{zone}/status", func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-block
+	})
+	router.Use(limitMiddleware(cfg))
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	// a request waiting on the amplifier fills the pending cap
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		do("GET", "/11/status")
+	}()
+	<-entered
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		want       int
+		wantRetry  string
+		beforeFunc func()
+	}{
+		{"Busy", "GET", "/12/status", http.StatusServiceUnavailable, "1", nil},
+		{"Bulk status busy", "GET", "/zones/status", http.StatusServiceUnavailable, "1", nil},
+		{"Long poll busy", "GET", "/12/status?wait=30s&since=%2200%22", http.StatusServiceUnavailable, "1", nil},
+		{"Command", "PUT", "/11/volume/10", http.StatusOK, "", func() { close(block); wg.Wait() }},
+		{"Zone limit", "PUT", "/11/volume/11", http.StatusTooManyRequests, "10", nil},
+		{"Other amp", "PUT", "/amps/pool/zones/11/volume/11", http.StatusOK, "", nil},
+		{"Invalid zone", "PUT", "/99/volume/1", http.StatusOK, "", nil},
+		{"Invalid zone again", "PUT", "/99/volume/1", http.StatusOK, "", nil},
+		{"Key limit", "GET", "/zones", http.StatusTooManyRequests, "10", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.beforeFunc != nil {
+				test.beforeFunc()
+			}
+
+			w := do(test.method, test.path)
+			if w.Code != test.want {
+				t.Errorf("Wanted status %d got %d", test.want, w.Code)
+			}
+
+			if got := w.Header().Get("Retry-After"); got != test.wantRetry {
+				t.Errorf("Wanted Retry-After %q got %q", test.wantRetry, got)
+			}
+		})
+	}
+}
+
+func TestLimitMiddlewareWait(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Limits = LimitsConfig{MaxPending: 1}
+
+	amp, err := monoprice.New(fakeamp.New(11, 12))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	monitor := monoprice.NewMonitor(amp.Zones(), time.Hour)
+	monitor.Poll()
+
+	router := api.New(amp, api.MonitorOption(func(string) *monoprice.Monitor { return monitor }))
+	router.Use(limitMiddleware(cfg))
+
+	do := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	// a long poll holds the pending cap while it queries the zone, then
+	// gives it up while it waits for a change
+	etag := do("/11/status").Header().Get("ETag")
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- do("/11/status?wait=200ms&since=" + url.QueryEscape(etag))
+	}()
+
+	select {
+	case w := <-done:
+		t.Fatalf("Wanted the long poll to wait got status %d", w.Code)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if w := do("/12/status"); w.Code != http.StatusOK {
+		t.Errorf("Wanted status %d while the long poll waits got %d", http.StatusOK, w.Code)
+	}
+
+	if w := <-done; w.Code != http.StatusNotModified {
+		t.Errorf("Wanted status %d got %d", http.StatusNotModified, w.Code)
+	}
+}
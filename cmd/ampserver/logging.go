@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// consoleTimeFormat is precise enough to see the amplifier's response
+// times
+const consoleTimeFormat = "15:04:05.000000"
+
+// setupLogging configures the default logger, which both the server's
+// messages and the amplifiers' messages go to.  With verbose, each line
+// sent to and received from the amplifiers is logged as well
+func setupLogging(format string, verbose bool) error {
+	level := slog.LevelInfo
+	if verbose {
+		level = slog.LevelDebug
+	}
+	return setLogHandler(os.Stderr, format, &slog.HandlerOptions{Level: level})
+}
+
+// setupConsoleLogging configures the default logger for the console.
+// Messages are written to w with every line sent to and received from
+// the amplifier, and text messages show the time of day to the
+// microsecond
+func setupConsoleLogging(w io.Writer, format string) error {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if format == "text" {
+		opts.ReplaceAttr = func(groups []string, attr slog.Attr) slog.Attr {
+			if len(groups) == 0 && attr.Key == slog.TimeKey && attr.Value.Kind() == slog.KindTime {
+				attr.Value = slog.StringValue(attr.Value.Time().Format(consoleTimeFormat))
+			}
+			return attr
+		}
+	}
+	return setLogHandler(w, format, opts)
+}
+
+func setLogHandler(w io.Writer, format string, opts *slog.HandlerOptions) error {
+	switch format {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(w, opts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, opts)))
+	default:
+		return fmt.Errorf("unknown log format %q, use text or json", format)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"log/slog"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSetupConsoleLogging(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	tests := []struct {
+		name   string
+		format string
+		want   *regexp.Regexp
+	}{
+		{"Text", "text", regexp.MustCompile(`^time=\d\d:\d\d:\d\d\.\d{6} level=DEBUG msg=TX line=<11VO20\ntime=\d\d:\d\d:\d\d\.\d{6} level=INFO msg="Failed to read input"\n$`)},
+		{"JSON", "json", regexp.MustCompile(`^\{"time":"[^"]+","level":"DEBUG","msg":"TX","line":"<11VO20"\}\n\{"time":"[^"]+","level":"INFO","msg":"Failed to read input"\}\n$`)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out strings.Builder
+			if err := setupConsoleLogging(&out, test.format); err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+
+			slog.Debug("TX", "line", "<11VO20")
+			log.Printf("Failed to read input")
+			if !test.want.MatchString(out.String()) {
+				t.Errorf("Wanted output matching %s got %q", test.want, out.String())
+			}
+		})
+	}
+
+	if err := setupConsoleLogging(&strings.Builder{}, "xml"); err == nil {
+		t.Errorf("Wanted an error for an unknown format")
+	}
+}
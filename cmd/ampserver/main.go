@@ -1,26 +1,41 @@
 package main
 
 import (
-	"crypto/rand"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
-	"net/http"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/abates/monoprice"
 	"github.com/abates/monoprice/api"
-	"github.com/gorilla/mux"
 	"github.com/tarm/serial"
 )
 
 var verbose bool
 var disableAuth bool
-var apiKey string
+var configFile string
+var cfg *Config
+var enableRaw bool
+var recordFile string
+var ampFlag string
+var ampName string
+var ampURL string
+var jsonOutput bool
+var scenesFile string
+var watchInterval time.Duration
+var caCertFile string
+var clientCertFile string
+var clientKeyFile string
+var logFormat string
+var plainKey bool
 
 func getEnv(key, fallback string) string {
 	value := os.Getenv(key)
@@ -41,96 +56,261 @@ func getIntEnv(key string, fallback int) int {
 }
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "Usage: %s <flags> [server|keygen]\n", filepath.Base(os.Args[0]))
+	name := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s <flags> [server|console]\n", name)
+	fmt.Fprintf(os.Stderr, "       %s <flags> keygen [add|list|revoke] [-scope scope] [-zones zones] [-groups groups] [name]\n", name)
+	fmt.Fprintf(os.Stderr, "       %s <flags> record <transcript file>\n", name)
+	fmt.Fprintf(os.Stderr, "       %s <flags> check-config [config file]\n", name)
+	fmt.Fprintf(os.Stderr, "       %s <flags> zones\n", name)
+	fmt.Fprintf(os.Stderr, "       %s <flags> status [zone]\n", name)
+	fmt.Fprintf(os.Stderr, "       %s <flags> set <zone> <attribute> <value>\n", name)
+	fmt.Fprintf(os.Stderr, "       %s <flags> scene [recall|save] <name> [zone...]\n", name)
+	fmt.Fprintf(os.Stderr, "       %s <flags> watch\n", name)
 	flag.PrintDefaults()
 }
 
 func main() {
 	flag.BoolVar(&verbose, "verbose", false, "verbose logging")
+	flag.StringVar(&configFile, "config", getEnv("CONFIG_FILE", ""), "configuration file")
 	flag.BoolVar(&disableAuth, "noauth", false, "disable authentication middleware (useful for testing)")
+	flag.BoolVar(&enableRaw, "raw", false, "enable the admin endpoint for sending raw protocol lines")
+	flag.StringVar(&ampFlag, "amp", "", "amplifier to control when more than one is configured")
+	flag.StringVar(&ampURL, "url", "", "control a running ampserver at this URL instead of the serial port")
+	flag.BoolVar(&jsonOutput, "json", false, "print command output as JSON")
+	flag.BoolVar(&plainKey, "plain-key", false, "send API_KEY in the X-Auth-Key header instead of signing requests to -url")
+	flag.StringVar(&scenesFile, "scenes", getEnv("SCENES_FILE", "scenes.json"), "file containing saved scenes")
+	flag.StringVar(&caCertFile, "cacert", getEnv("AMP_CACERT", ""), "CA certificate used to verify the server given with -url")
+	flag.StringVar(&clientCertFile, "client-cert", getEnv("AMP_CLIENT_CERT", ""), "client certificate sent to the server given with -url")
+	flag.StringVar(&clientKeyFile, "client-key", getEnv("AMP_CLIENT_KEY", ""), "key for the client certificate")
+	flag.StringVar(&logFormat, "log-format", getEnv("LOG_FORMAT", "text"), "log format, text or json")
+	flag.DurationVar(&watchInterval, "interval", time.Second, "polling interval for the watch command")
 	flag.Usage = usage
 	flag.Parse()
 
+	if err := setupLogging(logFormat, verbose); err != nil {
+		log.Fatalf("%v", err)
+	}
+
 	cmd := ""
-	if len(flag.Args()) > 0 {
-		cmd = flag.Args()[0]
+	args := flag.Args()
+	if len(args) > 0 {
+		cmd = args[0]
+		args = args[1:]
+	}
+
+	if cmd == "check-config" {
+		checkConfig(args)
+		return
+	}
+
+	cfg = defaultConfig()
+	if configFile != "" {
+		var err error
+		cfg, err = loadConfig(configFile)
+		if err != nil {
+			log.Fatalf("Failed to load configuration:\n%v", err)
+		}
 	}
+	cfg.applyEnv()
 
+	ampName = ampFlag
+	if ampName == "" {
+		ampName = cfg.DefaultAmp
+	} else if cfg.amp(ampName) == nil && ampURL == "" {
+		log.Fatalf("Unknown amp %q", ampName)
+	}
+
+	var err error
 	switch cmd {
 	case "server":
 		server()
+	case "record":
+		if len(args) != 1 {
+			err = errUsage
+			break
+		}
+		recordFile = args[0]
+		server()
 	case "keygen":
-		keygen()
+		keygen(args)
+	case "console":
+		console()
+	case "zones":
+		err = listZones(os.Stdout, connect())
+	case "status":
+		err = status(os.Stdout, connect(), args)
+	case "set":
+		err = set(connect(), args)
+	case "scene":
+		err = scene(connect(), args)
+	case "watch":
+		watch(os.Stdout, connect())
 	default:
+		err = errUsage
+	}
+
+	if errors.Is(err, errUsage) {
 		usage()
 		os.Exit(-1)
+	} else if err != nil {
+		log.Fatalf("%v", err)
 	}
 }
 
-func keygen() {
-	b := make([]byte, 64)
-	rand.Read(b)
-	fmt.Printf("%x\n", b)
+func checkConfig(args []string) {
+	filename := configFile
+	if len(args) > 0 {
+		filename = args[0]
+	}
+
+	if filename == "" {
+		log.Fatal("check-config requires a config file")
+	}
+
+	if _, err := loadConfig(filename); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: OK\n", filename)
 }
 
-func authMiddleware(apiKey string) mux.MiddlewareFunc {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			reqToken := r.Header.Get("X-Auth-Key")
-			if reqToken == apiKey {
-				next.ServeHTTP(w, r)
-			} else {
-				http.Error(w, "Not Authorized", http.StatusUnauthorized)
-			}
-		})
+// transcriptFile returns the file serial traffic for an amp is recorded
+// to.  Amps other than the implicit default amp of a single amp config
+// have their name added to the file name
+func transcriptFile(name string) string {
+	if name == api.DefaultAmp {
+		return recordFile
 	}
+	ext := filepath.Ext(recordFile)
+	return fmt.Sprintf("%s.%s%s", strings.TrimSuffix(recordFile, ext), name, ext)
 }
 
-func server() {
-	apiKey = getEnv("API_KEY", "")
-	if len(apiKey) == 0 && !disableAuth {
-		log.Fatal("ampserver requires an API_KEY environment variable.")
+// writeFile replaces a file by writing a temporary file and renaming it,
+// so a crash can't leave a truncated file behind
+func writeFile(filename string, b []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+"-*")
+	if err != nil {
+		return err
 	}
 
-	port := getEnv("AMP_PORT", "/dev/ttyUSB0")
-	speed := getIntEnv("AMP_SPEED", 9600)
-	listenPort := getIntEnv("LISTEN_PORT", 8000)
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
 
-	c := &serial.Config{Name: port, Baud: speed, ReadTimeout: time.Second}
-	s, err := serial.OpenPort(c)
 	if err != nil {
-		log.Fatalf("Failed to open serial port: %v", err)
+		os.Remove(tmp.Name())
 	}
+	return err
+}
+
+// ampConn is an open amplifier along with the settings used to open it
+type ampConn struct {
+	transport TransportConfig
+	amp       *monoprice.Amplifier
+	closers   []io.Closer
+
+	// monitor is replaced by a reload while requests may be reading it
+	monitor     atomic.Pointer[monoprice.Monitor]
+	interval    time.Duration
+	stopMonitor func()
+
+	// release ends a pause
+	release chan struct{}
+}
 
-	options := []monoprice.Option{}
-	if verbose {
-		options = append(options, monoprice.VerboseOption())
+// pause stops the monitor and holds the amplifier's lock, so nothing
+// more is sent on the port until resume or Close is called.  A reload
+// pauses a connection while its port is opened again with different
+// settings
+func (ac *ampConn) pause() {
+	if ac.stopMonitor != nil {
+		ac.stopMonitor()
+		ac.stopMonitor = nil
 	}
+	ac.monitor.Store(nil)
+
+	held := make(chan struct{})
+	release := make(chan struct{})
+	go ac.amp.Transaction(func(*monoprice.Tx) error {
+		close(held)
+		<-release
+		return nil
+	})
+	<-held
+	ac.release = release
+}
+
+// resume lets requests use the amplifier again after pause.  The monitor
+// isn't restarted, startMonitors does that
+func (ac *ampConn) resume() {
+	if ac.release != nil {
+		close(ac.release)
+		ac.release = nil
+	}
+}
 
-	amp, err := monoprice.New(s, options...)
+func (ac *ampConn) Close() (err error) {
+	if ac.stopMonitor != nil {
+		ac.stopMonitor()
+	}
+
+	for _, closer := range ac.closers {
+		if e := closer.Close(); err == nil {
+			err = e
+		}
+	}
+
+	// requests held by a pause now fail on the closed port rather than
+	// writing to the port that replaced it
+	ac.resume()
+	return err
+}
+
+func openAmp(ampCfg *AmpConfig) (*ampConn, error) {
+	transport := ampCfg.Transport
+	c := &serial.Config{Name: transport.Port, Baud: transport.Speed, ReadTimeout: transport.ReadTimeout}
+	s, err := serial.OpenPort(c)
 	if err != nil {
-		log.Fatalf("Failed to initialize amplifier: %v", err)
+		return nil, fmt.Errorf("failed to open serial port for amp %s: %w", ampCfg.Name, err)
 	}
+	conn := &ampConn{transport: transport, closers: []io.Closer{s}}
 
-	zones := []string{}
-	z := amp.Zones()
+	options := []monoprice.Option{monoprice.LoggerOption(slog.Default().With("amp", ampCfg.Name))}
 
-	for _, zone := range z {
-		zones = append(zones, fmt.Sprintf("%d", zone.ID()))
+	if recordFile != "" {
+		filename := transcriptFile(ampCfg.Name)
+		f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to open transcript file: %w", err)
+		}
+		log.Printf("Recording serial traffic for amp %s to %s", ampCfg.Name, filename)
+		options = append(options, monoprice.RecordOption(f))
+		conn.closers = append(conn.closers, f)
 	}
-	log.Printf("Connected to amplifier, found zones %s", strings.Join(zones, ","))
 
-	router := api.New(amp)
-	log.Printf("API Server started, listening on port %d", listenPort)
-	if !disableAuth {
-		router.Use(authMiddleware(apiKey))
+	conn.amp, err = monoprice.New(s, options...)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to initialize amplifier %s: %w", ampCfg.Name, err)
 	}
+	return conn, nil
+}
 
-	srv := &http.Server{
-		Handler:      router,
-		Addr:         fmt.Sprintf(":%d", listenPort),
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+// mustOpenAmp opens an amplifier for the command line tools
+func mustOpenAmp(ampCfg *AmpConfig) *monoprice.Amplifier {
+	conn, err := openAmp(ampCfg)
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
-	log.Fatal(srv.ListenAndServe())
+	return conn.amp
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/abates/monoprice"
+)
+
+// attributeOrder is the order attributes are set by a schedule so that
+// the zone is powered on before anything else is changed
+var attributeOrder = []string{"power", "mute", "dnd", "source", "volume", "treble", "bass", "balance"}
+
+// due reports whether the schedule should run at the given minute
+func (s *ScheduleConfig) due(t time.Time) bool {
+	// compare the parsed time so that "7:00" matches as well as "07:00"
+	when, err := time.Parse("15:04", s.Time)
+	if err != nil || t.Hour() != when.Hour() || t.Minute() != when.Minute() {
+		return false
+	}
+
+	if len(s.Days) == 0 {
+		return true
+	}
+
+	for _, day := range s.Days {
+		if weekdays[strings.ToLower(day)] == t.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ScheduleConfig) run(cfg *Config, ctrl controller) error {
+	if s.Scene != "" {
+		scenes, err := loadScenes(scenesFile)
+		if err != nil {
+			return err
+		}
+
+		scene, found := scenes[s.Scene]
+		if !found {
+			return fmt.Errorf("scene %q not found in %s", s.Scene, scenesFile)
+		}
+		return scene.Recall(ctrl.Zones())
+	}
+
+	ids := make(map[monoprice.ZoneID]bool)
+	for _, id := range s.Zones {
+		ids[monoprice.ZoneID(id)] = true
+	}
+
+	for _, group := range s.Groups {
+		for _, id := range cfg.groupZones(group) {
+			ids[monoprice.ZoneID(id)] = true
+		}
+	}
+
+	for _, zone := range ctrl.Zones() {
+		if !ids[zone.ID()] {
+			continue
+		}
+
+		for _, name := range attributeOrder {
+			value, found := s.Set[name]
+			if !found {
+				continue
+			}
+
+			attr := attributes[name]
+			arg, err := attr.parser(value)
+			if err == nil {
+				err = zone.SendCommand(attr.cmd, arg)
+			}
+
+			if err != nil {
+				return fmt.Errorf("zone %d %s: %w", zone.ID(), name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// runSchedules checks the schedules of the current instance at the
+// start of every minute and runs any that are due
+func runSchedules(current func() *instance) {
+	for {
+		next := time.Now().Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(time.Until(next))
+
+		inst := current()
+		cfg := inst.cfg
+		ctrls := inst.controllers()
+		for i := range cfg.Schedules {
+			schedule := &cfg.Schedules[i]
+			if schedule.due(next) {
+				log.Printf("Running schedule %q", schedule.Name)
+				amp := cfg.ampName(schedule.Amp)
+				if err := schedule.run(cfg, inst.audit.controller(amp, originSchedule, ctrls[amp])); err != nil {
+					log.Printf("Schedule %q failed: %v", schedule.Name, err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/abates/monoprice"
+	"github.com/abates/monoprice/api"
+)
+
+// instance is everything the server builds from a configuration.  It is
+// replaced as a whole when the configuration is reloaded
+type instance struct {
+	cfg     *Config
+	amps    map[string]*ampConn
+	store   *stateStore
+	audit   *auditLog
+	handler http.Handler
+
+	// watchers are called with every change the amps' monitors see
+	watchers []func(amp string, event monoprice.MonitorEvent)
+
+	// retired is closed once a reload has replaced the instance
+	retired chan struct{}
+}
+
+func (inst *instance) controllers() map[string]controller {
+	ctrls := make(map[string]controller)
+	for name, conn := range inst.amps {
+		ctrls[name] = conn.amp
+	}
+	return ctrls
+}
+
+// closeOpened closes the amps that were opened for inst when building it
+// fails
+func (inst *instance) closeOpened(opened []*AmpConfig) {
+	for _, ampCfg := range opened {
+		if conn, found := inst.amps[ampCfg.Name]; found {
+			conn.Close()
+		}
+	}
+}
+
+type ampServer struct {
+	// reloadMutex keeps more than one reload from running at once
+	reloadMutex sync.Mutex
+	current     atomic.Pointer[instance]
+
+	// nonces outlive reloads so a request can't be replayed against the
+	// new instance
+	nonces nonceCache
+
+	// openAmp opens an amplifier, it is replaced in tests
+	openAmp func(*AmpConfig) (*ampConn, error)
+}
+
+func server() {
+	s := &ampServer{}
+	inst, err := s.build(cfg, nil)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	s.current.Store(inst)
+	s.startMonitors(inst)
+
+	go runSchedules(s.current.Load)
+	go s.handleSignals()
+
+	srv := &http.Server{
+		Handler:      s,
+		Addr:         fmt.Sprintf(":%d", cfg.Listen.Port),
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+	}
+
+	if cfg.Listen.TLS.enabled() {
+		srv.TLSConfig, err = cfg.Listen.TLS.serverTLS()
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		log.Printf("API Server started, listening for HTTPS on port %d", cfg.Listen.Port)
+		log.Fatal(srv.ListenAndServeTLS("", ""))
+	}
+
+	log.Printf("API Server started, listening on port %d", cfg.Listen.Port)
+	log.Fatal(srv.ListenAndServe())
+}
+
+func (s *ampServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.current.Load().handler.ServeHTTP(w, r)
+}
+
+func (s *ampServer) handleSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		log.Printf("Received SIGHUP, reloading configuration")
+		if err := s.reload(); err != nil {
+			log.Printf("Failed to reload configuration:\n%v", err)
+		}
+	}
+}
+
+// reload reads the configuration file again and replaces the running
+// instance.  Amplifiers whose transport settings haven't changed are
+// kept open
+func (s *ampServer) reload() error {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	newCfg := defaultConfig()
+	if configFile != "" {
+		var err error
+		newCfg, err = loadConfig(configFile)
+		if err != nil {
+			return err
+		}
+	}
+	newCfg.applyEnv()
+
+	prev := s.current.Load()
+	if newCfg.Listen != prev.cfg.Listen {
+		log.Printf("Listen settings have changed, the server must be restarted for them to take effect")
+	}
+
+	inst, err := s.build(newCfg, prev)
+	if err != nil {
+		return err
+	}
+	s.current.Store(inst)
+	s.startMonitors(inst)
+	close(prev.retired)
+
+	for name, conn := range prev.amps {
+		if inst.amps[name] != conn {
+			log.Printf("Closing amp %s", name)
+			conn.Close()
+		}
+	}
+
+	if prev.audit != nil && prev.audit != inst.audit {
+		prev.audit.Close()
+	}
+	log.Printf("Configuration reloaded")
+	return nil
+}
+
+// startMonitors starts polling any amp in inst that doesn't already have
+// a monitor running at the configured interval.  It is called after inst
+// is made current so that the watchers see the new configuration
+func (s *ampServer) startMonitors(inst *instance) {
+	for name, conn := range inst.amps {
+		if conn.monitor.Load() != nil && conn.interval == inst.cfg.Monitor.Interval {
+			continue
+		}
+
+		if conn.stopMonitor != nil {
+			conn.stopMonitor()
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		monitor := monoprice.NewMonitor(conn.amp.Zones(), inst.cfg.Monitor.Interval)
+		conn.interval = inst.cfg.Monitor.Interval
+		events, unsubscribe := monitor.Subscribe()
+		conn.stopMonitor = func() {
+			cancel()
+			unsubscribe()
+		}
+
+		conn.monitor.Store(monitor)
+		go s.watchMonitor(name, monitor, conn.amp, events)
+		go monitor.Run(ctx)
+	}
+}
+
+func (s *ampServer) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	err := s.reload()
+	if err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(struct{}{})
+	} else if errors.Is(err, ErrConfig) {
+		api.WriteErrorCode(w, http.StatusBadRequest, "invalid_config", err.Error())
+	} else {
+		log.Printf("Failed to reload configuration: %v", err)
+		api.WriteError(w, err)
+	}
+}
+
+// build creates an instance from cfg.  Amplifiers in prev with the same
+// transport settings are reused, the rest are opened
+func (s *ampServer) build(cfg *Config, prev *instance) (*instance, error) {
+	authDisabled := disableAuth || cfg.Auth.Disabled
+	keys, err := cfg.authKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 && !authDisabled {
+		return nil, fmt.Errorf("ampserver requires an API_KEY environment variable, auth keys in the config file or a keystore")
+	}
+
+	if enableRaw && !authDisabled {
+		hasAdmin := false
+		for _, key := range keys {
+			hasAdmin = hasAdmin || key.scope() == scopeAdmin
+		}
+
+		if !hasAdmin {
+			log.Printf("Raw endpoint is enabled but no admin key is configured, it will reject every request")
+		}
+	}
+
+	inst := &instance{cfg: cfg, amps: make(map[string]*ampConn), retired: make(chan struct{})}
+	if cfg.State.File != "" {
+		if prev != nil && prev.store != nil && prev.store.filename == cfg.State.File {
+			inst.store = prev.store
+		} else {
+			inst.store, err = loadStateStore(cfg.State.File)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load state file: %w", err)
+			}
+		}
+	}
+
+	open := []*AmpConfig{}
+	for i := range cfg.Amps {
+		ampCfg := &cfg.Amps[i]
+		if prev != nil {
+			if conn, found := prev.amps[ampCfg.Name]; found && conn.transport == ampCfg.Transport {
+				inst.amps[ampCfg.Name] = conn
+				continue
+			}
+		}
+		open = append(open, ampCfg)
+	}
+
+	// amps being reopened keep their old connection until the new
+	// instance is made current, so a failed reload leaves them working.
+	// reload closes the old connections once they are replaced.  An old
+	// connection on a port that is opened again is paused first, so the
+	// two don't interleave their lines on the same device
+	paused := []*ampConn{}
+	if prev != nil {
+		for name, conn := range prev.amps {
+			if ampCfg := cfg.amp(name); ampCfg != nil && ampCfg.Transport == conn.transport {
+				continue
+			}
+
+			for _, ampCfg := range open {
+				if ampCfg.Transport.Port == conn.transport.Port {
+					conn.pause()
+					paused = append(paused, conn)
+					break
+				}
+			}
+		}
+	}
+
+	built := false
+	defer func() {
+		if !built && len(paused) > 0 {
+			for _, conn := range paused {
+				conn.resume()
+			}
+			s.startMonitors(prev)
+		}
+	}()
+
+	dial := s.openAmp
+	if dial == nil {
+		dial = openAmp
+	}
+
+	// each amplifier has its own serial port and lock, so they are
+	// initialized in parallel
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	errs := []string{}
+	for _, ampCfg := range open {
+		wg.Add(1)
+		go func(ampCfg *AmpConfig) {
+			defer wg.Done()
+			conn, err := dial(ampCfg)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				errs = append(errs, err.Error())
+				return
+			}
+			inst.amps[ampCfg.Name] = conn
+
+			zones := []string{}
+			for _, zone := range conn.amp.Zones() {
+				if name := cfg.zoneName(ampCfg.Name, zone.ID()); name != "" {
+					zones = append(zones, fmt.Sprintf("%d (%s)", zone.ID(), name))
+				} else {
+					zones = append(zones, fmt.Sprintf("%d", zone.ID()))
+				}
+			}
+			log.Printf("Connected to amplifier %s, found zones %s", ampCfg.Name, strings.Join(zones, ","))
+		}(ampCfg)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		inst.closeOpened(open)
+		return nil, errors.New(strings.Join(errs, "\n"))
+	}
+
+	if cfg.Audit.File != "" {
+		if prev != nil && prev.audit != nil && prev.audit.cfg == cfg.Audit {
+			inst.audit = prev.audit
+		} else if inst.audit, err = openAuditLog(cfg.Audit); err != nil {
+			inst.closeOpened(open)
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+	}
+
+	apiOptions := []api.Option{api.ZoneFilterOption(func(r *http.Request, amp string, zone monoprice.ZoneID) bool {
+		key, limited := requestKey(r)
+		return !limited || cfg.allowsZone(key, amp, zone)
+	})}
+	apiOptions = append(apiOptions, api.MonitorOption(func(amp string) *monoprice.Monitor {
+		if conn, found := inst.amps[amp]; found {
+			return conn.monitor.Load()
+		}
+		return nil
+	}))
+
+	if enableRaw {
+		apiOptions = append(apiOptions, api.RawOption())
+	}
+
+	if inst.audit != nil {
+		apiOptions = append(apiOptions, api.CommandOption(inst.audit.apiCommand()))
+	}
+
+	amps := make(map[string]*monoprice.Amplifier)
+	for name, conn := range inst.amps {
+		amps[name] = conn.amp
+	}
+
+	router := api.NewMulti(amps, cfg.DefaultAmp, apiOptions...)
+	router.HandleFunc("/admin/reload", s.reloadHandler).Methods("POST").Name("admin.reload")
+	if inst.audit != nil {
+		router.HandleFunc("/audit", inst.audit.handler(cfg)).Methods("GET").Name("admin.audit")
+	}
+	router.HandleFunc("/events", inst.events).Methods("GET")
+	inst.v1Routes(router.PathPrefix("/v1").Subrouter())
+
+	names := []string{}
+	for name := range cfg.Integrations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		node := cfg.Integrations[name]
+		if err := integrations[name].setup(inst, router, &node); err != nil {
+			inst.closeOpened(open)
+			if inst.audit != nil && (prev == nil || inst.audit != prev.audit) {
+				inst.audit.Close()
+			}
+			return nil, fmt.Errorf("integration %s: %w", name, err)
+		}
+	}
+
+	if !authDisabled {
+		router.Use(authMiddleware(cfg, keys, &s.nonces))
+	}
+	router.Use(limitMiddleware(cfg))
+	inst.handler = router
+	built = true
+	return inst, nil
+}
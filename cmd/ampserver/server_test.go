@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/abates/monoprice"
+)
+
+func testAmp(t *testing.T) *monoprice.Amplifier {
+	f, err := os.Open("../../testdata/init.jsonl")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer f.Close()
+
+	replay, err := monoprice.NewReplay(f)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	amp, err := monoprice.New(replay)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	return amp
+}
+
+func TestServerBuildReusesAmps(t *testing.T) {
+	prevCfg := defaultConfig()
+	prevCfg.Auth.Keys = []KeyConfig{{Name: "old", Key: "old"}}
+	conn := &ampConn{transport: prevCfg.Amps[0].Transport, amp: testAmp(t)}
+	prev := &instance{cfg: prevCfg, amps: map[string]*ampConn{prevCfg.DefaultAmp: conn}}
+
+	newCfg := defaultConfig()
+	newCfg.Auth.Keys = []KeyConfig{{Name: "new", Key: "new"}}
+	s := &ampServer{}
+	inst, err := s.build(newCfg, prev)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if inst.amps[newCfg.DefaultAmp] != conn {
+		t.Errorf("Expected the amp connection to be reused")
+	}
+
+	for key, want := range map[string]int{"old": http.StatusUnauthorized, "new": http.StatusOK} {
+		req := httptest.NewRequest(http.MethodGet, "/zones", nil)
+		req.Header.Set("X-Auth-Key", key)
+		w := httptest.NewRecorder()
+		inst.handler.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("Key %q wanted status %d got %d", key, want, w.Code)
+		}
+	}
+}
+
+func TestServerBuildPausesSamePort(t *testing.T) {
+	prevCfg := defaultConfig()
+	prevCfg.Auth.Disabled = true
+	conn := &ampConn{transport: prevCfg.Amps[0].Transport, amp: testAmp(t)}
+	defer conn.Close()
+	prev := &instance{cfg: prevCfg, amps: map[string]*ampConn{prevCfg.DefaultAmp: conn}}
+
+	s := &ampServer{}
+	s.current.Store(prev)
+	s.startMonitors(prev)
+
+	newCfg := defaultConfig()
+	newCfg.Auth.Disabled = true
+	newCfg.Amps[0].Transport.Speed = 19200
+
+	held := false
+	s.openAmp = func(*AmpConfig) (*ampConn, error) {
+		// the old connection mustn't poll or take requests while the port
+		// is opened again
+		done := make(chan struct{})
+		go func() {
+			conn.amp.Transaction(func(*monoprice.Tx) error { return nil })
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(50 * time.Millisecond):
+			held = true
+		}
+
+		if conn.monitor.Load() != nil {
+			t.Errorf("Wanted the old monitor stopped")
+		}
+		return nil, errors.New("port busy")
+	}
+
+	if _, err := s.build(newCfg, prev); err == nil {
+		t.Fatalf("Wanted the failed open to fail the build")
+	}
+
+	if !held {
+		t.Errorf("Wanted the old amplifier held while the port was opened")
+	}
+
+	if conn.monitor.Load() == nil {
+		t.Errorf("Wanted the old monitor restarted after the failed reload")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		conn.amp.Transaction(func(*monoprice.Tx) error { return nil })
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Wanted the old amplifier released after the failed reload")
+	}
+}
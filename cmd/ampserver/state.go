@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/abates/monoprice"
+)
+
+// stateStore persists the last observed state of every zone of every
+// amp so that it survives both a server restart and an amp power loss
+type stateStore struct {
+	mutex    sync.Mutex
+	filename string
+	states   map[string]map[monoprice.ZoneID]monoprice.State
+}
+
+func loadStateStore(filename string) (*stateStore, error) {
+	ss := &stateStore{
+		filename: filename,
+		states:   make(map[string]map[monoprice.ZoneID]monoprice.State),
+	}
+
+	b, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return ss, nil
+	} else if err == nil {
+		err = json.Unmarshal(b, &ss.states)
+	}
+	return ss, err
+}
+
+// saved returns a copy of the saved states for an amp
+func (ss *stateStore) saved(amp string) map[monoprice.ZoneID]monoprice.State {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	states := make(map[monoprice.ZoneID]monoprice.State)
+	for id, state := range ss.states[amp] {
+		states[id] = state
+	}
+	return states
+}
+
+// update records the changed states and rewrites the state file
+func (ss *stateStore) update(amp string, changes []monoprice.StateChange) error {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	if ss.states[amp] == nil {
+		ss.states[amp] = make(map[monoprice.ZoneID]monoprice.State)
+	}
+
+	for _, change := range changes {
+		ss.states[amp][change.Zone] = change.Current
+	}
+
+	b, err := json.MarshalIndent(ss.states, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFile(ss.filename, b, 0644)
+}
+
+// settings is the part of a zone's state that a power loss resets
+func settings(state monoprice.State) monoprice.State {
+	return monoprice.State{
+		Mute:         state.Mute,
+		DoNotDisturb: state.DoNotDisturb,
+		Volume:       state.Volume,
+		Treble:       state.Treble,
+		Bass:         state.Bass,
+		Balance:      state.Balance,
+		Source:       state.Source,
+	}
+}
+
+// resetDetected reports whether the amplifier appears to have lost power
+// and come back with factory defaults.  After a reset every zone is
+// off with identical settings, and those settings differ from what was
+// last saved.  Zones that were only switched off, by a keypad, a group
+// or a scene, keep their settings and don't count.  On the first poll,
+// or after the amp was unreachable, one zone whose settings differ from
+// the saved ones is enough.  Otherwise at least two zones must have
+// changed away from their saved settings in the same poll, or the only
+// zone of a single zone amp
+func resetDetected(saved, current map[monoprice.ZoneID]monoprice.State, event monoprice.MonitorEvent) bool {
+	var defaults *monoprice.State
+	for _, state := range current {
+		s := settings(state)
+		if state.Power {
+			return false
+		} else if defaults == nil {
+			defaults = &s
+		} else if *defaults != s {
+			return false
+		}
+	}
+
+	changed := make(map[monoprice.ZoneID]bool)
+	for _, change := range event.Changes {
+		changed[change.Zone] = true
+	}
+
+	differs := 0
+	for id, state := range current {
+		prev, found := saved[id]
+		if !found || settings(prev) == settings(state) {
+			continue
+		}
+
+		if !event.Initial && !event.Reconnected && !changed[id] {
+			return false
+		}
+		differs++
+	}
+
+	if event.Initial || event.Reconnected {
+		return differs > 0
+	}
+	return differs > 1 || (len(current) == 1 && differs == 1)
+}
+
+// watchMonitor records keypad changes in the audit log, saves every
+// change the amp's monitor sees and restores the saved states if the amp
+// is reset
+func (s *ampServer) watchMonitor(name string, monitor *monoprice.Monitor, amp *monoprice.Amplifier, events <-chan monoprice.MonitorEvent) {
+	for event := range events {
+		inst := s.current.Load()
+		if inst.audit != nil {
+			// a change within a couple of polls of a command is assumed
+			// to be the result of that command
+			inst.audit.recordChanges(name, event, 2*inst.cfg.Monitor.Interval+time.Second)
+		}
+
+		for _, watch := range inst.watchers {
+			watch(name, event)
+		}
+
+		if inst.store == nil {
+			continue
+		}
+
+		saved := inst.store.saved(name)
+		if resetDetected(saved, monitor.States(), event) {
+			if inst.cfg.State.AutoRestore {
+				log.Printf("Amp %s appears to have been reset, restoring saved zone states", name)
+				restoreZones(name, inst.audit.controller(name, originRestore, amp).Zones(), saved)
+				continue
+			}
+			// the saved states are kept rather than replaced with the
+			// defaults so they can still be restored by hand
+			log.Printf("Amp %s appears to have been reset, the previous zone states are saved in %s", name, inst.store.filename)
+			continue
+		}
+
+		if err := inst.store.update(name, event.Changes); err != nil {
+			log.Printf("Failed to save zone states: %v", err)
+		}
+	}
+}
+
+func restoreZones(name string, zones []monoprice.Zone, saved map[monoprice.ZoneID]monoprice.State) {
+	for _, zone := range zones {
+		state, found := saved[zone.ID()]
+		if !found {
+			continue
+		}
+
+		if err := monoprice.Restore(zone, state); err == nil {
+			log.Printf("Restored amp %s zone %d to %+v", name, zone.ID(), state)
+		} else {
+			log.Printf("Failed to restore amp %s zone %d: %v", name, zone.ID(), err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/abates/monoprice"
+	"github.com/abates/monoprice/internal/fakeamp"
+)
+
+func TestResetDetected(t *testing.T) {
+	defaults := monoprice.State{Volume: 20, Treble: 7, Bass: 7, Balance: 10, Source: 1}
+	off := func(id monoprice.ZoneID) monoprice.State {
+		state := defaults
+		state.Zone = int(id)
+		return state
+	}
+
+	on := func(id monoprice.ZoneID, volume int) monoprice.State {
+		state := off(id)
+		state.Power = true
+		state.Volume = volume
+		return state
+	}
+
+	saved := map[monoprice.ZoneID]monoprice.State{11: on(11, 10), 12: on(12, 15), 13: off(13)}
+	reset := map[monoprice.ZoneID]monoprice.State{11: off(11), 12: off(12), 13: off(13)}
+	changes := []monoprice.StateChange{{Zone: 11}, {Zone: 12}}
+	quiet := off(13)
+	quiet.Volume = 5
+
+	tests := []struct {
+		name    string
+		saved   map[monoprice.ZoneID]monoprice.State
+		current map[monoprice.ZoneID]monoprice.State
+		event   monoprice.MonitorEvent
+		want    bool
+	}{
+		{"Initial", saved, reset, monoprice.MonitorEvent{Initial: true}, true},
+		{"Reconnected", saved, reset, monoprice.MonitorEvent{Reconnected: true}, true},
+		{"Changed", saved, reset, monoprice.MonitorEvent{Changes: changes}, true},
+		{"One zone changed", saved, reset, monoprice.MonitorEvent{Changes: changes[:1]}, false},
+		{"Nothing saved", nil, reset, monoprice.MonitorEvent{Initial: true}, false},
+		{"Already off", reset, reset, monoprice.MonitorEvent{Initial: true}, false},
+		{"Zone on", saved, map[monoprice.ZoneID]monoprice.State{11: off(11), 12: on(12, 15), 13: off(13)}, monoprice.MonitorEvent{Initial: true}, false},
+		{"Single zone", map[monoprice.ZoneID]monoprice.State{11: on(11, 10)}, map[monoprice.ZoneID]monoprice.State{11: off(11)}, monoprice.MonitorEvent{Changes: changes[:1]}, true},
+		{"Single zone off", map[monoprice.ZoneID]monoprice.State{11: on(11, 20)}, map[monoprice.ZoneID]monoprice.State{11: off(11)}, monoprice.MonitorEvent{Changes: changes[:1]}, false},
+		{"Group powered off", map[monoprice.ZoneID]monoprice.State{11: on(11, 20), 12: on(12, 20), 13: off(13)}, reset, monoprice.MonitorEvent{Changes: changes}, false},
+		{"Powered off while down", map[monoprice.ZoneID]monoprice.State{11: on(11, 20), 12: on(12, 20), 13: off(13)}, reset, monoprice.MonitorEvent{Initial: true}, false},
+		{"Different settings", saved, map[monoprice.ZoneID]monoprice.State{11: off(11), 12: off(12), 13: quiet}, monoprice.MonitorEvent{Initial: true}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := resetDetected(test.saved, test.current, test.event)
+			if got != test.want {
+				t.Errorf("Wanted %v got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestStateStore(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "state.json")
+	ss, err := loadStateStore(filename)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	want := monoprice.State{Zone: 11, Power: true, Volume: 12}
+	err = ss.update("default", []monoprice.StateChange{{Zone: 11, Current: want}})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	ss, err = loadStateStore(filename)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if got := ss.saved("default")[11]; got != want {
+		t.Errorf("Wanted %+v got %+v", want, got)
+	}
+}
+
+func TestWatchMonitorKeepsSaved(t *testing.T) {
+	cfg := defaultConfig()
+	store, err := loadStateStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	want := monoprice.State{Zone: 11, Power: true, Volume: 25, Treble: 7, Bass: 7, Balance: 10, Source: 3}
+	store.update(cfg.DefaultAmp, []monoprice.StateChange{{Zone: 11, Current: want}})
+
+	// the fake amp comes up with every zone off, as after a reset
+	amp, err := monoprice.New(fakeamp.New(11, 12))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	s := &ampServer{}
+	s.current.Store(&instance{cfg: cfg, store: store})
+
+	monitor := monoprice.NewMonitor(amp.Zones(), time.Hour)
+	events, unsubscribe := monitor.Subscribe()
+	done := make(chan struct{})
+	go func() {
+		s.watchMonitor(cfg.DefaultAmp, monitor, amp, events)
+		close(done)
+	}()
+
+	monitor.Poll()
+	unsubscribe()
+	<-done
+
+	if got := store.saved(cfg.DefaultAmp)[11]; got != want {
+		t.Errorf("Wanted the saved state %+v kept got %+v", want, got)
+	}
+}
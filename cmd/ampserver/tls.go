@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+func (tc *TLSConfig) enabled() bool {
+	return tc.Cert != ""
+}
+
+// serverTLS loads the server certificate, generating it first if it is
+// self signed and doesn't exist yet
+func (tc *TLSConfig) serverTLS() (*tls.Config, error) {
+	if tc.SelfSigned {
+		_, err := os.Stat(tc.Cert)
+		if errors.Is(err, os.ErrNotExist) {
+			err = generateCert(tc.Cert, tc.Key)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate self signed certificate: %w", err)
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(tc.Cert, tc.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if tc.ClientCA != "" {
+		b, err := os.ReadFile(tc.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client CA: %w", err)
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in %s", tc.ClientCA)
+		}
+
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if tc.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, nil
+}
+
+// generateCert writes a self signed certificate, valid for the host name
+// and localhost, and its key
+func generateCert(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "ampserver"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	if hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = writeFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err == nil {
+		err = writeFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	}
+
+	if err == nil {
+		log.Printf("Generated self signed certificate %s with SHA-256 fingerprint %x", certFile, sha256.Sum256(der))
+	}
+	return err
+}
+
+// clientTLS returns the TLS settings the command line client uses to
+// talk to a server with a self signed certificate or that requires client
+// certificates.  It returns nil when none are set
+func clientTLS(caFile, certFile, keyFile string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		b, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// certSubject returns the subject of the verified client certificate, if
+// there is one
+func certSubject(state *tls.ConnectionState) (cn, dn string, found bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", "", false
+	}
+
+	subject := state.VerifiedChains[0][0].Subject
+	return subject.CommonName, subject.String(), true
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/abates/monoprice/api"
+)
+
+// testClientCert creates a CA and a client certificate signed by it,
+// returning the CA file and the client certificate
+func testClientCert(t *testing.T, dir, cn string) (string, tls.Certificate) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	ca, _ = x509.ParseCertificate(caDER)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, leaf, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	caFile := filepath.Join(dir, "ca.pem")
+	err = os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0644)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	return caFile, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	caFile, clientCert := testClientCert(t, dir, "kitchen-tablet")
+
+	tc := TLSConfig{
+		Cert:       filepath.Join(dir, "cert.pem"),
+		Key:        filepath.Join(dir, "key.pem"),
+		SelfSigned: true,
+		ClientCA:   caFile,
+	}
+
+	serverTLS, err := tc.serverTLS()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	// the client trusts the generated certificate directly
+	clientTLS, err := clientTLS(tc.Cert, "", "")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	keys := []KeyConfig{
+		{Name: "tablet", Subject: "kitchen-tablet", Scope: scopeRead},
+		{Name: "default", Key: "secret"},
+	}
+	router := api.New(testAmp(t))
+	router.Use(authMiddleware(defaultConfig(), keys, &nonceCache{}))
+
+	srv := httptest.NewUnstartedServer(router)
+	srv.TLS = serverTLS
+	srv.StartTLS()
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		key    string
+		cert   bool
+		method string
+		want   int
+	}{
+		{"No credentials", "", false, "GET", http.StatusUnauthorized},
+		{"Key", "secret", false, "GET", http.StatusOK},
+		{"Certificate", "", true, "GET", http.StatusOK},
+		{"Certificate scope", "", true, "PUT", http.StatusForbidden},
+		{"Bad key with certificate", "wrong", true, "GET", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := clientTLS.Clone()
+			if test.cert {
+				config.Certificates = []tls.Certificate{clientCert}
+			}
+			httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+
+			path := "/zones"
+			if test.method == "PUT" {
+				path = "/11/volume/10"
+			}
+
+			req, _ := http.NewRequest(test.method, srv.URL+path, nil)
+			if test.key != "" {
+				req.Header.Set("X-Auth-Key", test.key)
+			}
+
+			resp, err := httpClient.Do(req)
+			if err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != test.want {
+				t.Errorf("Wanted status %d got %d", test.want, resp.StatusCode)
+			}
+		})
+	}
+}
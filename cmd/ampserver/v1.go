@@ -0,0 +1,503 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/abates/monoprice"
+	"github.com/abates/monoprice/api"
+	"github.com/gorilla/mux"
+)
+
+// links are the paths of a resource and of the things that can be done
+// with it
+type links map[string]string
+
+// zoneResource is a zone in the v1 API.  When the zone can't be queried
+// State is left out and Error says why
+type zoneResource struct {
+	Amp   string           `json:"amp"`
+	ID    int              `json:"id"`
+	Name  string           `json:"name,omitempty"`
+	State *monoprice.State `json:"state,omitempty"`
+	Error *api.Error       `json:"error,omitempty"`
+	Links links            `json:"links"`
+}
+
+type groupResource struct {
+	Amp   string `json:"amp"`
+	Name  string `json:"name"`
+	Zones []int  `json:"zones"`
+	Links links  `json:"links"`
+}
+
+type sceneResource struct {
+	Name  string            `json:"name"`
+	Zones []monoprice.State `json:"zones"`
+	Links links             `json:"links"`
+}
+
+type sourceResource struct {
+	Amp  string `json:"amp"`
+	ID   int    `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+// zonePatch is the body of a PATCH to a zone or group.  Only the
+// attributes that are given are changed
+type zonePatch struct {
+	Power   *bool `json:"power"`
+	Mute    *bool `json:"mute"`
+	DND     *bool `json:"do_not_disturb"`
+	Source  *int  `json:"source"`
+	Volume  *int  `json:"volume"`
+	Treble  *int  `json:"treble"`
+	Bass    *int  `json:"bass"`
+	Balance *int  `json:"balance"`
+}
+
+type zoneCommand struct {
+	cmd monoprice.Command
+	arg interface{}
+}
+
+func boolArg(b bool) string {
+	if b {
+		return "01"
+	}
+	return "00"
+}
+
+// commands returns the commands for the patch in the same order
+// schedules use, so the zone is powered on before anything else changes
+func (zp *zonePatch) commands() []zoneCommand {
+	cmds := []zoneCommand{}
+	if zp.Power != nil {
+		cmds = append(cmds, zoneCommand{monoprice.SetPower, boolArg(*zp.Power)})
+	}
+
+	if zp.Mute != nil {
+		cmds = append(cmds, zoneCommand{monoprice.SetMute, boolArg(*zp.Mute)})
+	}
+
+	if zp.DND != nil {
+		cmds = append(cmds, zoneCommand{monoprice.SetDND, boolArg(*zp.DND)})
+	}
+
+	for _, attr := range []struct {
+		cmd   monoprice.Command
+		value *int
+	}{
+		{monoprice.SetSource, zp.Source},
+		{monoprice.SetVolume, zp.Volume},
+		{monoprice.SetTreble, zp.Treble},
+		{monoprice.SetBass, zp.Bass},
+		{monoprice.SetBalance, zp.Balance},
+	} {
+		if attr.value != nil {
+			cmds = append(cmds, zoneCommand{attr.cmd, *attr.value})
+		}
+	}
+	return cmds
+}
+
+func decodePatch(r *http.Request) (*zonePatch, error) {
+	patch := &zonePatch{}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(patch); err != nil {
+		return nil, fmt.Errorf("%w: %v", api.ErrInvalidArgument, err)
+	}
+	return patch, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(v)
+}
+
+// v1Routes registers the resource oriented API.  Zones on the default amp
+// are at /v1/zones/{zone} and zones on every amp are at
+// /v1/amps/{name}/zones/{zone}
+func (inst *instance) v1Routes(r *mux.Router) {
+	r.HandleFunc("/zones", inst.v1Zones).Methods("GET")
+	r.HandleFunc("/zones/{zone}", inst.v1Zone).Methods("GET")
+	r.HandleFunc("/zones/{zone}", inst.v1PatchZone).Methods("PATCH")
+	r.HandleFunc("/amps/{name}/zones", inst.v1Zones).Methods("GET")
+	r.HandleFunc("/amps/{name}/zones/{zone}", inst.v1Zone).Methods("GET")
+	r.HandleFunc("/amps/{name}/zones/{zone}", inst.v1PatchZone).Methods("PATCH")
+	r.HandleFunc("/groups", inst.v1Groups).Methods("GET")
+	r.HandleFunc("/groups/{group}", inst.v1Group).Methods("GET")
+	r.HandleFunc("/groups/{group}", inst.v1PatchGroup).Methods("PATCH")
+	r.HandleFunc("/scenes", inst.v1Scenes).Methods("GET")
+	r.HandleFunc("/scenes/{scene}", inst.v1Scene).Methods("GET")
+	r.HandleFunc("/scenes/{scene}/recall", inst.v1RecallScene).Methods("POST")
+	r.HandleFunc("/sources", inst.v1Sources).Methods("GET")
+}
+
+// zonePath is the v1 path of a zone
+func (cfg *Config) zonePath(amp string, id monoprice.ZoneID) string {
+	if amp == cfg.DefaultAmp {
+		return fmt.Sprintf("/v1/zones/%d", id)
+	}
+	return fmt.Sprintf("/v1/amps/%s/zones/%d", url.PathEscape(amp), id)
+}
+
+func (inst *instance) ampNames() []string {
+	names := []string{}
+	for name := range inst.amps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// zoneResource queries a zone's state
+func (inst *instance) zoneResource(amp string, zone monoprice.Zone) zoneResource {
+	zr := zoneResource{
+		Amp:   amp,
+		ID:    int(zone.ID()),
+		Name:  inst.cfg.zoneName(amp, zone.ID()),
+		Links: links{"self": inst.cfg.zonePath(amp, zone.ID())},
+	}
+
+	state, err := zone.State()
+	if err == nil {
+		zr.State = &state
+	} else {
+		code, _ := api.ErrorStatus(err)
+		zr.Error = &api.Error{Code: code, Message: err.Error()}
+	}
+	return zr
+}
+
+// apiZones wraps zones so the commands sent to them are audited as
+// coming from the request
+func (inst *instance) apiZones(r *http.Request, amp string, zones []monoprice.Zone) []monoprice.Zone {
+	return inst.audit.requestController(r, amp, &auditController{zones: zones}).Zones()
+}
+
+// findZone returns the zone a request is for
+func (inst *instance) findZone(r *http.Request) (string, monoprice.Zone, error) {
+	amp, str, _ := inst.cfg.requestZone(r)
+	conn, found := inst.amps[amp]
+	if !found {
+		return amp, nil, fmt.Errorf("%w: amp %q", api.ErrNotFound, amp)
+	}
+
+	id, err := strconv.Atoi(str)
+	if err != nil {
+		return amp, nil, fmt.Errorf("%w zone %q", api.ErrInvalidArgument, str)
+	}
+
+	for _, zone := range conn.amp.Zones() {
+		if zone.ID() == monoprice.ZoneID(id) {
+			return amp, zone, nil
+		}
+	}
+	return amp, nil, fmt.Errorf("%w %d", monoprice.ErrInvalidZone, id)
+}
+
+// allowsZones reports whether the key that made a request may use every
+// one of the zones
+func (inst *instance) allowsZones(r *http.Request, amp string, ids []int) bool {
+	key, limited := requestKey(r)
+	for _, id := range ids {
+		if limited && !inst.cfg.allowsZone(key, amp, monoprice.ZoneID(id)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (inst *instance) v1Zones(w http.ResponseWriter, r *http.Request) {
+	names := inst.ampNames()
+	if name, found := mux.Vars(r)["name"]; found {
+		if _, found := inst.amps[name]; !found {
+			api.WriteError(w, fmt.Errorf("%w: amp %q", api.ErrNotFound, name))
+			return
+		}
+		names = []string{name}
+	}
+
+	key, limited := requestKey(r)
+	zones := []zoneResource{}
+	for _, name := range names {
+		for _, zone := range inst.amps[name].amp.Zones() {
+			if !limited || inst.cfg.allowsZone(key, name, zone.ID()) {
+				zones = append(zones, inst.zoneResource(name, zone))
+			}
+		}
+	}
+	writeJSON(w, struct {
+		Zones []zoneResource `json:"zones"`
+	}{zones})
+}
+
+// writeZone writes a zone with the ETag of its state
+func writeZone(w http.ResponseWriter, zr zoneResource) {
+	if zr.State != nil {
+		w.Header().Set("ETag", api.ETag(*zr.State))
+	}
+	writeJSON(w, zr)
+}
+
+func (inst *instance) v1Zone(w http.ResponseWriter, r *http.Request) {
+	amp, zone, err := inst.findZone(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	writeZone(w, inst.zoneResource(amp, zone))
+}
+
+func (inst *instance) v1PatchZone(w http.ResponseWriter, r *http.Request) {
+	amp, zone, err := inst.findZone(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	patch, err := decodePatch(r)
+	if err != nil {
+		api.WriteZoneError(w, zone.ID(), err)
+		return
+	}
+
+	// with If-Match the whole patch is applied against the state the
+	// client last read, or not at all
+	err = api.SendIfMatch(r, inst.amps[amp].amp, zone.ID(), func(tx *monoprice.Tx) error {
+		for _, cmd := range patch.commands() {
+			err := tx.SendCommand(zone.ID(), cmd.cmd, cmd.arg)
+			inst.audit.recordRequest(r, amp, zone.ID(), cmd.cmd, cmd.arg, err)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		api.WriteZoneError(w, zone.ID(), err)
+		return
+	}
+	writeZone(w, inst.zoneResource(amp, zone))
+}
+
+func (inst *instance) groupResource(group GroupConfig) groupResource {
+	return groupResource{
+		Amp:   inst.cfg.ampName(group.Amp),
+		Name:  group.Name,
+		Zones: group.Zones,
+		Links: links{"self": "/v1/groups/" + url.PathEscape(group.Name)},
+	}
+}
+
+func (inst *instance) findGroup(r *http.Request) (GroupConfig, error) {
+	name := mux.Vars(r)["group"]
+	for _, group := range inst.cfg.Groups {
+		if group.Name == name {
+			return group, nil
+		}
+	}
+	return GroupConfig{}, fmt.Errorf("%w: group %q", api.ErrNotFound, name)
+}
+
+func (inst *instance) v1Groups(w http.ResponseWriter, r *http.Request) {
+	groups := []groupResource{}
+	for _, group := range inst.cfg.Groups {
+		if inst.allowsZones(r, inst.cfg.ampName(group.Amp), group.Zones) {
+			groups = append(groups, inst.groupResource(group))
+		}
+	}
+	writeJSON(w, struct {
+		Groups []groupResource `json:"groups"`
+	}{groups})
+}
+
+// v1Group returns a group.  The key must be allowed to use all of its
+// zones, the same as for listing and patching it
+func (inst *instance) v1Group(w http.ResponseWriter, r *http.Request) {
+	group, err := inst.findGroup(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	if !inst.allowsZones(r, inst.cfg.ampName(group.Amp), group.Zones) {
+		api.WriteErrorCode(w, http.StatusForbidden, "forbidden", "forbidden")
+		return
+	}
+	writeJSON(w, inst.groupResource(group))
+}
+
+// v1PatchGroup applies a patch to every zone in a group.  The key must be
+// allowed to use all of them
+func (inst *instance) v1PatchGroup(w http.ResponseWriter, r *http.Request) {
+	group, err := inst.findGroup(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	amp := inst.cfg.ampName(group.Amp)
+	if !inst.allowsZones(r, amp, group.Zones) {
+		api.WriteErrorCode(w, http.StatusForbidden, "forbidden", "forbidden")
+		return
+	}
+
+	patch, err := decodePatch(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	conn, found := inst.amps[amp]
+	if !found {
+		api.WriteError(w, fmt.Errorf("%w: amp %q", api.ErrNotFound, amp))
+		return
+	}
+
+	members := make(map[monoprice.ZoneID]bool)
+	for _, id := range group.Zones {
+		members[monoprice.ZoneID(id)] = true
+	}
+
+	for _, zone := range inst.apiZones(r, amp, conn.amp.Zones()) {
+		if !members[zone.ID()] {
+			continue
+		}
+
+		for _, cmd := range patch.commands() {
+			if err := zone.SendCommand(cmd.cmd, cmd.arg); err != nil {
+				api.WriteZoneError(w, zone.ID(), err)
+				return
+			}
+		}
+	}
+	writeJSON(w, inst.groupResource(group))
+}
+
+func newSceneResource(scene monoprice.Scene) sceneResource {
+	path := "/v1/scenes/" + url.PathEscape(scene.Name)
+	sr := sceneResource{
+		Name:  scene.Name,
+		Zones: scene.Zones,
+		Links: links{"self": path, "recall": path + "/recall"},
+	}
+
+	if sr.Zones == nil {
+		sr.Zones = []monoprice.State{}
+	}
+	return sr
+}
+
+// sceneZones returns the zones a scene sets
+func sceneZones(scene monoprice.Scene) []int {
+	ids := []int{}
+	for _, state := range scene.Zones {
+		ids = append(ids, state.Zone)
+	}
+	return ids
+}
+
+// v1Scenes lists the scenes whose zones the key may use.  Scenes are
+// recalled on the default amp
+func (inst *instance) v1Scenes(w http.ResponseWriter, r *http.Request) {
+	scenes, err := loadScenes(scenesFile)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	names := []string{}
+	for name := range scenes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := []sceneResource{}
+	for _, name := range names {
+		if inst.allowsZones(r, inst.cfg.DefaultAmp, sceneZones(scenes[name])) {
+			list = append(list, newSceneResource(scenes[name]))
+		}
+	}
+	writeJSON(w, struct {
+		Scenes []sceneResource `json:"scenes"`
+	}{list})
+}
+
+func findScene(r *http.Request) (monoprice.Scene, error) {
+	scenes, err := loadScenes(scenesFile)
+	if err != nil {
+		return monoprice.Scene{}, err
+	}
+
+	name := mux.Vars(r)["scene"]
+	scene, found := scenes[name]
+	if !found {
+		return scene, fmt.Errorf("%w: scene %q", api.ErrNotFound, name)
+	}
+	return scene, nil
+}
+
+func (inst *instance) v1Scene(w http.ResponseWriter, r *http.Request) {
+	scene, err := findScene(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	if !inst.allowsZones(r, inst.cfg.DefaultAmp, sceneZones(scene)) {
+		api.WriteErrorCode(w, http.StatusForbidden, "forbidden", "forbidden")
+		return
+	}
+	writeJSON(w, newSceneResource(scene))
+}
+
+// v1RecallScene recalls a scene on the default amp, which is where
+// scenes are recalled by schedules and the scene command
+func (inst *instance) v1RecallScene(w http.ResponseWriter, r *http.Request) {
+	scene, err := findScene(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+
+	amp := inst.cfg.DefaultAmp
+	if !inst.allowsZones(r, amp, sceneZones(scene)) {
+		api.WriteErrorCode(w, http.StatusForbidden, "forbidden", "forbidden")
+		return
+	}
+
+	conn, found := inst.amps[amp]
+	if !found {
+		api.WriteError(w, fmt.Errorf("%w: amp %q", api.ErrNotFound, amp))
+		return
+	}
+
+	if err := scene.Recall(inst.apiZones(r, amp, conn.amp.Zones())); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	writeJSON(w, newSceneResource(scene))
+}
+
+// v1Sources lists the sources of every amp, named from the sources
+// section of the configuration
+func (inst *instance) v1Sources(w http.ResponseWriter, r *http.Request) {
+	sources := []sourceResource{}
+	for _, amp := range inst.ampNames() {
+		for id := 1; id <= monoprice.MaxSource; id++ {
+			sources = append(sources, sourceResource{Amp: amp, ID: id, Name: inst.cfg.sourceName(amp, id)})
+		}
+	}
+	writeJSON(w, struct {
+		Sources []sourceResource `json:"sources"`
+	}{sources})
+}
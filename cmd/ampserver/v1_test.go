@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abates/monoprice"
+	"github.com/abates/monoprice/internal/fakeamp"
+)
+
+func TestV1API(t *testing.T) {
+	dir := t.TempDir()
+	scenesFile = filepath.Join(dir, "scenes.json")
+	defer func() { scenesFile = "scenes.json" }()
+	os.WriteFile(scenesFile, []byte(`[{"name":"quiet","zones":[{"zone":12,"volume":5,"source":2}]}]`), 0600)
+
+	input := "zones:\n  - {id: 11, name: Kitchen}\nsources:\n  - {id: 2, name: Radio}\ngroups:\n  - {name: downstairs, zones: [11, 12]}\n" +
+		"auth:\n  keys:\n    - {name: all, key: all}\n    - {name: kitchen, key: kitchen, zones: [11]}\n    - {name: reader, key: reader, scope: read}\n" +
+		"audit:\n  file: " + filepath.Join(dir, "audit.log") + "\n"
+	cfg, err := parseConfig("test.yaml", []byte(input))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	serial := fakeamp.New(11, 12)
+	amp, err := monoprice.New(serial)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	conn := &ampConn{transport: cfg.Amps[0].Transport, amp: amp}
+	prev := &instance{cfg: cfg, amps: map[string]*ampConn{cfg.DefaultAmp: conn}}
+	inst, err := (&ampServer{}).build(cfg, prev)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer inst.audit.Close()
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		key      string
+		body     string
+		want     int
+		wantBody string
+	}{
+		{"Zones", "GET", "/v1/zones", "all", "", http.StatusOK, `{"amp":"default","id":11,"name":"Kitchen","state":{"zone":11,`},
+		{"Zone links", "GET", "/v1/zones", "all", "", http.StatusOK, `"links":{"self":"/v1/zones/12"}`},
+		{"Zones limited", "GET", "/v1/zones", "kitchen", "", http.StatusOK, `"links":{"self":"/v1/zones/11"}}]}`},
+		{"Amp zones", "GET", "/v1/amps/default/zones/11", "all", "", http.StatusOK, `"name":"Kitchen"`},
+		{"Unknown amp", "GET", "/v1/amps/pool/zones", "all", "", http.StatusNotFound, `"code":"not_found"`},
+		{"Unknown zone", "GET", "/v1/zones/13", "all", "", http.StatusNotFound, `"code":"invalid_zone"`},
+		{"Patch", "PATCH", "/v1/zones/11", "all", `{"power":true,"volume":20}`, http.StatusOK, `"power":true,"mute":false,"do_not_disturb":false,"volume":20`},
+		{"Patch DND", "PATCH", "/v1/zones/11", "all", `{"do_not_disturb":true}`, http.StatusOK, `"mute":false,"do_not_disturb":true`},
+		{"Patch DND off", "PATCH", "/v1/zones/11", "all", `{"do_not_disturb":false}`, http.StatusOK, `"mute":false,"do_not_disturb":false`},
+		{"Patch unknown field", "PATCH", "/v1/zones/11", "all", `{"colour":"red"}`, http.StatusBadRequest, `"code":"invalid_argument"`},
+		{"Patch read scope", "PATCH", "/v1/zones/11", "reader", `{"power":true}`, http.StatusForbidden, `"code":"forbidden"`},
+		{"Patch other zone", "PATCH", "/v1/zones/12", "kitchen", `{"power":true}`, http.StatusForbidden, ""},
+		{"Volume up", "POST", "/12/volume/up?step=30", "all", "", http.StatusOK, `"volume":38`},
+		{"Balance down", "POST", "/12/balance/down", "all", "", http.StatusOK, `"balance":9`},
+		{"Power toggle", "POST", "/12/power/toggle", "all", "", http.StatusOK, `"power":true`},
+		{"Invalid step", "POST", "/12/volume/up?step=-1", "all", "", http.StatusBadRequest, `"code":"invalid_argument"`},
+		{"Toggle read scope", "POST", "/12/mute/toggle", "reader", "", http.StatusForbidden, ""},
+		{"Groups", "GET", "/v1/groups", "all", "", http.StatusOK, `{"groups":[{"amp":"default","name":"downstairs","zones":[11,12],"links":{"self":"/v1/groups/downstairs"}}]}`},
+		{"Groups limited", "GET", "/v1/groups", "kitchen", "", http.StatusOK, `{"groups":[]}`},
+		{"Patch group", "PATCH", "/v1/groups/downstairs", "all", `{"mute":true}`, http.StatusOK, `"name":"downstairs"`},
+		{"Patch group limited", "PATCH", "/v1/groups/downstairs", "kitchen", `{"mute":true}`, http.StatusForbidden, ""},
+		{"Group", "GET", "/v1/groups/downstairs", "all", "", http.StatusOK, `"zones":[11,12]`},
+		{"Group limited", "GET", "/v1/groups/downstairs", "kitchen", "", http.StatusForbidden, `"code":"forbidden"`},
+		{"Unknown group", "GET", "/v1/groups/upstairs", "all", "", http.StatusNotFound, `"code":"not_found"`},
+		{"Scenes", "GET", "/v1/scenes", "all", "", http.StatusOK, `"links":{"recall":"/v1/scenes/quiet/recall","self":"/v1/scenes/quiet"}`},
+		{"Scenes limited", "GET", "/v1/scenes", "kitchen", "", http.StatusOK, `{"scenes":[]}`},
+		{"Scene", "GET", "/v1/scenes/quiet", "all", "", http.StatusOK, `"name":"quiet"`},
+		{"Scene limited", "GET", "/v1/scenes/quiet", "kitchen", "", http.StatusForbidden, `"code":"forbidden"`},
+		{"Recall", "POST", "/v1/scenes/quiet/recall", "all", "", http.StatusOK, `"name":"quiet"`},
+		{"Recall limited", "POST", "/v1/scenes/quiet/recall", "kitchen", "", http.StatusForbidden, ""},
+		{"Unknown scene", "POST", "/v1/scenes/loud/recall", "all", "", http.StatusNotFound, `"code":"not_found"`},
+		{"Sources", "GET", "/v1/sources", "all", "", http.StatusOK, `{"amp":"default","id":1},{"amp":"default","id":2,"name":"Radio"}`},
+		{"Last source", "GET", "/v1/sources", "all", "", http.StatusOK, `{"amp":"default","id":6}]}`},
+		{"Legacy", "GET", "/11/status", "all", "", http.StatusOK, `"zone":11`},
+		{"Bulk status", "GET", "/zones/status", "all", "", http.StatusOK, `,"12":{"zone":12,`},
+		{"Bulk status limited", "GET", "/amps/default/zones/status", "kitchen", "", http.StatusOK, `{"11":{"zone":11,"pa":false,"power":true,"mute":true,"do_not_disturb":false,"volume":20,"treble":7,"bass":7,"balance":10,"source":1,"keypad":false}}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+			req.Header.Set("X-Auth-Key", test.key)
+			w := httptest.NewRecorder()
+			inst.handler.ServeHTTP(w, req)
+
+			if w.Code != test.want {
+				t.Errorf("Wanted status %d got %d (%s)", test.want, w.Code, w.Body.String())
+			} else if !strings.Contains(w.Body.String(), test.wantBody) {
+				t.Errorf("Wanted body containing %q got %q", test.wantBody, w.Body.String())
+			}
+		})
+	}
+
+	if state := serial.State(11); !state.Mute || !state.Power || state.Volume != 20 {
+		t.Errorf("Wanted zone 11 patched and muted by the group got %+v", state)
+	}
+
+	// recalling the scene restores the whole state, including mute
+	if state := serial.State(12); state.Mute || state.Volume != 5 || state.Source != 2 {
+		t.Errorf("Wanted zone 12 set by the scene got %+v", state)
+	}
+
+	// a write with the ETag just read succeeds, and the same ETag is then
+	// stale for the next write
+	for i, path := range []string{"/v1/zones/11", "/11/status"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-Auth-Key", "all")
+		w := httptest.NewRecorder()
+		inst.handler.ServeHTTP(w, req)
+		etag := w.Header().Get("ETag")
+		if etag == "" {
+			t.Fatalf("Wanted an ETag from %s got none", path)
+		}
+
+		writes := []struct {
+			method string
+			path   string
+			body   string
+			want   int
+		}{
+			{"PATCH", "/v1/zones/11", fmt.Sprintf(`{"volume":%d}`, 21+i), http.StatusOK},
+			{"PUT", "/11/volume/22", "", http.StatusPreconditionFailed},
+			{"PATCH", "/v1/zones/11", `{"volume":23}`, http.StatusPreconditionFailed},
+		}
+
+		for _, write := range writes {
+			req := httptest.NewRequest(write.method, write.path, strings.NewReader(write.body))
+			req.Header.Set("X-Auth-Key", "all")
+			req.Header.Set("If-Match", etag)
+			w := httptest.NewRecorder()
+			inst.handler.ServeHTTP(w, req)
+			if w.Code != write.want {
+				t.Errorf("%s %s: Wanted status %d got %d (%s)", write.method, write.path, write.want, w.Code, w.Body.String())
+			}
+		}
+	}
+
+	if volume := serial.State(11).Volume; volume != 22 {
+		t.Errorf("Wanted stale writes rejected got volume %d", volume)
+	}
+
+	entries, err := inst.audit.query(cfg.DefaultAmp, 11, time.Time{})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if len(entries) == 0 || entries[0].Key != "all" || entries[0].Origin != originAPI || entries[0].Command != "power" {
+		t.Errorf("Wanted the patch audited with its key got %+v", entries)
+	}
+}
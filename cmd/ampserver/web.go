@@ -0,0 +1,108 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+// webConfig is the configuration of the web integration, which serves a
+// control panel for every zone
+type webConfig struct {
+	Path  string `yaml:"path"`
+	Title string `yaml:"title"`
+}
+
+func init() {
+	integrations["web"] = integration{validate: validateWeb, setup: setupWeb}
+}
+
+func decodeWeb(node *yaml.Node) (webConfig, error) {
+	wc := webConfig{Path: "/ui", Title: "Amplifier"}
+	err := decodeStrict(node, &wc)
+	wc.Path = "/" + strings.Trim(wc.Path, "/")
+	return wc, err
+}
+
+func validateWeb(node *yaml.Node) error {
+	wc, err := decodeWeb(node)
+	if err == nil && wc.Path == "/" {
+		err = errors.New("path can't be /")
+	}
+	return err
+}
+
+// webZone describes a zone to the web UI
+type webZone struct {
+	Amp  string `json:"amp"`
+	ID   int    `json:"id"`
+	Name string `json:"name,omitempty"`
+	// Path is the API path for the zone's routes
+	Path string `json:"path"`
+}
+
+type webInfo struct {
+	Title string    `json:"title"`
+	Zones []webZone `json:"zones"`
+}
+
+// setupWeb serves the control panel's files, which don't need a key, and
+// the list of zones the UI shows.  The UI asks for a key, which can also
+// be given in the page's URL as #key=..., and uses it for the API calls
+// and the /events stream
+func setupWeb(inst *instance, router *mux.Router, node *yaml.Node) error {
+	wc, err := decodeWeb(node)
+	if err != nil {
+		return err
+	}
+
+	files, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		return err
+	}
+
+	router.HandleFunc(wc.Path+"/zones.json", func(w http.ResponseWriter, r *http.Request) {
+		key, limited := requestKey(r)
+		info := webInfo{Title: wc.Title, Zones: []webZone{}}
+
+		names := []string{}
+		for name := range inst.amps {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			for _, zone := range inst.amps[name].amp.Zones() {
+				if limited && !inst.cfg.allowsZone(key, name, zone.ID()) {
+					continue
+				}
+
+				info.Zones = append(info.Zones, webZone{
+					Amp:  name,
+					ID:   int(zone.ID()),
+					Name: inst.cfg.zoneName(name, zone.ID()),
+					Path: "/amps/" + name + "/zones/" + strconv.Itoa(int(zone.ID())),
+				})
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(info)
+	}).Methods("GET")
+
+	router.Handle(wc.Path, http.RedirectHandler(wc.Path+"/", http.StatusMovedPermanently)).Methods("GET").Name("public.web")
+	router.PathPrefix(wc.Path + "/").Handler(http.StripPrefix(wc.Path+"/", http.FileServer(http.FS(files)))).Methods("GET").Name("public.web.files")
+	return nil
+}
@@ -0,0 +1,171 @@
+"use strict";
+
+// The UI is served from <path>/ and the API from the server's root
+const base = location.pathname.replace(/\/[^/]*$/, "");
+const zones = new Map();
+let key = localStorage.getItem("ampserver.key") || "";
+
+function zoneKey(amp, id) {
+  return amp + ":" + id;
+}
+
+function setStatus(text, ok) {
+  const status = document.getElementById("status");
+  status.textContent = text;
+  status.classList.toggle("ok", ok);
+}
+
+async function api(method, path) {
+  const resp = await fetch(path, {method: method, headers: {"X-Auth-Key": key}});
+  if (resp.status === 401) {
+    showLogin("That key was not accepted");
+    throw new Error("not authorized");
+  } else if (!resp.ok) {
+    const body = await resp.json().catch(() => null);
+    throw new Error((body && body.error && body.error.message) || resp.statusText);
+  }
+  return resp;
+}
+
+function showLogin(message) {
+  document.getElementById("login").hidden = false;
+  document.getElementById("login-error").textContent = message || "";
+  setStatus("disconnected", false);
+}
+
+function render(zone, state) {
+  const el = zone.element;
+  for (const input of el.querySelectorAll("[data-attr]")) {
+    // don't move a control out from under the user
+    if (input === document.activeElement && input.type === "range") {
+      continue;
+    }
+
+    const attr = input.dataset.attr;
+    if (input.type === "checkbox") {
+      input.checked = state[attr];
+    } else {
+      input.value = state[attr];
+    }
+  }
+
+  for (const output of el.querySelectorAll("output")) {
+    output.textContent = state[output.dataset.for];
+  }
+  el.classList.toggle("off", !state.power);
+}
+
+async function send(zone, attr, value) {
+  const error = zone.element.querySelector(".error");
+  try {
+    await api("PUT", zone.path + "/" + attr + "/" + value);
+    error.textContent = "";
+  } catch (err) {
+    error.textContent = err.message;
+  }
+}
+
+function addZone(info) {
+  const el = document.getElementById("zone-template").content.firstElementChild.cloneNode(true);
+  el.querySelector(".name").textContent = info.name || "Zone " + info.id;
+  const zone = {path: info.path, element: el};
+
+  for (const input of el.querySelectorAll("[data-attr]")) {
+    const attr = input.dataset.attr;
+    input.addEventListener("change", () => {
+      send(zone, attr, input.type === "checkbox" ? input.checked : input.value);
+    });
+
+    if (input.type === "range") {
+      input.addEventListener("input", () => {
+        el.querySelector("output[data-for=" + attr + "]").textContent = input.value;
+      });
+    }
+  }
+
+  zones.set(zoneKey(info.amp, info.id), zone);
+  document.getElementById("zones").appendChild(el);
+}
+
+// events reads the server-sent event stream.  EventSource can't send the
+// key header, so the stream is read with fetch instead
+async function events() {
+  const resp = await api("GET", "/events");
+  setStatus("live", true);
+
+  const reader = resp.body.pipeThrough(new TextDecoderStream()).getReader();
+  let buffer = "";
+  for (;;) {
+    const {value, done} = await reader.read();
+    if (done) {
+      break;
+    }
+
+    buffer += value;
+    let end;
+    while ((end = buffer.indexOf("\n\n")) >= 0) {
+      const message = buffer.slice(0, end);
+      buffer = buffer.slice(end + 2);
+
+      const data = message.split("\n").filter((line) => line.startsWith("data: ")).map((line) => line.slice(6)).join("\n");
+      if (data) {
+        const event = JSON.parse(data);
+        const zone = zones.get(zoneKey(event.amp, event.zone));
+        if (zone) {
+          render(zone, event.state);
+        }
+      }
+    }
+  }
+}
+
+async function run() {
+  if (!key) {
+    showLogin();
+    return;
+  }
+
+  document.getElementById("login").hidden = true;
+  try {
+    const info = await (await api("GET", base + "/zones.json")).json();
+    document.title = info.title;
+    document.getElementById("title").textContent = info.title;
+    document.getElementById("zones").replaceChildren();
+    zones.clear();
+    info.zones.forEach(addZone);
+  } catch (err) {
+    setStatus(err.message, false);
+    return;
+  }
+
+  // the stream ends when the server reloads its configuration, so keep
+  // reconnecting
+  for (;;) {
+    try {
+      await events();
+    } catch (err) {
+      if (err.message === "not authorized") {
+        return;
+      }
+    }
+    setStatus("reconnecting", false);
+    await new Promise((resolve) => setTimeout(resolve, 2000));
+  }
+}
+
+document.getElementById("login").addEventListener("submit", (e) => {
+  e.preventDefault();
+  key = document.getElementById("key").value;
+  localStorage.setItem("ampserver.key", key);
+  run();
+});
+
+// a link such as /ui/#key=... logs a guest in without typing the key
+const match = location.hash.match(/key=([^&]+)/);
+if (match) {
+  key = decodeURIComponent(match[1]);
+  localStorage.setItem("ampserver.key", key);
+  history.replaceState(null, "", location.pathname);
+}
+
+run();
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abates/monoprice"
+)
+
+type fakeZone struct {
+	id    monoprice.ZoneID
+	state monoprice.State
+}
+
+func (fz *fakeZone) ID() monoprice.ZoneID                                     { return fz.id }
+func (fz *fakeZone) State() (monoprice.State, error)                          { return fz.state, nil }
+func (fz *fakeZone) SendCommand(cmd monoprice.Command, arg interface{}) error { return nil }
+
+func TestWebIntegration(t *testing.T) {
+	cfg, err := parseConfig("test.yaml", []byte("zones:\n  - id: 11\n    name: Kitchen\nauth:\n  keys:\n    - name: kitchen\n      key: secret\n      zones: [11]\nintegrations:\n  web:\n    title: House\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	kitchen := &fakeZone{id: 11, state: monoprice.State{Zone: 11, Volume: 10}}
+	conn := &ampConn{transport: cfg.Amps[0].Transport, amp: testAmp(t)}
+	monitor := monoprice.NewMonitor([]monoprice.Zone{kitchen, &fakeZone{id: 12}}, time.Hour)
+	conn.monitor.Store(monitor)
+	monitor.Poll()
+	prev := &instance{cfg: cfg, amps: map[string]*ampConn{cfg.DefaultAmp: conn}}
+
+	s := &ampServer{}
+	inst, err := s.build(cfg, prev)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	srv := httptest.NewServer(inst.handler)
+	defer srv.Close()
+
+	get := func(path, key string) *http.Response {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		if key != "" {
+			req.Header.Set("X-Auth-Key", key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		return resp
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		key      string
+		want     int
+		wantBody string
+	}{
+		{"Page", "/ui/", "", http.StatusOK, "<title>Amplifier</title>"},
+		{"Script", "/ui/app.js", "", http.StatusOK, "events"},
+		{"Zones without key", "/ui/zones.json", "", http.StatusUnauthorized, ""},
+		{"Zones", "/ui/zones.json", "secret", http.StatusOK, `{"title":"House","zones":[{"amp":"default","id":11,"name":"Kitchen","path":"/amps/default/zones/11"}]}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := get(test.path, test.key)
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != test.want {
+				t.Errorf("Wanted status %d got %d", test.want, resp.StatusCode)
+			} else if !strings.Contains(string(b), test.wantBody) {
+				t.Errorf("Wanted body containing %q got %q", test.wantBody, b)
+			}
+		})
+	}
+
+	resp := get("/events", "secret")
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Wanted content type text/event-stream got %q", ct)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	next := func() zoneEvent {
+		event := zoneEvent{}
+		for scanner.Scan() {
+			if line := scanner.Text(); strings.HasPrefix(line, "data: ") {
+				if err := json.Unmarshal([]byte(line[6:]), &event); err != nil {
+					t.Fatalf("Unexpected error %v", err)
+				}
+				return event
+			}
+		}
+		t.Fatalf("Event stream ended: %v", scanner.Err())
+		return event
+	}
+
+	// zone 12 isn't sent since the key is limited to zone 11
+	if event := next(); event.Zone != 11 || event.Name != "Kitchen" || event.State.Volume != 10 {
+		t.Errorf("Wanted the initial state of zone 11 got %+v", event)
+	}
+
+	kitchen.state.Volume = 20
+	monitor.Poll()
+	if event := next(); event.Zone != 11 || event.State.Volume != 20 {
+		t.Errorf("Wanted volume 20 for zone 11 got %+v", event)
+	}
+
+	// a reload retires the instance, which ends the stream
+	close(inst.retired)
+	ended := make(chan struct{})
+	go func() {
+		for scanner.Scan() {
+		}
+		close(ended)
+	}()
+
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Wanted the stream to end when the instance was retired")
+	}
+}
@@ -12,13 +12,15 @@ type cmdResp struct {
 }
 
 func (cr *cmdResp) Unmarshal(line string) (err error) {
-	if len(line) < 2 {
-		return ErrInvalidResponse
+	// every response has at least a two digit zone and a two character
+	// command or state field
+	if len(line) < 4 {
+		return fmt.Errorf("%w %q is too short", ErrInvalidResponse, line)
 	}
 
 	zone, err := strconv.Atoi(line[0:2])
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %w", ErrInvalidResponse, err)
 	}
 	cr.zone = ZoneID(zone)
 	line = line[2:]
@@ -34,8 +36,30 @@ func (cr *cmdResp) Unmarshal(line string) (err error) {
 
 type Command string
 
-func (c Command) format(v interface{}) string {
-	return fmt.Sprintf(commands[c], v)
+// format returns the argument as it is sent to the amplifier.  The on/off
+// commands take the strings "00" and "01" or the numbers 0 and 1, and the
+// other commands take a number.  Any other argument is an ErrCommand
+// rather than a malformed line on the serial port
+func (c Command) format(v interface{}) (string, error) {
+	verb := commands[c]
+	switch arg := v.(type) {
+	case int:
+		if verb == "%02d" || (verb == "%s" && (arg == 0 || arg == 1)) {
+			return fmt.Sprintf("%02d", arg), nil
+		}
+	case string:
+		if verb == "%s" && (arg == "00" || arg == "01") {
+			return arg, nil
+		}
+	}
+
+	switch verb {
+	case "":
+		return "", nil
+	case "%s":
+		return "", fmt.Errorf("%w %s value %#v, must be \"00\" or \"01\"", ErrCommand, c, v)
+	}
+	return "", fmt.Errorf("%w %s value %#v, must be a number", ErrCommand, c, v)
 }
 
 var (
@@ -55,7 +79,7 @@ var (
 		PA:              "",
 		SetPower:        "%s",
 		SetMute:         "%s",
-		SetDND:          "%02d",
+		SetDND:          "%s",
 		SetVolume:       "%02d",
 		SetTreble:       "%02d",
 		SetBass:         "%02d",
@@ -65,3 +89,55 @@ var (
 		ST:              "",
 	}
 )
+
+// Hardware limits for the level commands, the lowest level is always 0
+const (
+	MaxVolume  = 38
+	MaxTone    = 14
+	MaxBalance = 20
+)
+
+// MaxSource is the highest source number, sources are numbered from 1
+const MaxSource = 6
+
+// levels maps each level command to its maximum and the State field
+// holding its current value
+var levels = map[Command]struct {
+	max   int
+	field func(*State) *int
+}{
+	SetVolume:  {MaxVolume, func(s *State) *int { return &s.Volume }},
+	SetTreble:  {MaxTone, func(s *State) *int { return &s.Treble }},
+	SetBass:    {MaxTone, func(s *State) *int { return &s.Bass }},
+	SetBalance: {MaxBalance, func(s *State) *int { return &s.Balance }},
+}
+
+// Range returns the lowest and highest values the command accepts.  ok is
+// false for commands that don't take a number
+func (c Command) Range() (lo, hi int, ok bool) {
+	if level, found := levels[c]; found {
+		return 0, level.max, true
+	}
+	if c == SetSource {
+		return 1, MaxSource, true
+	}
+	return 0, 0, false
+}
+
+// CheckRange returns an error if arg is a number outside the command's
+// Range.  SendCommand checks this before anything is sent
+func (c Command) CheckRange(arg interface{}) error {
+	n, isInt := arg.(int)
+	lo, hi, ok := c.Range()
+	if isInt && ok && (n < lo || n > hi) {
+		return fmt.Errorf("%w %s value %d, must be from %d to %d", ErrCommand, c, n, lo, hi)
+	}
+	return nil
+}
+
+// toggles maps each on/off command to the State field holding its
+// current value
+var toggles = map[Command]func(*State) *bool{
+	SetPower: func(s *State) *bool { return &s.Power },
+	SetMute:  func(s *State) *bool { return &s.Mute },
+}
@@ -0,0 +1,109 @@
+package monoprice
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func FuzzStateUnmarshal(f *testing.F) {
+	f.Add("1100010000131112100401")
+	f.Add("110001000010111210040")
+	f.Add("11000100dfsf112100401")
+	f.Add("")
+	f.Fuzz(func(t *testing.T, input string) {
+		state := State{}
+		err := state.Unmarshal(input)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidResponse) {
+				t.Fatalf("Wanted %v got %v", ErrInvalidResponse, err)
+			}
+			return
+		}
+
+		str, _ := state.Marshal()
+		got := State{}
+		if err := got.Unmarshal(str); err != nil {
+			t.Fatalf("Failed to unmarshal %q (marshaled from %q): %v", str, input, err)
+		} else if got != state {
+			t.Fatalf("Wanted %+v got %+v", state, got)
+		}
+	})
+}
+
+func FuzzCmdRespUnmarshal(f *testing.F) {
+	f.Add("11VO20")
+	f.Add("1100010000131112100401")
+	f.Add("11P")
+	f.Add("1")
+	f.Fuzz(func(t *testing.T, input string) {
+		cr := cmdResp{}
+		if err := cr.Unmarshal(input); err != nil && !errors.Is(err, ErrInvalidResponse) {
+			t.Fatalf("Wanted %v got %v", ErrInvalidResponse, err)
+		}
+	})
+}
+
+func FuzzIntUnmarshaler(f *testing.F) {
+	f.Add("01")
+	f.Add("foo")
+	f.Fuzz(func(t *testing.T, input string) {
+		v := 0
+		if err := intUnmarshaler(&v)(input); err != nil && !errors.Is(err, ErrInvalidResponse) {
+			t.Fatalf("Wanted %v got %v", ErrInvalidResponse, err)
+		}
+	})
+}
+
+func FuzzBoolUnmarshaler(f *testing.F) {
+	f.Add("01")
+	f.Add("00")
+	f.Add("")
+	f.Fuzz(func(t *testing.T, input string) {
+		v := false
+		if err := boolUnmarshaler(&v)(input); err != nil && !errors.Is(err, ErrInvalidResponse) {
+			t.Fatalf("Wanted %v got %v", ErrInvalidResponse, err)
+		}
+	})
+}
+
+func FuzzParseLine(f *testing.F) {
+	f.Add(">1100000000130705100301")
+	f.Add("<11VO20")
+	f.Add(">11")
+	f.Fuzz(func(t *testing.T, input string) {
+		if got := ParseLine(input); got.Raw != input {
+			t.Fatalf("Wanted raw %q got %q", input, got.Raw)
+		}
+	})
+}
+
+func FuzzQueryResponse(f *testing.F) {
+	f.Add("?11\r#>1100000000130705100301\r#")
+	f.Add("?11\r##")
+	f.Add("?11\r#>11#")
+	f.Fuzz(func(t *testing.T, input string) {
+		resp := QueryResponse{}
+		err := resp.Read(testReader{bufio.NewReader(strings.NewReader(input))})
+		if err != nil && !errors.Is(err, ErrInvalidResponse) && !errors.Is(err, ErrInvalidZone) && !errors.Is(err, io.EOF) {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	})
+}
+
+func FuzzAmplifierQueryState(f *testing.F) {
+	f.Add("?11\r\n#>1100000000130705100301\r\r\n#")
+	f.Add("?11\r\n#>11\r\r\n#")
+	f.Fuzz(func(t *testing.T, input string) {
+		amp := Amplifier{
+			reader: bufio.NewReader(strings.NewReader(input)),
+			writer: io.Discard,
+		}
+		_, err := amp.QueryState(11)
+		if err != nil && !errors.Is(err, ErrInvalidResponse) && !errors.Is(err, ErrInvalidZone) && !errors.Is(err, io.EOF) {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	})
+}
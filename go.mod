@@ -1,9 +1,18 @@
 module github.com/abates/monoprice
 
-go 1.14
+go 1.21
 
 require (
+	github.com/chzyer/readline v1.5.1
 	github.com/gorilla/mux v1.7.4
+	github.com/hashicorp/mdns v1.0.5
+	github.com/miekg/dns v1.1.41
 	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07
-	golang.org/x/sys v0.0.0-20200620081246-981b61492c35 // indirect
+	golang.org/x/crypto v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/sys v0.18.0 // indirect
 )
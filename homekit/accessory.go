@@ -0,0 +1,279 @@
+package homekit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Service and characteristic types, in the short form of Apple's UUIDs
+const (
+	typeAccessoryInformation = "3E"
+	typeProtocolInformation  = "A2"
+	typeTelevision           = "D8"
+	typeInputSource          = "D9"
+	typeTelevisionSpeaker    = "113"
+
+	typeIdentify               = "14"
+	typeManufacturer           = "20"
+	typeModel                  = "21"
+	typeName                   = "23"
+	typeSerialNumber           = "30"
+	typeVersion                = "37"
+	typeFirmwareRevision       = "52"
+	typeActive                 = "B0"
+	typeIsConfigured           = "D6"
+	typeInputSourceType        = "DB"
+	typeConfiguredName         = "E3"
+	typeIdentifier             = "E6"
+	typeActiveIdentifier       = "E7"
+	typeSleepDiscoveryMode     = "E8"
+	typeVolumeControlType      = "E9"
+	typeVolumeSelector         = "EA"
+	typeMute                   = "11A"
+	typeVolume                 = "119"
+	typeCurrentVisibilityState = "135"
+)
+
+// Characteristic permissions
+const (
+	permRead   = "pr"
+	permWrite  = "pw"
+	permEvents = "ev"
+)
+
+// Characteristic formats
+const (
+	formatBool   = "bool"
+	formatUint8  = "uint8"
+	formatUint32 = "uint32"
+	formatString = "string"
+)
+
+var errInvalidValue = errors.New("invalid value")
+
+// characteristic is a value of a service.  Values come from get, or are
+// fixed when get is nil, and writes are handed to set
+type characteristic struct {
+	iid    uint64
+	typ    string
+	format string
+	perms  []string
+	unit   string
+	min    *float64
+	max    *float64
+	step   *float64
+	valid  []int
+	value  interface{}
+
+	get func() (interface{}, error)
+	set func(value interface{}) error
+}
+
+func (c *characteristic) can(perm string) bool {
+	for _, p := range c.perms {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *characteristic) read() (interface{}, error) {
+	if c.get != nil {
+		return c.get()
+	}
+	return c.value, nil
+}
+
+// convert checks a value written by a controller against the
+// characteristic's format and range.  Controllers send booleans as
+// either true/false or 1/0, and sometimes send true/false for integers
+func (c *characteristic) convert(value interface{}) (interface{}, error) {
+	switch c.format {
+	case formatBool:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case float64:
+			if v == 0 || v == 1 {
+				return v == 1, nil
+			}
+		}
+	case formatString:
+		if s, ok := value.(string); ok && len(s) <= 64 {
+			return s, nil
+		}
+	default:
+		if b, ok := value.(bool); ok {
+			value = 0.0
+			if b {
+				value = 1.0
+			}
+		}
+
+		v, ok := value.(float64)
+		if !ok || v != math.Trunc(v) || v < 0 ||
+			(c.min != nil && v < *c.min) || (c.max != nil && v > *c.max) {
+			break
+		}
+
+		if len(c.valid) == 0 {
+			return int(v), nil
+		}
+
+		for _, valid := range c.valid {
+			if valid == int(v) {
+				return valid, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w %v for %s", errInvalidValue, value, c.format)
+}
+
+// characteristicJSON is how a characteristic is described in the
+// accessory database
+type characteristicJSON struct {
+	IID    uint64      `json:"iid"`
+	Type   string      `json:"type"`
+	Format string      `json:"format"`
+	Perms  []string    `json:"perms"`
+	Value  interface{} `json:"value,omitempty"`
+	Unit   string      `json:"unit,omitempty"`
+	Min    *float64    `json:"minValue,omitempty"`
+	Max    *float64    `json:"maxValue,omitempty"`
+	Step   *float64    `json:"minStep,omitempty"`
+	Valid  []int       `json:"valid-values,omitempty"`
+}
+
+func (c *characteristic) describe(withValue bool) characteristicJSON {
+	cj := characteristicJSON{
+		IID:    c.iid,
+		Type:   c.typ,
+		Format: c.format,
+		Perms:  c.perms,
+		Unit:   c.unit,
+		Min:    c.min,
+		Max:    c.max,
+		Step:   c.step,
+		Valid:  c.valid,
+	}
+
+	// fixed values are always included so that a renamed zone changes
+	// the database
+	if c.can(permRead) && (withValue || c.get == nil) {
+		if value, err := c.read(); err == nil {
+			cj.Value = value
+		}
+	}
+	return cj
+}
+
+type service struct {
+	iid             uint64
+	typ             string
+	primary         bool
+	linked          []uint64
+	characteristics []*characteristic
+}
+
+type serviceJSON struct {
+	IID             uint64               `json:"iid"`
+	Type            string               `json:"type"`
+	Primary         bool                 `json:"primary,omitempty"`
+	Linked          []uint64             `json:"linked,omitempty"`
+	Characteristics []characteristicJSON `json:"characteristics"`
+}
+
+// accessory is a bridged accessory, or the bridge itself, which is
+// always aid 1
+type accessory struct {
+	aid      uint64
+	services []*service
+	nextIID  uint64
+}
+
+func newAccessory(aid uint64) *accessory {
+	return &accessory{aid: aid, nextIID: 1}
+}
+
+// addService adds a service with the given characteristics, numbering
+// them in the order they're added
+func (a *accessory) addService(typ string, characteristics ...*characteristic) *service {
+	s := &service{iid: a.nextIID, typ: typ, characteristics: characteristics}
+	a.nextIID++
+	for _, c := range characteristics {
+		c.iid = a.nextIID
+		a.nextIID++
+	}
+	a.services = append(a.services, s)
+	return s
+}
+
+func (a *accessory) characteristic(iid uint64) *characteristic {
+	for _, s := range a.services {
+		for _, c := range s.characteristics {
+			if c.iid == iid {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// addInformation adds the accessory information service every accessory
+// must have
+func (a *accessory) addInformation(name, model, serial string) {
+	a.addService(typeAccessoryInformation,
+		&characteristic{typ: typeIdentify, format: formatBool, perms: []string{permWrite}, set: func(interface{}) error { return nil }},
+		fixed(typeManufacturer, "Monoprice"),
+		fixed(typeModel, model),
+		fixed(typeName, name),
+		fixed(typeSerialNumber, serial),
+		fixed(typeFirmwareRevision, "1.0.0"),
+	)
+}
+
+type accessoryJSON struct {
+	AID      uint64        `json:"aid"`
+	Services []serviceJSON `json:"services"`
+}
+
+func (a *accessory) describe(withValues bool) accessoryJSON {
+	aj := accessoryJSON{AID: a.aid, Services: []serviceJSON{}}
+	for _, s := range a.services {
+		sj := serviceJSON{IID: s.iid, Type: s.typ, Primary: s.primary, Linked: s.linked}
+		for _, c := range s.characteristics {
+			sj.Characteristics = append(sj.Characteristics, c.describe(withValues))
+		}
+		aj.Services = append(aj.Services, sj)
+	}
+	return aj
+}
+
+// fixed is a read only string characteristic
+func fixed(typ, value string) *characteristic {
+	return &characteristic{typ: typ, format: formatString, perms: []string{permRead}, value: value}
+}
+
+func limits(min, max float64) (*float64, *float64, *float64) {
+	step := 1.0
+	return &min, &max, &step
+}
+
+// characteristicValue is a value in a read response or an event
+type characteristicValue struct {
+	AID    uint64      `json:"aid"`
+	IID    uint64      `json:"iid"`
+	Value  interface{} `json:"value,omitempty"`
+	Status *int        `json:"status,omitempty"`
+}
+
+// encodeValues is the body of a read response or an event
+func encodeValues(values []characteristicValue) []byte {
+	b, _ := json.Marshal(struct {
+		Characteristics []characteristicValue `json:"characteristics"`
+	}{values})
+	return b
+}
@@ -0,0 +1,72 @@
+package homekit
+
+import (
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/mdns"
+	"github.com/miekg/dns"
+)
+
+// advertisement answers mDNS queries for the bridge's _hap._tcp service.
+// The TXT record is replaced as the bridge is paired and its accessories
+// change
+type advertisement struct {
+	mutex   sync.Mutex
+	service *mdns.MDNSService
+	server  *mdns.Server
+}
+
+func newAdvertisement(name string, port int, txt []string) (*advertisement, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	host = strings.SplitN(host, ".", 2)[0] + ".local."
+
+	service, err := mdns.NewMDNSService(name, "_hap._tcp", "", host, port, localIPs(), txt)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &advertisement{service: service}
+	a.server, err = mdns.NewServer(&mdns.Config{Zone: a})
+	return a, err
+}
+
+// localIPs are the addresses the bridge is advertised on
+func localIPs() []net.IP {
+	ips := []net.IP{}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && !ipnet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+
+	if len(ips) == 0 {
+		ips = append(ips, net.IPv4(127, 0, 0, 1))
+	}
+	return ips
+}
+
+// Records answers an mDNS question
+func (a *advertisement) Records(q dns.Question) []dns.RR {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.service.Records(q)
+}
+
+func (a *advertisement) update(txt []string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	service := *a.service
+	service.TXT = txt
+	a.service = &service
+}
+
+func (a *advertisement) Close() error {
+	return a.server.Shutdown()
+}
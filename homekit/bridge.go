@@ -0,0 +1,593 @@
+package homekit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/abates/monoprice"
+	"github.com/gorilla/mux"
+)
+
+// HAP status codes reported for individual characteristics
+const (
+	statusSuccess         = 0
+	statusInsufficient    = -70401
+	statusCommunication   = -70402
+	statusReadOnly        = -70404
+	statusWriteOnly       = -70405
+	statusNoNotifications = -70406
+	statusNotFound        = -70409
+	statusInvalidValue    = -70410
+)
+
+// statusConnectionAuthorization is the HTTP status for requests that need
+// a verified session
+const statusConnectionAuthorization = 470
+
+var (
+	// ErrSetupCode is returned for setup codes that don't look like
+	// XXX-XX-XXX or that HomeKit doesn't allow
+	ErrSetupCode = errors.New("setup code must look like 123-45-678 and can't be trivial")
+
+	setupCodeRE = regexp.MustCompile(`^\d{3}-\d{2}-\d{3}$`)
+)
+
+// ValidSetupCode reports whether code can be used to pair with a bridge
+func ValidSetupCode(code string) bool {
+	if !setupCodeRE.MatchString(code) {
+		return false
+	}
+
+	digits := strings.ReplaceAll(code, "-", "")
+	switch digits {
+	case "12345678", "87654321":
+		return false
+	}
+	return strings.Count(digits, digits[:1]) != len(digits)
+}
+
+// Zone is an amplifier zone exposed by the bridge as a television
+// accessory.  Power is the television's Active characteristic, the source
+// is its active input and volume and mute are on its speaker
+type Zone struct {
+	// ID identifies the zone across restarts, such as "amp1:12", so that
+	// it keeps the same accessory ID
+	ID   string
+	Name string
+	Zone monoprice.Zone
+	// Sources names the zone's inputs by number.  Inputs without a name
+	// are called "Source n"
+	Sources map[int]string
+}
+
+// Bridge is a HomeKit bridge with an accessory for each zone it is given
+type Bridge struct {
+	name      string
+	setupCode string
+	store     *store
+	logger    monoprice.Logger
+
+	mutex     sync.Mutex
+	bridge    *accessory
+	zones     []*zoneAccessory
+	conns     map[*conn]bool
+	setupConn *conn
+	attempts  int
+	advert    *advertisement
+
+	handler http.Handler
+}
+
+type Option func(*Bridge)
+
+// NameOption sets the name the bridge is advertised as
+func NameOption(name string) Option {
+	return func(b *Bridge) {
+		b.name = name
+	}
+}
+
+// SetupCodeOption sets the code that is entered on the controller to pair
+// with the bridge.  Without it a random code is kept in the pairing store
+func SetupCodeOption(code string) Option {
+	return func(b *Bridge) {
+		b.setupCode = code
+	}
+}
+
+// LoggerOption sends the bridge's log messages, such as pairing changes
+// and failed writes to zones, to logger.  Without it nothing is logged
+func LoggerOption(logger monoprice.Logger) Option {
+	return func(b *Bridge) {
+		b.logger = logger
+	}
+}
+
+// NewBridge creates a bridge that keeps its identity and pairings in
+// storeFile, which is created if it doesn't exist
+func NewBridge(storeFile string, options ...Option) (*Bridge, error) {
+	st, err := openStore(storeFile)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Bridge{
+		name:      "Amplifier",
+		setupCode: st.data.SetupCode,
+		store:     st,
+		conns:     make(map[*conn]bool),
+	}
+
+	for _, option := range options {
+		option(b)
+	}
+
+	if !ValidSetupCode(b.setupCode) {
+		return nil, ErrSetupCode
+	}
+
+	b.bridge = newAccessory(1)
+	b.bridge.addInformation(b.name, "ampserver", st.data.DeviceID)
+	b.bridge.services[0].characteristics[0].set = func(interface{}) error {
+		b.log().Info("HomeKit bridge identify requested")
+		return nil
+	}
+	b.bridge.addService(typeProtocolInformation, fixed(typeVersion, "1.1.0"))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/pair-setup", b.pairSetup).Methods("POST")
+	router.HandleFunc("/pair-verify", b.pairVerify).Methods("POST")
+	router.HandleFunc("/identify", b.identify).Methods("POST")
+	router.HandleFunc("/accessories", b.verified(b.accessories)).Methods("GET")
+	router.HandleFunc("/characteristics", b.verified(b.readCharacteristics)).Methods("GET")
+	router.HandleFunc("/characteristics", b.verified(b.writeCharacteristics)).Methods("PUT")
+	router.HandleFunc("/pairings", b.verified(b.pairings)).Methods("POST")
+	b.handler = router
+
+	if err := b.SetZones(nil); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// SetupCode is the code to enter on a controller to pair with the bridge
+func (b *Bridge) SetupCode() string {
+	return b.setupCode
+}
+
+// log returns the bridge's logger
+func (b *Bridge) log() monoprice.Logger {
+	if b.logger == nil {
+		return discardLogger{}
+	}
+	return b.logger
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Debug(string, ...any) {}
+func (discardLogger) Info(string, ...any)  {}
+func (discardLogger) Warn(string, ...any)  {}
+func (discardLogger) Error(string, ...any) {}
+
+// Paired reports whether any controller is paired with the bridge
+func (b *Bridge) Paired() bool {
+	return b.store.paired()
+}
+
+// SetZones replaces the bridged accessories.  Controllers are told to
+// fetch the accessories again when they have changed
+func (b *Bridge) SetZones(zones []Zone) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.store.mutex.Lock()
+	next := uint64(2)
+	for _, aid := range b.store.data.Accessories {
+		if aid >= next {
+			next = aid + 1
+		}
+	}
+
+	accessories := []*zoneAccessory{}
+	for _, zone := range zones {
+		aid, found := b.store.data.Accessories[zone.ID]
+		if !found {
+			aid = next
+			next++
+			b.store.data.Accessories[zone.ID] = aid
+		}
+		accessories = append(accessories, newZoneAccessory(aid, zone))
+	}
+	sort.Slice(accessories, func(i, j int) bool { return accessories[i].aid < accessories[j].aid })
+
+	// the configuration number changes whenever the accessories do
+	b.zones = accessories
+	sum := sha256.Sum256(b.database(false))
+	hash := hex.EncodeToString(sum[:])
+	changed := hash != b.store.data.ConfigHash
+	if changed {
+		if b.store.data.ConfigHash != "" {
+			b.store.data.ConfigNumber = b.store.data.ConfigNumber%65535 + 1
+		}
+		b.store.data.ConfigHash = hash
+	}
+	err := b.store.save()
+	b.store.mutex.Unlock()
+
+	if changed && b.advert != nil {
+		b.advert.update(b.txt())
+	}
+	return err
+}
+
+// Update tells the bridge the current state of a zone.  Controllers that
+// asked for events are sent the characteristics that changed
+func (b *Bridge) Update(id string, state monoprice.State) {
+	b.mutex.Lock()
+	var za *zoneAccessory
+	for _, zone := range b.zones {
+		if zone.zone.ID == id {
+			za = zone
+		}
+	}
+	b.mutex.Unlock()
+
+	if za != nil {
+		za.update(state)
+		b.notify(za, nil)
+	}
+}
+
+// notify sends events for the zone's characteristics that have changed
+// since they were last sent, skipping the connection that made the change
+func (b *Bridge) notify(za *zoneAccessory, except *conn) {
+	changes := za.changes()
+	if len(changes) == 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	conns := []*conn{}
+	for c := range b.conns {
+		if c != except {
+			conns = append(conns, c)
+		}
+	}
+	b.mutex.Unlock()
+
+	for _, c := range conns {
+		values := []characteristicValue{}
+		for _, change := range changes {
+			if c.subscribed(characteristicID{change.AID, change.IID}) {
+				values = append(values, change)
+			}
+		}
+
+		if len(values) > 0 {
+			c.sendEvent(encodeValues(values))
+		}
+	}
+}
+
+// database returns the accessory database served on GET /accessories.
+// b.mutex must be held
+func (b *Bridge) database(withValues bool) []byte {
+	accessories := []accessoryJSON{b.bridge.describe(withValues)}
+	for _, za := range b.zones {
+		accessories = append(accessories, za.describe(withValues))
+	}
+
+	body, _ := json.Marshal(struct {
+		Accessories []accessoryJSON `json:"accessories"`
+	}{accessories})
+	return body
+}
+
+func (b *Bridge) accessory(aid uint64) (*accessory, *zoneAccessory) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if aid == b.bridge.aid {
+		return b.bridge, nil
+	}
+
+	for _, za := range b.zones {
+		if za.aid == aid {
+			return za.accessory, za
+		}
+	}
+	return nil, nil
+}
+
+// Serve accepts controller connections on l
+func (b *Bridge) Serve(l net.Listener) error {
+	srv := &http.Server{
+		Handler: b.handler,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey{}, c.(*conn))
+		},
+		ConnState: b.connState,
+	}
+	return srv.Serve(listener{l})
+}
+
+// ListenAndServe advertises the bridge over mDNS and accepts controller
+// connections on addr
+func (b *Bridge) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	advert, err := newAdvertisement(b.name, l.Addr().(*net.TCPAddr).Port, b.txt())
+	if err != nil {
+		l.Close()
+		return fmt.Errorf("failed to advertise HomeKit bridge: %w", err)
+	}
+
+	b.mutex.Lock()
+	b.advert = advert
+	b.mutex.Unlock()
+	defer advert.Close()
+	return b.Serve(l)
+}
+
+func (b *Bridge) connState(nc net.Conn, state http.ConnState) {
+	c := nc.(*conn)
+	switch state {
+	case http.StateNew:
+		b.mutex.Lock()
+		b.conns[c] = true
+		b.mutex.Unlock()
+	case http.StateActive:
+		c.setActive(true)
+	case http.StateIdle:
+		c.setActive(false)
+	case http.StateClosed, http.StateHijacked:
+		b.endSetup(c)
+		b.mutex.Lock()
+		delete(b.conns, c)
+		b.mutex.Unlock()
+	}
+}
+
+// closeUnpaired closes the sessions of controllers that are no longer
+// paired
+func (b *Bridge) closeUnpaired() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for c := range b.conns {
+		if controller, verified := c.verified(); verified {
+			if _, found := b.store.pairing(controller); !found {
+				c.Close()
+			}
+		}
+	}
+}
+
+// advertise updates the mDNS record after pairing changes
+func (b *Bridge) advertise() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.advert != nil {
+		b.advert.update(b.txt())
+	}
+}
+
+// txt is the bridge's mDNS TXT record
+func (b *Bridge) txt() []string {
+	paired := "1"
+	if b.store.paired() {
+		paired = "0"
+	}
+
+	b.store.mutex.Lock()
+	defer b.store.mutex.Unlock()
+	return []string{
+		"c#=" + strconv.Itoa(b.store.data.ConfigNumber),
+		"ff=0",
+		"id=" + b.store.data.DeviceID,
+		"md=" + b.name,
+		"pv=1.1",
+		"s#=1",
+		"sf=" + paired,
+		// 2 is the bridge category
+		"ci=2",
+	}
+}
+
+type connContextKey struct{}
+
+func requestConn(r *http.Request) *conn {
+	return r.Context().Value(connContextKey{}).(*conn)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body []byte) {
+	w.Header().Set("Content-Type", "application/hap+json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func writeStatus(w http.ResponseWriter, httpStatus, status int) {
+	body, _ := json.Marshal(struct {
+		Status int `json:"status"`
+	}{status})
+	writeJSON(w, httpStatus, body)
+}
+
+// verified only lets requests through on sessions that have completed
+// pair verify
+func (b *Bridge) verified(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, verified := requestConn(r).verified(); !verified {
+			writeStatus(w, statusConnectionAuthorization, statusInsufficient)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// identify handles POST /identify, which is only allowed before the
+// bridge is paired
+func (b *Bridge) identify(w http.ResponseWriter, r *http.Request) {
+	if b.store.paired() {
+		writeStatus(w, http.StatusBadRequest, statusInsufficient)
+		return
+	}
+	b.log().Info("HomeKit bridge identify requested")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (b *Bridge) accessories(w http.ResponseWriter, r *http.Request) {
+	b.mutex.Lock()
+	body := b.database(true)
+	b.mutex.Unlock()
+	writeJSON(w, http.StatusOK, body)
+}
+
+// readCharacteristics handles GET /characteristics?id=1.2,3.4
+func (b *Bridge) readCharacteristics(w http.ResponseWriter, r *http.Request) {
+	ids := strings.Split(r.URL.Query().Get("id"), ",")
+	values := []characteristicValue{}
+	failed := false
+	for _, id := range ids {
+		aidStr, iidStr, _ := strings.Cut(id, ".")
+		aid, err1 := strconv.ParseUint(aidStr, 10, 64)
+		iid, err2 := strconv.ParseUint(iidStr, 10, 64)
+		if err1 != nil || err2 != nil {
+			writeStatus(w, http.StatusBadRequest, statusInvalidValue)
+			return
+		}
+
+		value := characteristicValue{AID: aid, IID: iid}
+		status := statusSuccess
+		a, _ := b.accessory(aid)
+		var c *characteristic
+		if a != nil {
+			c = a.characteristic(iid)
+		}
+
+		if c == nil {
+			status = statusNotFound
+		} else if !c.can(permRead) {
+			status = statusWriteOnly
+		} else if v, err := c.read(); err != nil {
+			status = statusCommunication
+		} else {
+			value.Value = v
+		}
+
+		if status != statusSuccess {
+			failed = true
+		}
+		value.Status = &status
+		values = append(values, value)
+	}
+
+	if !failed {
+		for i := range values {
+			values[i].Status = nil
+		}
+		writeJSON(w, http.StatusOK, encodeValues(values))
+		return
+	}
+	writeJSON(w, http.StatusMultiStatus, encodeValues(values))
+}
+
+// characteristicWrite is one entry in a PUT /characteristics request
+type characteristicWrite struct {
+	AID   uint64      `json:"aid"`
+	IID   uint64      `json:"iid"`
+	Value interface{} `json:"value"`
+	Event *bool       `json:"ev"`
+}
+
+// writeCharacteristics handles PUT /characteristics, which sets values and
+// turns events on and off
+func (b *Bridge) writeCharacteristics(w http.ResponseWriter, r *http.Request) {
+	c := requestConn(r)
+	req := struct {
+		Characteristics []characteristicWrite `json:"characteristics"`
+	}{}
+
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		writeStatus(w, http.StatusBadRequest, statusInvalidValue)
+		return
+	}
+
+	values := []characteristicValue{}
+	changed := map[*zoneAccessory]bool{}
+	failed := false
+	for _, write := range req.Characteristics {
+		status := b.write(c, write, changed)
+		if status != statusSuccess {
+			failed = true
+		}
+		values = append(values, characteristicValue{AID: write.AID, IID: write.IID, Status: &status})
+	}
+
+	for za := range changed {
+		b.notify(za, c)
+	}
+
+	if failed {
+		writeJSON(w, http.StatusMultiStatus, encodeValues(values))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (b *Bridge) write(c *conn, write characteristicWrite, changed map[*zoneAccessory]bool) int {
+	a, za := b.accessory(write.AID)
+	if a == nil {
+		return statusNotFound
+	}
+
+	ch := a.characteristic(write.IID)
+	if ch == nil {
+		return statusNotFound
+	}
+
+	if write.Event != nil {
+		if !ch.can(permEvents) {
+			return statusNoNotifications
+		}
+		c.subscribe(characteristicID{write.AID, write.IID}, *write.Event)
+	}
+
+	if write.Value == nil {
+		return statusSuccess
+	}
+
+	if !ch.can(permWrite) {
+		return statusReadOnly
+	}
+
+	value, err := ch.convert(write.Value)
+	if err != nil {
+		return statusInvalidValue
+	}
+
+	if err := ch.set(value); err != nil {
+		b.log().Warn("HomeKit write failed", "aid", write.AID, "iid", write.IID, "error", err)
+		return statusCommunication
+	}
+
+	if za != nil {
+		changed[za] = true
+	}
+	return statusSuccess
+}
@@ -0,0 +1,243 @@
+package homekit
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxFrame is the most plaintext an encrypted frame may hold
+const maxFrame = 1024
+
+// eventTimeout is how long an event may take to write before the
+// controller is considered gone and its connection is closed
+var eventTimeout = 5 * time.Second
+
+// frameOverhead is the length prefix and authentication tag around each
+// encrypted frame
+const frameOverhead = 2 + 16
+
+// conn is a connection from a controller.  It carries plain HTTP until
+// pair verify completes, after which every byte in either direction is
+// sent in encrypted frames
+type conn struct {
+	net.Conn
+
+	// read side, only used by the server's reading goroutine
+	raw       []byte
+	plain     []byte
+	readCount uint64
+
+	// writeMutex serializes responses and events
+	writeMutex sync.Mutex
+	writeKey   []byte
+	writeCount uint64
+
+	// mutex guards the rest
+	mutex        sync.Mutex
+	readKey      []byte
+	nextWriteKey []byte
+	// controller is the pairing ID of the verified controller
+	controller string
+	// active is set while a request is being handled, events are held
+	// back until the response has been sent
+	active  bool
+	pending [][]byte
+	// subscriptions are the characteristics the controller wants events
+	// for
+	subscriptions map[characteristicID]bool
+
+	setup  *pairSetup
+	verify *pairVerify
+}
+
+type characteristicID struct {
+	aid uint64
+	iid uint64
+}
+
+func newConn(c net.Conn) *conn {
+	return &conn{Conn: c, subscriptions: make(map[characteristicID]bool)}
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	for len(c.plain) == 0 {
+		c.mutex.Lock()
+		key := c.readKey
+		c.mutex.Unlock()
+
+		// the key is checked after the bytes arrive, since a read may
+		// already be waiting when pair verify completes
+		if key == nil && len(c.raw) > 0 {
+			c.plain, c.raw = c.raw, nil
+			break
+		}
+
+		if key != nil && len(c.raw) >= 2 {
+			n := int(binary.LittleEndian.Uint16(c.raw))
+			if n > maxFrame {
+				return 0, fmt.Errorf("encrypted frame of %d bytes is too long", n)
+			}
+
+			if len(c.raw) >= n+frameOverhead {
+				plain, err := open(key, counterNonce(c.readCount), c.raw[2:n+frameOverhead], c.raw[:2])
+				if err != nil {
+					return 0, err
+				}
+				c.readCount++
+				c.plain = plain
+				c.raw = c.raw[n+frameOverhead:]
+				continue
+			}
+		}
+
+		buf := make([]byte, 4096)
+		n, err := c.Conn.Read(buf)
+		c.raw = append(c.raw, buf[:n]...)
+		if n == 0 && err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, c.plain)
+	c.plain = c.plain[n:]
+	return n, nil
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.write(p)
+}
+
+// writeEvent writes an event with a deadline, so a controller that stops
+// reading can't hold up the amplifier's state updates.  The connection is
+// closed if the event can't be written
+func (c *conn) writeEvent(event []byte) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.Conn.SetWriteDeadline(time.Now().Add(eventTimeout))
+	_, err := c.write(event)
+	c.Conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		c.Conn.Close()
+	}
+}
+
+// write encrypts p once the session has started.  writeMutex must be
+// held
+func (c *conn) write(p []byte) (int, error) {
+	if c.writeKey == nil {
+		return c.Conn.Write(p)
+	}
+
+	frames := []byte{}
+	for rest := p; len(rest) > 0; {
+		n := len(rest)
+		if n > maxFrame {
+			n = maxFrame
+		}
+
+		length := binary.LittleEndian.AppendUint16(nil, uint16(n))
+		frames = append(frames, length...)
+		frames = append(frames, seal(c.writeKey, counterNonce(c.writeCount), rest[:n], length)...)
+		c.writeCount++
+		rest = rest[n:]
+	}
+
+	if _, err := c.Conn.Write(frames); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// startSession sets the keys for the encrypted session.  Incoming bytes
+// are decrypted right away since the controller won't send anything more
+// until it has the response to its last pair verify request, which is
+// still written in plain text.  encryptWrites is called once it has been
+func (c *conn) startSession(controller string, shared []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.controller = controller
+	c.readKey = deriveKey(shared, "Control-Salt", "Control-Write-Encryption-Key")
+	c.nextWriteKey = deriveKey(shared, "Control-Salt", "Control-Read-Encryption-Key")
+	c.verify = nil
+}
+
+func (c *conn) encryptWrites() {
+	c.mutex.Lock()
+	key := c.nextWriteKey
+	c.nextWriteKey = nil
+	c.mutex.Unlock()
+
+	c.writeMutex.Lock()
+	c.writeKey = key
+	c.writeMutex.Unlock()
+}
+
+// verified returns the pairing ID of the controller once pair verify has
+// completed
+func (c *conn) verified() (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.controller, c.readKey != nil
+}
+
+func (c *conn) subscribe(id characteristicID, enable bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if enable {
+		c.subscriptions[id] = true
+	} else {
+		delete(c.subscriptions, id)
+	}
+}
+
+func (c *conn) subscribed(id characteristicID) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.subscriptions[id]
+}
+
+// setActive is called as requests start and finish.  Events that arrived
+// during a request are sent after its response
+func (c *conn) setActive(active bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.active = active
+	if !active {
+		for _, event := range c.pending {
+			c.writeEvent(event)
+		}
+		c.pending = nil
+	}
+}
+
+// sendEvent sends an event with the given body.  The mutex is held while
+// writing so a request can't start in the middle of an event, which is
+// why the write has a deadline
+func (c *conn) sendEvent(body []byte) {
+	event := []byte(fmt.Sprintf("EVENT/1.0 200 OK\r\nContent-Type: application/hap+json\r\nContent-Length: %d\r\n\r\n%s", len(body), body))
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.active {
+		c.pending = append(c.pending, event)
+	} else {
+		c.writeEvent(event)
+	}
+}
+
+// listener wraps accepted connections so they can be encrypted
+type listener struct {
+	net.Listener
+}
+
+func (l listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newConn(c), nil
+}
@@ -0,0 +1,47 @@
+package homekit
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// deriveKey derives a 32 byte key from a shared secret with HKDF-SHA512
+func deriveKey(secret []byte, salt, info string) []byte {
+	key := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha512.New, secret, []byte(salt), []byte(info)), key)
+	return key
+}
+
+// pairingNonce pads the fixed nonce strings used during pairing, such
+// as "PS-Msg05", to the 12 bytes ChaCha20-Poly1305 needs
+func pairingNonce(nonce string) []byte {
+	return append(make([]byte, 4), nonce...)
+}
+
+// counterNonce is the nonce for the nth frame of an encrypted session
+func counterNonce(n uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.LittleEndian.PutUint64(nonce[4:], n)
+	return nonce
+}
+
+func seal(key, nonce, plaintext, additional []byte) []byte {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		// only happens if the key isn't 32 bytes
+		panic(err)
+	}
+	return aead.Seal(nil, nonce, plaintext, additional)
+}
+
+func open(key, nonce, ciphertext, additional []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, ciphertext, additional)
+}
@@ -0,0 +1,473 @@
+package homekit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abates/monoprice"
+)
+
+func TestTLV(t *testing.T) {
+	long := bytes.Repeat([]byte{7}, 300)
+	tests := []struct {
+		name    string
+		input   tlv
+		want    []byte
+		wantErr bool
+	}{
+		{"Simple", tlv{{tlvState, []byte{1}}, {tlvMethod, []byte{0}}}, []byte{6, 1, 1, 0, 1, 0}, false},
+		{"Separator", tlv{{tlvIdentifier, []byte("a")}, {tlvSeparator, []byte{}}, {tlvIdentifier, []byte("b")}}, []byte{1, 1, 'a', 0xff, 0, 1, 1, 'b'}, false},
+		{"Fragmented", tlv{{tlvPublicKey, long}}, append(append(append([]byte{3, 255}, long[:255]...), 3, 45), long[255:]...), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.input.encode()
+			if !bytes.Equal(test.want, got) {
+				t.Errorf("Wanted encoding %v got %v", test.want, got)
+			}
+
+			decoded, err := decodeTLV(got)
+			if err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+
+			if !reflect.DeepEqual(test.input, decoded) {
+				t.Errorf("Wanted %v got %v", test.input, decoded)
+			}
+		})
+	}
+
+	if _, err := decodeTLV([]byte{6, 2, 1}); err != errTLVTruncated {
+		t.Errorf("Wanted %v got %v", errTLVTruncated, err)
+	}
+}
+
+func TestValidSetupCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{"031-45-154", true},
+		{"03145154", false},
+		{"031-45-15", false},
+		{"111-11-111", false},
+		{"123-45-678", false},
+		{"876-54-321", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.code, func(t *testing.T) {
+			if got := ValidSetupCode(test.code); got != test.want {
+				t.Errorf("Wanted %v got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestVolumeScale(t *testing.T) {
+	tests := []struct {
+		volume  int
+		percent int
+	}{
+		{0, 0},
+		{1, 3},
+		{19, 50},
+		{38, 100},
+	}
+
+	for _, test := range tests {
+		t.Run(strconv.Itoa(test.volume), func(t *testing.T) {
+			if got := toPercent(test.volume); got != test.percent {
+				t.Errorf("Wanted %d%% got %d%%", test.percent, got)
+			}
+
+			if got := fromPercent(test.percent); got != test.volume {
+				t.Errorf("Wanted volume %d got %d", test.volume, got)
+			}
+		})
+	}
+}
+
+type testZone struct {
+	mutex    sync.Mutex
+	id       monoprice.ZoneID
+	state    monoprice.State
+	commands []string
+}
+
+func (tz *testZone) ID() monoprice.ZoneID { return tz.id }
+
+func (tz *testZone) State() (monoprice.State, error) {
+	tz.mutex.Lock()
+	defer tz.mutex.Unlock()
+	return tz.state, nil
+}
+
+func (tz *testZone) SendCommand(cmd monoprice.Command, arg interface{}) error {
+	tz.mutex.Lock()
+	defer tz.mutex.Unlock()
+	tz.commands = append(tz.commands, fmt.Sprintf("%s%v", cmd, arg))
+	return nil
+}
+
+func TestSendEventTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { eventTimeout = timeout }(eventTimeout)
+	eventTimeout = 20 * time.Millisecond
+
+	// nothing reads the other end of the pipe, like a controller that has
+	// stopped responding
+	nc, other := net.Pipe()
+	defer other.Close()
+	c := newConn(nc)
+
+	done := make(chan struct{})
+	go func() {
+		c.sendEvent([]byte("{}"))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Wanted sendEvent to give up on a stalled controller")
+	}
+
+	if _, err := c.Conn.Write([]byte("x")); err == nil {
+		t.Errorf("Wanted the stalled connection to be closed")
+	}
+}
+
+// testController is a HAP controller for exercising the bridge
+type testController struct {
+	t          *testing.T
+	conn       *conn
+	reader     *textproto.Reader
+	id         string
+	publicKey  ed25519.PublicKey
+	privateKey ed25519.PrivateKey
+}
+
+func newTestController(t *testing.T, addr string) *testController {
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	t.Cleanup(func() { nc.Close() })
+
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	c := newConn(nc)
+	return &testController{
+		t:          t,
+		conn:       c,
+		reader:     textproto.NewReader(bufio.NewReader(c)),
+		id:         "2F5C9A3E-7D1B-4A6C-9E8F-1B2C3D4E5F60",
+		publicKey:  public,
+		privateKey: private,
+	}
+}
+
+// message reads a response or event, returning its status line and body
+func (tc *testController) message() (string, []byte) {
+	tc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := tc.reader.ReadLine()
+	if err != nil {
+		tc.t.Fatalf("Unexpected error %v", err)
+	}
+
+	header, err := tc.reader.ReadMIMEHeader()
+	if err != nil {
+		tc.t.Fatalf("Unexpected error %v", err)
+	}
+
+	length, _ := strconv.Atoi(header.Get("Content-Length"))
+	body := make([]byte, length)
+	if _, err := io.ReadFull(tc.reader.R, body); err != nil {
+		tc.t.Fatalf("Unexpected error %v", err)
+	}
+	return line, body
+}
+
+func (tc *testController) do(method, path, contentType string, body []byte) (int, []byte) {
+	fmt.Fprintf(tc.conn, "%s %s HTTP/1.1\r\nHost: bridge\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n%s", method, path, contentType, len(body), body)
+	line, respBody := tc.message()
+	status, _ := strconv.Atoi(strings.Fields(line)[1])
+	return status, respBody
+}
+
+func (tc *testController) pair(path string, req tlv) tlv {
+	status, body := tc.do("POST", path, "application/pairing+tlv8", req.encode())
+	if status != 200 {
+		tc.t.Fatalf("Wanted status 200 got %d", status)
+	}
+
+	resp, err := decodeTLV(body)
+	if err != nil {
+		tc.t.Fatalf("Unexpected error %v", err)
+	}
+	return resp
+}
+
+// pairSetup runs pair setup with the given code, returning the pairing
+// error code if it fails
+func (tc *testController) pairSetup(code string) byte {
+	req := tlv{}
+	req.addByte(tlvState, 1)
+	req.addByte(tlvMethod, methodPairSetup)
+	resp := tc.pair("/pair-setup", req)
+	if e := resp.getByte(tlvError); e != 0 {
+		return e
+	}
+
+	salt := resp.get(tlvSalt)
+	B := new(big.Int).SetBytes(resp.get(tlvPublicKey))
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	a := new(big.Int).SetBytes(secret)
+	A := new(big.Int).Exp(srpG, a, srpN)
+
+	// S = (B - k*g^x) ^ (a + u*x)
+	x := srpX(salt, code)
+	S := new(big.Int).Exp(srpG, x, srpN)
+	S.Mul(S, srpK())
+	S.Sub(B, S)
+	S.Mod(S, srpN)
+	exp := new(big.Int).Mul(srpU(A, B), x)
+	exp.Add(exp, a)
+	S.Exp(S, exp, srpN)
+	key := srpHash(srpPad(S))
+	proof := srpClientProof(salt, A, B, key)
+
+	req = tlv{}
+	req.addByte(tlvState, 3)
+	req.add(tlvPublicKey, srpPad(A))
+	req.add(tlvProof, proof)
+	resp = tc.pair("/pair-setup", req)
+	if e := resp.getByte(tlvError); e != 0 {
+		return e
+	}
+
+	if !bytes.Equal(srpHash(srpPad(A), proof, key), resp.get(tlvProof)) {
+		tc.t.Fatalf("Bridge's SRP proof is wrong")
+	}
+
+	encryptKey := deriveKey(key, "Pair-Setup-Encrypt-Salt", "Pair-Setup-Encrypt-Info")
+	info := deriveKey(key, "Pair-Setup-Controller-Sign-Salt", "Pair-Setup-Controller-Sign-Info")
+	info = append(append(info, tc.id...), tc.publicKey...)
+	sub := tlv{}
+	sub.add(tlvIdentifier, []byte(tc.id))
+	sub.add(tlvPublicKey, tc.publicKey)
+	sub.add(tlvSignature, ed25519.Sign(tc.privateKey, info))
+
+	req = tlv{}
+	req.addByte(tlvState, 5)
+	req.add(tlvEncryptedData, seal(encryptKey, pairingNonce("PS-Msg05"), sub.encode(), nil))
+	resp = tc.pair("/pair-setup", req)
+	if e := resp.getByte(tlvError); e != 0 {
+		return e
+	}
+
+	plain, err := open(encryptKey, pairingNonce("PS-Msg06"), resp.get(tlvEncryptedData), nil)
+	if err != nil {
+		tc.t.Fatalf("Unexpected error %v", err)
+	}
+
+	sub, _ = decodeTLV(plain)
+	info = deriveKey(key, "Pair-Setup-Accessory-Sign-Salt", "Pair-Setup-Accessory-Sign-Info")
+	info = append(append(info, sub.get(tlvIdentifier)...), sub.get(tlvPublicKey)...)
+	if !ed25519.Verify(sub.get(tlvPublicKey), info, sub.get(tlvSignature)) {
+		tc.t.Fatalf("Bridge's long term key signature is wrong")
+	}
+	return 0
+}
+
+// pairVerify starts an encrypted session
+func (tc *testController) pairVerify() byte {
+	private, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	public := private.PublicKey().Bytes()
+
+	req := tlv{}
+	req.addByte(tlvState, 1)
+	req.add(tlvPublicKey, public)
+	resp := tc.pair("/pair-verify", req)
+	if e := resp.getByte(tlvError); e != 0 {
+		return e
+	}
+
+	accessoryKey := resp.get(tlvPublicKey)
+	peer, _ := ecdh.X25519().NewPublicKey(accessoryKey)
+	shared, _ := private.ECDH(peer)
+	key := deriveKey(shared, "Pair-Verify-Encrypt-Salt", "Pair-Verify-Encrypt-Info")
+	if _, err := open(key, pairingNonce("PV-Msg02"), resp.get(tlvEncryptedData), nil); err != nil {
+		tc.t.Fatalf("Unexpected error %v", err)
+	}
+
+	info := append(append(append([]byte{}, public...), tc.id...), accessoryKey...)
+	sub := tlv{}
+	sub.add(tlvIdentifier, []byte(tc.id))
+	sub.add(tlvSignature, ed25519.Sign(tc.privateKey, info))
+
+	req = tlv{}
+	req.addByte(tlvState, 3)
+	req.add(tlvEncryptedData, seal(key, pairingNonce("PV-Msg03"), sub.encode(), nil))
+	resp = tc.pair("/pair-verify", req)
+	if e := resp.getByte(tlvError); e != 0 {
+		return e
+	}
+
+	// the controller's keys are the other way around from the bridge's
+	tc.conn.mutex.Lock()
+	tc.conn.readKey = deriveKey(shared, "Control-Salt", "Control-Read-Encryption-Key")
+	tc.conn.mutex.Unlock()
+	tc.conn.writeKey = deriveKey(shared, "Control-Salt", "Control-Write-Encryption-Key")
+	return 0
+}
+
+// iid finds a characteristic in the accessory database
+func iid(t *testing.T, db []byte, aid uint64, serviceType, characteristicType string) (uint64, interface{}) {
+	var accessories struct {
+		Accessories []accessoryJSON `json:"accessories"`
+	}
+	json.Unmarshal(db, &accessories)
+	for _, a := range accessories.Accessories {
+		for _, s := range a.Services {
+			for _, c := range s.Characteristics {
+				if a.AID == aid && s.Type == serviceType && c.Type == characteristicType {
+					return c.IID, c.Value
+				}
+			}
+		}
+	}
+	t.Fatalf("Characteristic %s of service %s not found on accessory %d", characteristicType, serviceType, aid)
+	return 0, nil
+}
+
+func TestBridge(t *testing.T) {
+	storeFile := filepath.Join(t.TempDir(), "homekit.json")
+	bridge, err := NewBridge(storeFile, NameOption("Test"), SetupCodeOption("031-45-154"))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	zone := &testZone{id: 11, state: monoprice.State{Zone: 11, Volume: 10, Source: 2}}
+	zones := []Zone{{ID: "amp:11", Name: "Kitchen", Zone: zone, Sources: map[int]string{1: "Turntable"}}}
+	if err := bridge.SetZones(zones); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer l.Close()
+	go bridge.Serve(l)
+
+	tc := newTestController(t, l.Addr().String())
+	if status, _ := tc.do("GET", "/accessories", "application/hap+json", nil); status != statusConnectionAuthorization {
+		t.Errorf("Wanted status %d before pairing got %d", statusConnectionAuthorization, status)
+	}
+
+	if e := tc.pairSetup("111-22-333"); e != tlvErrAuthentication {
+		t.Errorf("Wanted error %d for the wrong code got %d", tlvErrAuthentication, e)
+	}
+
+	if e := tc.pairSetup("031-45-154"); e != 0 {
+		t.Fatalf("Wanted pair setup to succeed got error %d", e)
+	}
+
+	if !bridge.Paired() {
+		t.Errorf("Wanted bridge to be paired")
+	}
+
+	if e := newTestController(t, l.Addr().String()).pairSetup("031-45-154"); e != tlvErrUnavailable {
+		t.Errorf("Wanted error %d once paired got %d", tlvErrUnavailable, e)
+	}
+
+	if e := tc.pairVerify(); e != 0 {
+		t.Fatalf("Wanted pair verify to succeed got error %d", e)
+	}
+
+	status, db := tc.do("GET", "/accessories", "application/hap+json", nil)
+	if status != 200 {
+		t.Fatalf("Wanted status 200 got %d", status)
+	}
+
+	if _, name := iid(t, db, 2, typeAccessoryInformation, typeName); name != "Kitchen" {
+		t.Errorf("Wanted name Kitchen got %v", name)
+	}
+
+	if _, name := iid(t, db, 2, typeInputSource, typeName); name != "Turntable" {
+		t.Errorf("Wanted first input Turntable got %v", name)
+	}
+
+	if _, source := iid(t, db, 2, typeTelevision, typeActiveIdentifier); source != 2.0 {
+		t.Errorf("Wanted active input 2 got %v", source)
+	}
+
+	activeIID, _ := iid(t, db, 2, typeTelevision, typeActive)
+	volumeIID, volume := iid(t, db, 2, typeTelevisionSpeaker, typeVolume)
+	if volume != 26.0 {
+		t.Errorf("Wanted volume 26%% got %v", volume)
+	}
+
+	write := fmt.Sprintf(`{"characteristics":[{"aid":2,"iid":%d,"value":true},{"aid":2,"iid":%d,"ev":true},{"aid":9,"iid":1,"value":1}]}`, activeIID, volumeIID)
+	status, body := tc.do("PUT", "/characteristics", "application/hap+json", []byte(write))
+	wantBody := fmt.Sprintf(`{"characteristics":[{"aid":2,"iid":%d,"status":0},{"aid":2,"iid":%d,"status":0},{"aid":9,"iid":1,"status":%d}]}`, activeIID, volumeIID, statusNotFound)
+	if status != 207 || string(body) != wantBody {
+		t.Errorf("Wanted 207 %s got %d %s", wantBody, status, body)
+	}
+
+	write = fmt.Sprintf(`{"characteristics":[{"aid":2,"iid":%d,"value":50}]}`, volumeIID)
+	if status, _ := tc.do("PUT", "/characteristics", "application/hap+json", []byte(write)); status != 204 {
+		t.Errorf("Wanted status 204 got %d", status)
+	}
+
+	wantCommands := []string{"PR01", "VO19"}
+	if !reflect.DeepEqual(wantCommands, zone.commands) {
+		t.Errorf("Wanted commands %v got %v", wantCommands, zone.commands)
+	}
+
+	bridge.Update("amp:11", monoprice.State{Zone: 11, Power: true, Volume: 38, Source: 2})
+	line, body := tc.message()
+	wantEvent := fmt.Sprintf(`{"characteristics":[{"aid":2,"iid":%d,"value":100}]}`, volumeIID)
+	if line != "EVENT/1.0 200 OK" || string(body) != wantEvent {
+		t.Errorf("Wanted event %s got %q %s", wantEvent, line, body)
+	}
+
+	status, body = tc.do("GET", fmt.Sprintf("/characteristics?id=2.%d,2.%d", activeIID, volumeIID), "application/hap+json", nil)
+	wantBody = fmt.Sprintf(`{"characteristics":[{"aid":2,"iid":%d,"value":1},{"aid":2,"iid":%d,"value":100}]}`, activeIID, volumeIID)
+	if status != 200 || string(body) != wantBody {
+		t.Errorf("Wanted 200 %s got %d %s", wantBody, status, body)
+	}
+
+	// the pairing and the zone's aid are kept across restarts
+	bridge, err = NewBridge(storeFile, SetupCodeOption("031-45-154"))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if !bridge.Paired() {
+		t.Errorf("Wanted pairing to be loaded from the store")
+	}
+
+	bridge.SetZones(append([]Zone{{ID: "amp:12", Zone: &testZone{id: 12}}}, zones...))
+	if _, za := bridge.accessory(2); za == nil || za.zone.ID != "amp:11" {
+		t.Errorf("Wanted amp:11 to keep aid 2")
+	}
+}
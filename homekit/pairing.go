@@ -0,0 +1,393 @@
+package homekit
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// maxAttempts is how many wrong setup codes are accepted before pair
+// setup is refused until the bridge restarts
+const maxAttempts = 100
+
+// maxPairings is how many controllers can be paired at once
+const maxPairings = 16
+
+// pairSetup is the state of a pair setup exchange on a connection
+type pairSetup struct {
+	srp *srpServer
+	// key encrypts the exchange of long term keys once the setup code has
+	// been verified
+	key []byte
+}
+
+// pairVerify is the state of a pair verify exchange on a connection
+type pairVerify struct {
+	publicKey []byte
+	// controllerKey is the controller's ephemeral public key
+	controllerKey []byte
+	shared        []byte
+	key           []byte
+}
+
+// writeTLV writes a pairing response.  Pairing errors are reported in the
+// body with a 200 status
+func writeTLV(w http.ResponseWriter, t tlv) {
+	b := t.encode()
+	w.Header().Set("Content-Type", "application/pairing+tlv8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func errorTLV(state, code byte) tlv {
+	t := tlv{}
+	t.addByte(tlvState, state)
+	t.addByte(tlvError, code)
+	return t
+}
+
+func readTLV(r *http.Request) (tlv, error) {
+	b, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	return decodeTLV(b)
+}
+
+// pairSetup handles POST /pair-setup, where a controller proves it knows
+// the setup code and exchanges long term keys with the bridge
+func (b *Bridge) pairSetup(w http.ResponseWriter, r *http.Request) {
+	c := requestConn(r)
+	req, err := readTLV(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	state := req.getByte(tlvState)
+	switch state {
+	case 1:
+		writeTLV(w, b.setupStart(c, req))
+	case 3:
+		writeTLV(w, b.setupVerify(c, req))
+	case 5:
+		writeTLV(w, b.setupExchange(c, req))
+	default:
+		writeTLV(w, errorTLV(state+1, tlvErrUnknown))
+	}
+}
+
+func (b *Bridge) endSetup(c *conn) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.setupConn == c {
+		b.setupConn = nil
+	}
+	c.mutex.Lock()
+	c.setup = nil
+	c.mutex.Unlock()
+}
+
+// setupStart answers M1 with the SRP salt and public key
+func (b *Bridge) setupStart(c *conn, req tlv) tlv {
+	if method := req.getByte(tlvMethod); method != methodPairSetup && method != methodPairSetupAuth {
+		return errorTLV(2, tlvErrUnknown)
+	}
+
+	if b.store.paired() {
+		return errorTLV(2, tlvErrUnavailable)
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.attempts >= maxAttempts {
+		return errorTLV(2, tlvErrMaxTries)
+	}
+
+	if b.setupConn != nil && b.setupConn != c {
+		return errorTLV(2, tlvErrBusy)
+	}
+
+	srp, err := newSRPServer(b.setupCode)
+	if err != nil {
+		b.log().Error("HomeKit pair setup failed", "error", err)
+		return errorTLV(2, tlvErrUnknown)
+	}
+
+	b.setupConn = c
+	c.mutex.Lock()
+	c.setup = &pairSetup{srp: srp}
+	c.mutex.Unlock()
+
+	resp := tlv{}
+	resp.addByte(tlvState, 2)
+	resp.add(tlvPublicKey, srp.publicKey())
+	resp.add(tlvSalt, srp.salt)
+	return resp
+}
+
+// setupVerify checks the controller's SRP proof, M3, and answers with the
+// bridge's proof
+func (b *Bridge) setupVerify(c *conn, req tlv) tlv {
+	c.mutex.Lock()
+	setup := c.setup
+	c.mutex.Unlock()
+	if setup == nil {
+		return errorTLV(4, tlvErrUnknown)
+	}
+
+	proof, err := setup.srp.verify(req.get(tlvPublicKey), req.get(tlvProof))
+	if err != nil {
+		b.mutex.Lock()
+		b.attempts++
+		b.mutex.Unlock()
+		b.endSetup(c)
+		b.log().Warn("HomeKit pair setup failed", "remote", c.RemoteAddr().String(), "error", err)
+		return errorTLV(4, tlvErrAuthentication)
+	}
+	setup.key = deriveKey(setup.srp.key, "Pair-Setup-Encrypt-Salt", "Pair-Setup-Encrypt-Info")
+
+	resp := tlv{}
+	resp.addByte(tlvState, 4)
+	resp.add(tlvProof, proof)
+	return resp
+}
+
+// setupExchange checks the controller's long term key, M5, saves the
+// pairing and answers with the bridge's long term key
+func (b *Bridge) setupExchange(c *conn, req tlv) tlv {
+	c.mutex.Lock()
+	setup := c.setup
+	c.mutex.Unlock()
+	if setup == nil || setup.key == nil {
+		return errorTLV(6, tlvErrUnknown)
+	}
+	defer b.endSetup(c)
+
+	plain, err := open(setup.key, pairingNonce("PS-Msg05"), req.get(tlvEncryptedData), nil)
+	if err != nil {
+		return errorTLV(6, tlvErrAuthentication)
+	}
+
+	sub, err := decodeTLV(plain)
+	if err != nil {
+		return errorTLV(6, tlvErrUnknown)
+	}
+
+	id := sub.get(tlvIdentifier)
+	publicKey := sub.get(tlvPublicKey)
+	if len(publicKey) != ed25519.PublicKeySize {
+		return errorTLV(6, tlvErrAuthentication)
+	}
+
+	x := deriveKey(setup.srp.key, "Pair-Setup-Controller-Sign-Salt", "Pair-Setup-Controller-Sign-Info")
+	info := append(append(x, id...), publicKey...)
+	if !ed25519.Verify(publicKey, info, sub.get(tlvSignature)) {
+		return errorTLV(6, tlvErrAuthentication)
+	}
+
+	if err := b.store.addPairing(Pairing{ID: string(id), PublicKey: publicKey, Admin: true}); err != nil {
+		b.log().Error("Failed to save HomeKit pairing", "error", err)
+		return errorTLV(6, tlvErrUnknown)
+	}
+	b.log().Info("HomeKit controller paired", "controller", string(id))
+	b.advertise()
+
+	x = deriveKey(setup.srp.key, "Pair-Setup-Accessory-Sign-Salt", "Pair-Setup-Accessory-Sign-Info")
+	accessoryKey := b.store.privateKey()
+	accessoryPublic := accessoryKey.Public().(ed25519.PublicKey)
+	info = append(append(x, b.store.data.DeviceID...), accessoryPublic...)
+
+	sub = tlv{}
+	sub.add(tlvIdentifier, []byte(b.store.data.DeviceID))
+	sub.add(tlvPublicKey, accessoryPublic)
+	sub.add(tlvSignature, ed25519.Sign(accessoryKey, info))
+
+	resp := tlv{}
+	resp.addByte(tlvState, 6)
+	resp.add(tlvEncryptedData, seal(setup.key, pairingNonce("PS-Msg06"), sub.encode(), nil))
+	return resp
+}
+
+// pairVerify handles POST /pair-verify, where a paired controller and the
+// bridge prove their identities to each other and agree on the keys for
+// an encrypted session
+func (b *Bridge) pairVerify(w http.ResponseWriter, r *http.Request) {
+	c := requestConn(r)
+	req, err := readTLV(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	state := req.getByte(tlvState)
+	switch state {
+	case 1:
+		writeTLV(w, b.verifyStart(c, req))
+	case 3:
+		resp, controller, shared := b.verifyFinish(c, req)
+		if controller == "" {
+			writeTLV(w, resp)
+			return
+		}
+
+		// the response is the last thing sent in plain text
+		c.startSession(controller, shared)
+		writeTLV(w, resp)
+		http.NewResponseController(w).Flush()
+		c.encryptWrites()
+	default:
+		writeTLV(w, errorTLV(state+1, tlvErrUnknown))
+	}
+}
+
+// verifyStart answers M1 with an ephemeral key and the bridge's signature
+func (b *Bridge) verifyStart(c *conn, req tlv) tlv {
+	controllerKey := req.get(tlvPublicKey)
+	peer, err := ecdh.X25519().NewPublicKey(controllerKey)
+	if err != nil {
+		return errorTLV(2, tlvErrUnknown)
+	}
+
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return errorTLV(2, tlvErrUnknown)
+	}
+
+	shared, err := privateKey.ECDH(peer)
+	if err != nil {
+		return errorTLV(2, tlvErrUnknown)
+	}
+
+	verify := &pairVerify{
+		publicKey:     privateKey.PublicKey().Bytes(),
+		controllerKey: controllerKey,
+		shared:        shared,
+		key:           deriveKey(shared, "Pair-Verify-Encrypt-Salt", "Pair-Verify-Encrypt-Info"),
+	}
+
+	info := append(append(append([]byte{}, verify.publicKey...), b.store.data.DeviceID...), controllerKey...)
+	sub := tlv{}
+	sub.add(tlvIdentifier, []byte(b.store.data.DeviceID))
+	sub.add(tlvSignature, ed25519.Sign(b.store.privateKey(), info))
+
+	c.mutex.Lock()
+	c.verify = verify
+	c.mutex.Unlock()
+
+	resp := tlv{}
+	resp.addByte(tlvState, 2)
+	resp.add(tlvPublicKey, verify.publicKey)
+	resp.add(tlvEncryptedData, seal(verify.key, pairingNonce("PV-Msg02"), sub.encode(), nil))
+	return resp
+}
+
+// verifyFinish checks the controller's signature, M3.  It returns the
+// controller's pairing ID and the shared secret when it is valid
+func (b *Bridge) verifyFinish(c *conn, req tlv) (tlv, string, []byte) {
+	c.mutex.Lock()
+	verify := c.verify
+	c.verify = nil
+	c.mutex.Unlock()
+	if verify == nil {
+		return errorTLV(4, tlvErrUnknown), "", nil
+	}
+
+	plain, err := open(verify.key, pairingNonce("PV-Msg03"), req.get(tlvEncryptedData), nil)
+	if err != nil {
+		return errorTLV(4, tlvErrAuthentication), "", nil
+	}
+
+	sub, err := decodeTLV(plain)
+	if err != nil {
+		return errorTLV(4, tlvErrUnknown), "", nil
+	}
+
+	id := string(sub.get(tlvIdentifier))
+	pairing, found := b.store.pairing(id)
+	if !found {
+		return errorTLV(4, tlvErrAuthentication), "", nil
+	}
+
+	info := append(append(append([]byte{}, verify.controllerKey...), id...), verify.publicKey...)
+	if !ed25519.Verify(pairing.PublicKey, info, sub.get(tlvSignature)) {
+		return errorTLV(4, tlvErrAuthentication), "", nil
+	}
+
+	resp := tlv{}
+	resp.addByte(tlvState, 4)
+	return resp, id, verify.shared
+}
+
+// pairings handles POST /pairings, which lets an admin controller add,
+// remove and list pairings
+func (b *Bridge) pairings(w http.ResponseWriter, r *http.Request) {
+	c := requestConn(r)
+	controller, _ := c.verified()
+	req, err := readTLV(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if pairing, found := b.store.pairing(controller); !found || !pairing.Admin {
+		writeTLV(w, errorTLV(2, tlvErrAuthentication))
+		return
+	}
+
+	resp := tlv{}
+	resp.addByte(tlvState, 2)
+	switch req.getByte(tlvMethod) {
+	case methodAddPairing:
+		id := string(req.get(tlvIdentifier))
+		publicKey := req.get(tlvPublicKey)
+		existing, found := b.store.pairing(id)
+		if found && string(existing.PublicKey) != string(publicKey) {
+			resp = errorTLV(2, tlvErrUnknown)
+		} else if !found && len(b.store.pairings()) >= maxPairings {
+			resp = errorTLV(2, tlvErrMaxPeers)
+		} else if len(publicKey) != ed25519.PublicKeySize {
+			resp = errorTLV(2, tlvErrUnknown)
+		} else if err := b.store.addPairing(Pairing{ID: id, PublicKey: publicKey, Admin: req.getByte(tlvPermissions) == 1}); err != nil {
+			b.log().Error("Failed to save HomeKit pairing", "error", err)
+			resp = errorTLV(2, tlvErrUnknown)
+		}
+	case methodRemovePairing:
+		id := string(req.get(tlvIdentifier))
+		if err := b.store.removePairing(id); err != nil {
+			b.log().Error("Failed to save HomeKit pairing", "error", err)
+			resp = errorTLV(2, tlvErrUnknown)
+			break
+		}
+
+		b.log().Info("HomeKit controller unpaired", "controller", id)
+		b.advertise()
+
+		// the response is sent before the removed controllers'
+		// connections are closed
+		writeTLV(w, resp)
+		http.NewResponseController(w).Flush()
+		b.closeUnpaired()
+		return
+	case methodListPairings:
+		for i, pairing := range b.store.pairings() {
+			if i > 0 {
+				resp.add(tlvSeparator, nil)
+			}
+			permissions := byte(0)
+			if pairing.Admin {
+				permissions = 1
+			}
+			resp.add(tlvIdentifier, []byte(pairing.ID))
+			resp.add(tlvPublicKey, pairing.PublicKey)
+			resp.addByte(tlvPermissions, permissions)
+		}
+	default:
+		resp = errorTLV(2, tlvErrUnknown)
+	}
+	writeTLV(w, resp)
+}
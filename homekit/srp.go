@@ -0,0 +1,132 @@
+package homekit
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"math/big"
+)
+
+// srpN and srpG are the 3072 bit group from RFC 5054 that pair setup uses
+var (
+	srpN, _ = new(big.Int).SetString(""+
+		"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+		"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+		"4FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+		"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF05"+
+		"98DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB"+
+		"9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B"+
+		"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF695581718"+
+		"3995497CEA956AE515D2261898FA051015728E5A8AAAC42DAD33170D04507A33"+
+		"A85521ABDF1CBA64ECFB850458DBEF0A8AEA71575D060C7DB3970F85A6E1E4C7"+
+		"ABF5AE8CDB0933D71E8C94E04A25619DCEE3D2261AD2EE6BF12FFA06D98A0864"+
+		"D87602733EC86A64521F2B18177B200CBBE117577A615D6C770988C0BAD946E2"+
+		"08E24FA074E5AB3143DB5BFCE0FD108E4B82D120A93AD2CAFFFFFFFFFFFFFFFF", 16)
+	srpG = big.NewInt(5)
+)
+
+// srpUsername is the fixed SRP username for pair setup
+const srpUsername = "Pair-Setup"
+
+var errSRPProof = errors.New("incorrect setup code")
+
+// srpHash returns the SHA-512 hash of the concatenated values
+func srpHash(values ...[]byte) []byte {
+	h := sha512.New()
+	for _, v := range values {
+		h.Write(v)
+	}
+	return h.Sum(nil)
+}
+
+// srpPad returns n as big endian bytes padded to the size of the group
+func srpPad(n *big.Int) []byte {
+	return n.FillBytes(make([]byte, (srpN.BitLen()+7)/8))
+}
+
+// srpX derives the private key from the salt and setup code
+func srpX(salt []byte, password string) *big.Int {
+	return new(big.Int).SetBytes(srpHash(salt, srpHash([]byte(srpUsername+":"+password))))
+}
+
+// srpK is the SRP-6a multiplier
+func srpK() *big.Int {
+	return new(big.Int).SetBytes(srpHash(srpPad(srpN), srpPad(srpG)))
+}
+
+// srpU scrambles the two public keys
+func srpU(A, B *big.Int) *big.Int {
+	return new(big.Int).SetBytes(srpHash(srpPad(A), srpPad(B)))
+}
+
+// srpClientProof is the proof the controller sends to show it knows the
+// setup code
+func srpClientProof(salt []byte, A, B *big.Int, key []byte) []byte {
+	hN := srpHash(srpN.Bytes())
+	hG := srpHash(srpG.Bytes())
+	for i := range hN {
+		hN[i] ^= hG[i]
+	}
+	return srpHash(hN, srpHash([]byte(srpUsername)), salt, srpPad(A), srpPad(B), key)
+}
+
+// srpServer is the accessory side of an SRP-6a exchange
+type srpServer struct {
+	salt []byte
+	v    *big.Int
+	b    *big.Int
+	B    *big.Int
+
+	// key is the shared session key once the controller's proof has
+	// been verified
+	key []byte
+}
+
+func newSRPServer(password string) (*srpServer, error) {
+	s := &srpServer{salt: make([]byte, 16)}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(s.salt); err != nil {
+		return nil, err
+	}
+
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	s.v = new(big.Int).Exp(srpG, srpX(s.salt, password), srpN)
+	s.b = new(big.Int).SetBytes(secret)
+
+	// B = k*v + g^b
+	s.B = new(big.Int).Mul(srpK(), s.v)
+	s.B.Add(s.B, new(big.Int).Exp(srpG, s.b, srpN))
+	s.B.Mod(s.B, srpN)
+	return s, nil
+}
+
+func (s *srpServer) publicKey() []byte {
+	return srpPad(s.B)
+}
+
+// verify checks the controller's public key and proof.  It returns the
+// accessory's proof and sets the session key
+func (s *srpServer) verify(publicKey, proof []byte) ([]byte, error) {
+	A := new(big.Int).SetBytes(publicKey)
+	if new(big.Int).Mod(A, srpN).Sign() == 0 {
+		return nil, errSRPProof
+	}
+
+	// S = (A * v^u) ^ b
+	S := new(big.Int).Exp(s.v, srpU(A, s.B), srpN)
+	S.Mul(S, A)
+	S.Exp(S, s.b, srpN)
+	key := srpHash(srpPad(S))
+
+	expected := srpClientProof(s.salt, A, s.B, key)
+	if subtle.ConstantTimeCompare(expected, proof) != 1 {
+		return nil, errSRPProof
+	}
+
+	s.key = key
+	return srpHash(srpPad(A), proof, key), nil
+}
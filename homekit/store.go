@@ -0,0 +1,195 @@
+package homekit
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Pairing is a controller that has been paired with the bridge
+type Pairing struct {
+	ID        string `json:"id"`
+	PublicKey []byte `json:"public_key"`
+	Admin     bool   `json:"admin"`
+}
+
+// storeData is what is kept in the pairing store file
+type storeData struct {
+	// DeviceID is the bridge's pairing identifier, which looks like a
+	// MAC address
+	DeviceID   string `json:"device_id"`
+	PrivateKey []byte `json:"private_key"`
+	SetupCode  string `json:"setup_code"`
+
+	// ConfigNumber is advertised over mDNS and must change whenever the
+	// accessories do so controllers fetch them again
+	ConfigNumber int    `json:"config_number"`
+	ConfigHash   string `json:"config_hash"`
+
+	// Accessories maps zone IDs to the aid they were given, so a zone
+	// keeps its aid, and its place in the Home app, across restarts
+	Accessories map[string]uint64 `json:"accessories"`
+	Pairings    []Pairing         `json:"pairings"`
+}
+
+// store keeps the bridge's identity and pairings in a file
+type store struct {
+	mutex    sync.Mutex
+	filename string
+	data     storeData
+}
+
+func openStore(filename string) (*store, error) {
+	s := &store{filename: filename}
+	b, err := os.ReadFile(filename)
+	if err == nil {
+		err = json.Unmarshal(b, &s.data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	if s.data.DeviceID == "" || len(s.data.PrivateKey) != ed25519.SeedSize {
+		id := make([]byte, 6)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		s.data.DeviceID = fmt.Sprintf("%02X:%02X:%02X:%02X:%02X:%02X", id[0], id[1], id[2], id[3], id[4], id[5])
+
+		s.data.PrivateKey = make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(s.data.PrivateKey); err != nil {
+			return nil, err
+		}
+		s.data.Pairings = nil
+	}
+
+	if s.data.SetupCode == "" {
+		if s.data.SetupCode, err = generateSetupCode(); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.data.ConfigNumber == 0 {
+		s.data.ConfigNumber = 1
+	}
+
+	if s.data.Accessories == nil {
+		s.data.Accessories = make(map[string]uint64)
+	}
+	return s, s.save()
+}
+
+// save writes the store to a temporary file that then replaces the
+// store, so a crash never leaves a partly written file
+func (s *store) save() error {
+	b, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.filename), "."+filepath.Base(s.filename)+"-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(b)
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.filename)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (s *store) privateKey() ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(s.data.PrivateKey)
+}
+
+func (s *store) paired() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.data.Pairings) > 0
+}
+
+func (s *store) pairing(id string) (Pairing, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, pairing := range s.data.Pairings {
+		if pairing.ID == id {
+			return pairing, true
+		}
+	}
+	return Pairing{}, false
+}
+
+func (s *store) pairings() []Pairing {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Pairing{}, s.data.Pairings...)
+}
+
+// addPairing adds a controller, or updates the permissions of one that is
+// already paired
+func (s *store) addPairing(pairing Pairing) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, existing := range s.data.Pairings {
+		if existing.ID == pairing.ID {
+			s.data.Pairings[i].Admin = pairing.Admin
+			return s.save()
+		}
+	}
+	s.data.Pairings = append(s.data.Pairings, pairing)
+	return s.save()
+}
+
+// removePairing removes a controller.  Removing the last admin removes
+// every pairing, which leaves the bridge unpaired
+func (s *store) removePairing(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pairings := []Pairing{}
+	admin := false
+	for _, pairing := range s.data.Pairings {
+		if pairing.ID != id {
+			pairings = append(pairings, pairing)
+			admin = admin || pairing.Admin
+		}
+	}
+
+	if !admin {
+		pairings = nil
+	}
+	s.data.Pairings = pairings
+	return s.save()
+}
+
+// generateSetupCode picks a random setup code, avoiding the codes the
+// HAP specification doesn't allow
+func generateSetupCode() (string, error) {
+	b := make([]byte, 4)
+	for {
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		n := (uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])) % 100000000
+		code := fmt.Sprintf("%03d-%02d-%03d", n/100000, n/1000%100, n%1000)
+		if ValidSetupCode(code) {
+			return code, nil
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package homekit
+
+import (
+	"errors"
+)
+
+// TLV8 item types used by the pairing endpoints
+const (
+	tlvMethod        byte = 0x00
+	tlvIdentifier    byte = 0x01
+	tlvSalt          byte = 0x02
+	tlvPublicKey     byte = 0x03
+	tlvProof         byte = 0x04
+	tlvEncryptedData byte = 0x05
+	tlvState         byte = 0x06
+	tlvError         byte = 0x07
+	tlvSignature     byte = 0x0a
+	tlvPermissions   byte = 0x0b
+	tlvSeparator     byte = 0xff
+)
+
+// Pairing methods
+const (
+	methodPairSetup     byte = 0x00
+	methodPairSetupAuth byte = 0x01
+	methodAddPairing    byte = 0x03
+	methodRemovePairing byte = 0x04
+	methodListPairings  byte = 0x05
+)
+
+// Pairing error codes
+const (
+	tlvErrUnknown        byte = 0x01
+	tlvErrAuthentication byte = 0x02
+	tlvErrMaxPeers       byte = 0x04
+	tlvErrMaxTries       byte = 0x05
+	tlvErrUnavailable    byte = 0x06
+	tlvErrBusy           byte = 0x07
+)
+
+var errTLVTruncated = errors.New("truncated TLV8 item")
+
+type tlvItem struct {
+	typ   byte
+	value []byte
+}
+
+// tlv is an ordered list of TLV8 items.  Order matters for lists that use
+// separators, such as the response to a list pairings request
+type tlv []tlvItem
+
+func (t *tlv) add(typ byte, value []byte) {
+	*t = append(*t, tlvItem{typ, value})
+}
+
+func (t *tlv) addByte(typ byte, value byte) {
+	t.add(typ, []byte{value})
+}
+
+// get returns the value of the first item of the given type
+func (t tlv) get(typ byte) []byte {
+	for _, item := range t {
+		if item.typ == typ {
+			return item.value
+		}
+	}
+	return nil
+}
+
+// getByte returns the single byte value of the first item of the given
+// type, or 0 when there isn't one
+func (t tlv) getByte(typ byte) byte {
+	if value := t.get(typ); len(value) == 1 {
+		return value[0]
+	}
+	return 0
+}
+
+// encode serializes the items.  Values longer than 255 bytes are split
+// into fragments of the same type
+func (t tlv) encode() []byte {
+	b := []byte{}
+	for _, item := range t {
+		value := item.value
+		for {
+			n := len(value)
+			if n > 255 {
+				n = 255
+			}
+			b = append(b, item.typ, byte(n))
+			b = append(b, value[:n]...)
+			value = value[n:]
+			if len(value) == 0 {
+				break
+			}
+		}
+	}
+	return b
+}
+
+// decodeTLV parses TLV8 items, joining fragmented values back together
+func decodeTLV(b []byte) (tlv, error) {
+	t := tlv{}
+	fragment := false
+	for len(b) > 0 {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, errTLVTruncated
+		}
+
+		typ, n := b[0], int(b[1])
+		value := b[2 : 2+n]
+		b = b[2+n:]
+
+		if fragment && t[len(t)-1].typ == typ {
+			last := &t[len(t)-1]
+			last.value = append(last.value, value...)
+		} else {
+			t = append(t, tlvItem{typ, append([]byte{}, value...)})
+		}
+		fragment = n == 255
+	}
+	return t, nil
+}
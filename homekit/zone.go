@@ -0,0 +1,274 @@
+package homekit
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/abates/monoprice"
+)
+
+// maxVolume is the amp's highest volume, which HomeKit shows as 100%
+const maxVolume = monoprice.MaxVolume
+
+// numSources is the number of inputs on each zone
+const numSources = 6
+
+func toPercent(volume int) int {
+	return int(math.Round(float64(volume) * 100 / maxVolume))
+}
+
+func fromPercent(percent int) int {
+	return int(math.Round(float64(percent) * maxVolume / 100))
+}
+
+func boolArg(b bool) string {
+	if b {
+		return "01"
+	}
+	return "00"
+}
+
+// zoneAccessory is the television accessory for a zone
+type zoneAccessory struct {
+	*accessory
+	zone Zone
+
+	mutex sync.Mutex
+	state monoprice.State
+	known bool
+	// names are the names given to the zone and its inputs from the Home
+	// app, by iid
+	names map[uint64]string
+	// derived are the characteristics whose values come from the zone's
+	// state, and sent are the values they last had in an event
+	derived []derivedCharacteristic
+	sent    map[uint64]interface{}
+}
+
+func newZoneAccessory(aid uint64, zone Zone) *zoneAccessory {
+	za := &zoneAccessory{
+		accessory: newAccessory(aid),
+		zone:      zone,
+		names:     make(map[uint64]string),
+		sent:      make(map[uint64]interface{}),
+	}
+
+	name := zone.Name
+	if name == "" {
+		name = fmt.Sprintf("Zone %d", zone.Zone.ID())
+	}
+	za.addInformation(name, "MPR-6ZHMAUT", zone.ID)
+
+	min, max, step := limits(0, 1)
+	active := &characteristic{typ: typeActive, format: formatUint8, perms: []string{permRead, permWrite, permEvents}, min: min, max: max, step: step, valid: []int{0, 1}}
+	za.fromState(active, func(state monoprice.State) interface{} {
+		if state.Power {
+			return 1
+		}
+		return 0
+	})
+	active.set = func(value interface{}) error {
+		power := value.(int) == 1
+		return za.send(monoprice.SetPower, boolArg(power), func(state *monoprice.State) { state.Power = power })
+	}
+
+	sources := []int{}
+	for i := 1; i <= numSources; i++ {
+		sources = append(sources, i)
+	}
+	min, max, step = limits(1, numSources)
+	activeIdentifier := &characteristic{typ: typeActiveIdentifier, format: formatUint32, perms: []string{permRead, permWrite, permEvents}, min: min, max: max, step: step, valid: sources}
+	za.fromState(activeIdentifier, func(state monoprice.State) interface{} { return state.Source })
+	activeIdentifier.set = func(value interface{}) error {
+		source := value.(int)
+		return za.send(monoprice.SetSource, source, func(state *monoprice.State) { state.Source = source })
+	}
+
+	min, max, step = limits(0, 1)
+	television := za.addService(typeTelevision,
+		active,
+		activeIdentifier,
+		za.configuredName(name),
+		&characteristic{typ: typeSleepDiscoveryMode, format: formatUint8, perms: []string{permRead, permEvents}, min: min, max: max, step: step, value: 1},
+	)
+	television.primary = true
+
+	mute := &characteristic{typ: typeMute, format: formatBool, perms: []string{permRead, permWrite, permEvents}}
+	za.fromState(mute, func(state monoprice.State) interface{} { return state.Mute })
+	mute.set = func(value interface{}) error {
+		muted := value.(bool)
+		return za.send(monoprice.SetMute, boolArg(muted), func(state *monoprice.State) { state.Mute = muted })
+	}
+
+	min, max, step = limits(0, 100)
+	volume := &characteristic{typ: typeVolume, format: formatUint8, perms: []string{permRead, permWrite, permEvents}, unit: "percentage", min: min, max: max, step: step}
+	za.fromState(volume, func(state monoprice.State) interface{} { return toPercent(state.Volume) })
+	volume.set = func(value interface{}) error {
+		v := fromPercent(value.(int))
+		return za.send(monoprice.SetVolume, v, func(state *monoprice.State) { state.Volume = v })
+	}
+
+	// the remote's volume buttons step the volume up or down by one
+	min, max, step = limits(0, 1)
+	selector := &characteristic{typ: typeVolumeSelector, format: formatUint8, perms: []string{permWrite}, min: min, max: max, step: step, valid: []int{0, 1}}
+	selector.set = func(value interface{}) error {
+		state, err := za.current()
+		if err != nil {
+			return err
+		}
+
+		v := state.Volume + 1
+		if value.(int) == 1 {
+			v = state.Volume - 1
+		}
+
+		if v < 0 || v > maxVolume {
+			return nil
+		}
+		return za.send(monoprice.SetVolume, v, func(state *monoprice.State) { state.Volume = v })
+	}
+
+	// 3 is absolute volume control
+	min, max, step = limits(0, 3)
+	speaker := za.addService(typeTelevisionSpeaker,
+		mute,
+		volume,
+		&characteristic{typ: typeVolumeControlType, format: formatUint8, perms: []string{permRead, permEvents}, min: min, max: max, step: step, value: 3},
+		selector,
+	)
+	television.linked = append(television.linked, speaker.iid)
+
+	for i := 1; i <= numSources; i++ {
+		sourceName := zone.Sources[i]
+		if sourceName == "" {
+			sourceName = fmt.Sprintf("Source %d", i)
+		}
+
+		min, max, step = limits(0, 1)
+		configured := &characteristic{typ: typeIsConfigured, format: formatUint8, perms: []string{permRead, permWrite, permEvents}, min: min, max: max, step: step, valid: []int{0, 1}, value: 1}
+		configured.set = func(interface{}) error { return nil }
+
+		input := za.addService(typeInputSource,
+			za.configuredName(sourceName),
+			// 0 is an input of type "other"
+			&characteristic{typ: typeInputSourceType, format: formatUint8, perms: []string{permRead, permEvents}, value: 0},
+			configured,
+			// 0 is shown
+			&characteristic{typ: typeCurrentVisibilityState, format: formatUint8, perms: []string{permRead, permEvents}, value: 0},
+			&characteristic{typ: typeIdentifier, format: formatUint32, perms: []string{permRead}, value: i},
+			fixed(typeName, sourceName),
+		)
+		television.linked = append(television.linked, input.iid)
+	}
+	return za
+}
+
+// fromState makes the characteristic's value come from the zone's state
+func (za *zoneAccessory) fromState(c *characteristic, fn func(monoprice.State) interface{}) {
+	c.get = func() (interface{}, error) {
+		state, err := za.current()
+		if err != nil {
+			return nil, err
+		}
+		return fn(state), nil
+	}
+	za.derived = append(za.derived, derivedCharacteristic{c, fn})
+}
+
+type derivedCharacteristic struct {
+	c  *characteristic
+	fn func(monoprice.State) interface{}
+}
+
+// configuredName is a name that can be changed from the Home app.  New
+// names only last until the bridge restarts, the names in the
+// configuration file are the ones that stick
+func (za *zoneAccessory) configuredName(name string) *characteristic {
+	c := &characteristic{typ: typeConfiguredName, format: formatString, perms: []string{permRead, permWrite, permEvents}}
+	c.get = func() (interface{}, error) {
+		za.mutex.Lock()
+		defer za.mutex.Unlock()
+		if n, found := za.names[c.iid]; found {
+			return n, nil
+		}
+		return name, nil
+	}
+
+	c.set = func(value interface{}) error {
+		za.mutex.Lock()
+		defer za.mutex.Unlock()
+		za.names[c.iid] = value.(string)
+		return nil
+	}
+	return c
+}
+
+// current returns the zone's last known state, querying the zone if it
+// hasn't been updated yet
+func (za *zoneAccessory) current() (monoprice.State, error) {
+	za.mutex.Lock()
+	defer za.mutex.Unlock()
+	if za.known {
+		return za.state, nil
+	}
+
+	state, err := za.zone.Zone.State()
+	if err == nil {
+		za.setState(state)
+	}
+	return state, err
+}
+
+// setState sets the known state.  The first known state is what
+// controllers read, so it isn't sent as events.  za.mutex must be held
+func (za *zoneAccessory) setState(state monoprice.State) {
+	za.state = state
+	if !za.known {
+		for _, d := range za.derived {
+			za.sent[d.c.iid] = d.fn(state)
+		}
+	}
+	za.known = true
+}
+
+// send sends a command to the zone and applies the change to the known
+// state
+func (za *zoneAccessory) send(cmd monoprice.Command, arg interface{}, apply func(*monoprice.State)) error {
+	if err := za.zone.Zone.SendCommand(cmd, arg); err != nil {
+		return err
+	}
+
+	za.mutex.Lock()
+	defer za.mutex.Unlock()
+	if za.known {
+		apply(&za.state)
+	}
+	return nil
+}
+
+func (za *zoneAccessory) update(state monoprice.State) {
+	za.mutex.Lock()
+	defer za.mutex.Unlock()
+	za.setState(state)
+}
+
+// changes returns the characteristics that have changed since they were
+// last returned
+func (za *zoneAccessory) changes() []characteristicValue {
+	za.mutex.Lock()
+	defer za.mutex.Unlock()
+	if !za.known {
+		return nil
+	}
+
+	changes := []characteristicValue{}
+	for _, d := range za.derived {
+		value := d.fn(za.state)
+		if za.sent[d.c.iid] != value {
+			changes = append(changes, characteristicValue{AID: za.aid, IID: d.c.iid, Value: value})
+			za.sent[d.c.iid] = value
+		}
+	}
+	return changes
+}
@@ -0,0 +1,112 @@
+// Package fakeamp is an amplifier for tests.  It answers queries and
+// commands on its serial line the way the hardware does
+package fakeamp
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/abates/monoprice"
+)
+
+// Amp is a serial connection to an amplifier with the given zones
+// attached.  Pass it to monoprice.New
+type Amp struct {
+	mutex  sync.Mutex
+	states map[int]*monoprice.State
+	missed map[int]int
+	out    bytes.Buffer
+}
+
+// New creates an amplifier with the zones powered off at volume 10, the
+// tone and balance centred and source 1 selected
+func New(zones ...int) *Amp {
+	fake := &Amp{states: make(map[int]*monoprice.State), missed: make(map[int]int)}
+	for _, zone := range zones {
+		fake.states[zone] = &monoprice.State{Zone: zone, Volume: 10, Treble: 7, Bass: 7, Balance: 10, Source: 1}
+	}
+	return fake
+}
+
+// State returns a zone's current state
+func (fake *Amp) State(zone int) monoprice.State {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return *fake.states[zone]
+}
+
+// Update changes a zone's state, as if it was changed from a keypad
+func (fake *Amp) Update(zone int, fn func(*monoprice.State)) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fn(fake.states[zone])
+}
+
+// Miss makes the amplifier echo the next n queries of a zone without
+// answering them, the way a noisy serial line loses a response
+func (fake *Amp) Miss(zone, n int) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.missed[zone] = n
+}
+
+func (fake *Amp) Write(p []byte) (int, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	line := strings.TrimSpace(string(p))
+	fake.out.WriteString(line + "\r\n#")
+	if len(line) < 3 {
+		return len(p), nil
+	}
+
+	zone, _ := strconv.Atoi(line[1:3])
+	state, found := fake.states[zone]
+	if line[0] == '?' && zone%10 == 0 {
+		// a unit query reports every zone on the unit
+		for id := zone + 1; id <= zone+6; id++ {
+			if state, found := fake.states[id]; found {
+				str, _ := state.Marshal()
+				fake.out.WriteString(">" + str + "\r\r\n#")
+			}
+		}
+	} else if line[0] == '?' && found && fake.missed[zone] > 0 {
+		fake.missed[zone]--
+	} else if line[0] == '?' && found {
+		str, _ := state.Marshal()
+		fake.out.WriteString(">" + str + "\r\r\n#")
+	} else if line[0] == '<' && found && len(line) >= 7 {
+		value, _ := strconv.Atoi(line[5:])
+		switch monoprice.Command(line[3:5]) {
+		case monoprice.SetPower:
+			state.Power = value == 1
+		case monoprice.SetMute:
+			state.Mute = value == 1
+		case monoprice.SetDND:
+			state.DoNotDisturb = value == 1
+		case monoprice.SetVolume:
+			state.Volume = value
+		case monoprice.SetTreble:
+			state.Treble = value
+		case monoprice.SetBass:
+			state.Bass = value
+		case monoprice.SetBalance:
+			state.Balance = value
+		case monoprice.SetSource:
+			state.Source = value
+		}
+	}
+	return len(p), nil
+}
+
+func (fake *Amp) Read(p []byte) (int, error) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if fake.out.Len() == 0 {
+		return 0, io.EOF
+	}
+	return fake.out.Read(p)
+}
@@ -0,0 +1,76 @@
+package monoprice
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger receives the library's log messages.  Debug is used for every
+// line sent to and received from the amplifier, Info for zone discovery
+// and Warn for retries.  Arguments are alternating keys and values, such
+// as "zone", 11, so a *slog.Logger can be used directly
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// LoggerOption sends the amplifier's log messages to logger.  Without it,
+// or VerboseOption, nothing is logged
+func LoggerOption(logger Logger) Option {
+	return func(amp *Amplifier) {
+		amp.logger = logger
+	}
+}
+
+// VerboseOption logs every message, including each line sent to and
+// received from the amplifier, with the standard log package
+func VerboseOption() Option {
+	return LoggerOption(stdLogger{})
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Debug(string, ...any) {}
+func (discardLogger) Info(string, ...any)  {}
+func (discardLogger) Warn(string, ...any)  {}
+func (discardLogger) Error(string, ...any) {}
+
+// stdLogger writes messages as "LEVEL msg key=value" lines with the
+// standard log package
+type stdLogger struct{}
+
+func (stdLogger) Debug(msg string, args ...any) { stdLog("DEBUG", msg, args) }
+func (stdLogger) Info(msg string, args ...any)  { stdLog("INFO", msg, args) }
+func (stdLogger) Warn(msg string, args ...any)  { stdLog("WARN", msg, args) }
+func (stdLogger) Error(msg string, args ...any) { stdLog("ERROR", msg, args) }
+
+func stdLog(level, msg string, args []any) {
+	builder := &strings.Builder{}
+	builder.WriteString(level)
+	builder.WriteString(" ")
+	builder.WriteString(msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(builder, " %v=%v", args[i], quote(args[i+1]))
+	}
+	log.Print(builder.String())
+}
+
+// quote quotes strings so protocol lines, with their carriage returns and
+// line feeds, stay on one line
+func quote(v any) any {
+	if s, ok := v.(string); ok {
+		return fmt.Sprintf("%q", s)
+	}
+	return v
+}
+
+// log returns the amplifier's logger
+func (amp *Amplifier) log() Logger {
+	if amp.logger == nil {
+		return discardLogger{}
+	}
+	return amp.logger
+}
@@ -0,0 +1,166 @@
+package monoprice
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// StateChange describes a zone whose state differs from the previous
+// poll.  Previous is the zero State the first time a zone is seen
+type StateChange struct {
+	Zone     ZoneID `json:"zone"`
+	Previous State  `json:"previous"`
+	Current  State  `json:"current"`
+}
+
+// MonitorEvent is sent to subscribers after any poll that found a
+// change.  Initial is set for the first successful poll, and
+// Reconnected is set for the first successful poll after a poll in which
+// no zone could be queried
+type MonitorEvent struct {
+	Time        time.Time     `json:"time"`
+	Changes     []StateChange `json:"changes"`
+	Initial     bool          `json:"initial,omitempty"`
+	Reconnected bool          `json:"reconnected,omitempty"`
+}
+
+// Monitor periodically queries a set of zones and notifies subscribers
+// of any changes, including changes made at the keypads
+type Monitor struct {
+	zones    []Zone
+	interval time.Duration
+
+	mutex       sync.Mutex
+	states      map[ZoneID]State
+	polled      bool
+	down        bool
+	stopped     bool
+	subscribers map[chan MonitorEvent]struct{}
+}
+
+func NewMonitor(zones []Zone, interval time.Duration) *Monitor {
+	return &Monitor{
+		zones:       zones,
+		interval:    interval,
+		states:      make(map[ZoneID]State),
+		subscribers: make(map[chan MonitorEvent]struct{}),
+	}
+}
+
+// Run polls the zones until the context is cancelled.  When it returns
+// every subscriber's channel is closed, and later subscribers get a
+// closed channel
+func (m *Monitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	defer m.stop()
+
+	for {
+		m.Poll()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll queries every zone once, notifies subscribers of any changes and
+// returns the event that was sent, if any
+func (m *Monitor) Poll() (MonitorEvent, bool) {
+	states := make(map[ZoneID]State)
+	for _, zone := range m.zones {
+		if state, err := zone.State(); err == nil {
+			states[zone.ID()] = state
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if len(states) == 0 {
+		m.down = m.polled
+		return MonitorEvent{}, false
+	}
+
+	event := MonitorEvent{
+		Time:        time.Now(),
+		Initial:     !m.polled,
+		Reconnected: m.down,
+	}
+	m.polled = true
+	m.down = false
+
+	for _, zone := range m.zones {
+		state, found := states[zone.ID()]
+		if !found {
+			continue
+		}
+
+		if prev, found := m.states[zone.ID()]; !found || prev != state {
+			event.Changes = append(event.Changes, StateChange{Zone: zone.ID(), Previous: prev, Current: state})
+			m.states[zone.ID()] = state
+		}
+	}
+
+	if len(event.Changes) == 0 && !event.Reconnected {
+		return event, false
+	}
+
+	for ch := range m.subscribers {
+		// a slow subscriber misses events rather than holding up the
+		// monitor
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+	return event, true
+}
+
+func (m *Monitor) stop() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.stopped = true
+	for ch := range m.subscribers {
+		delete(m.subscribers, ch)
+		close(ch)
+	}
+}
+
+// States returns the most recently polled state of every zone
+func (m *Monitor) States() map[ZoneID]State {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	states := make(map[ZoneID]State)
+	for id, state := range m.states {
+		states[id] = state
+	}
+	return states
+}
+
+// Subscribe returns a channel that receives an event for each poll with
+// changes.  The channel is closed when Run returns.  The returned
+// function unsubscribes and closes the channel if Run hasn't already
+func (m *Monitor) Subscribe() (<-chan MonitorEvent, func()) {
+	ch := make(chan MonitorEvent, 16)
+	m.mutex.Lock()
+	if m.stopped {
+		close(ch)
+	} else {
+		m.subscribers[ch] = struct{}{}
+	}
+	m.mutex.Unlock()
+
+	return ch, func() {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		if _, found := m.subscribers[ch]; found {
+			delete(m.subscribers, ch)
+			close(ch)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package monoprice
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMonitorPoll(t *testing.T) {
+	zone11 := &testZone{id: 11, state: State{Zone: 11}}
+	zone12 := &testZone{id: 12, state: State{Zone: 12}}
+	m := NewMonitor([]Zone{zone11, zone12}, time.Second)
+	ch, unsubscribe := m.Subscribe()
+	defer unsubscribe()
+
+	tests := []struct {
+		name      string
+		update    func()
+		want      MonitorEvent
+		wantEvent bool
+	}{
+		{
+			name:      "Initial",
+			update:    func() {},
+			want:      MonitorEvent{Changes: []StateChange{{11, State{}, State{Zone: 11}}, {12, State{}, State{Zone: 12}}}, Initial: true},
+			wantEvent: true,
+		},
+		{
+			name:      "No change",
+			update:    func() {},
+			wantEvent: false,
+		},
+		{
+			name:      "Keypad",
+			update:    func() { zone12.state.Volume = 20 },
+			want:      MonitorEvent{Changes: []StateChange{{12, State{Zone: 12}, State{Zone: 12, Volume: 20}}}},
+			wantEvent: true,
+		},
+		{
+			name:      "Down",
+			update:    func() { zone11.err = ErrUnknownState; zone12.err = ErrUnknownState },
+			wantEvent: false,
+		},
+		{
+			name:      "Reconnected",
+			update:    func() { zone11.err = nil; zone12.err = nil },
+			want:      MonitorEvent{Reconnected: true},
+			wantEvent: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.update()
+			got, gotEvent := m.Poll()
+			got.Time = time.Time{}
+			if gotEvent != test.wantEvent {
+				t.Fatalf("Wanted event %v got %v", test.wantEvent, gotEvent)
+			}
+
+			if !gotEvent {
+				return
+			}
+
+			if !reflect.DeepEqual(test.want, got) {
+				t.Errorf("Wanted %+v got %+v", test.want, got)
+			}
+
+			select {
+			case sent := <-ch:
+				sent.Time = time.Time{}
+				if !reflect.DeepEqual(test.want, sent) {
+					t.Errorf("Subscriber wanted %+v got %+v", test.want, sent)
+				}
+			default:
+				t.Errorf("Subscriber did not receive the event")
+			}
+		})
+	}
+
+	want := map[ZoneID]State{11: {Zone: 11}, 12: {Zone: 12, Volume: 20}}
+	if got := m.States(); !reflect.DeepEqual(want, got) {
+		t.Errorf("Wanted states %+v got %+v", want, got)
+	}
+}
+
+func TestMonitorRunClosesSubscribers(t *testing.T) {
+	m := NewMonitor([]Zone{&testZone{id: 11, state: State{Zone: 11}}}, time.Hour)
+	ch, unsubscribe := m.Subscribe()
+	defer unsubscribe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx)
+		close(done)
+	}()
+
+	if event := <-ch; !event.Initial {
+		t.Errorf("Wanted the initial event got %+v", event)
+	}
+
+	cancel()
+	<-done
+	closed := func(ch <-chan MonitorEvent) bool {
+		select {
+		case _, ok := <-ch:
+			return !ok
+		default:
+			return false
+		}
+	}
+
+	if !closed(ch) {
+		t.Errorf("Wanted the channel closed when Run returned")
+	}
+
+	late, unsubscribeLate := m.Subscribe()
+	defer unsubscribeLate()
+	if !closed(late) {
+		t.Errorf("Wanted a closed channel after Run returned")
+	}
+}
@@ -38,9 +38,9 @@ func (state *State) Unmarshal(str string) (err error) {
 
 	for err == nil {
 		if len(str) < 2 {
-			err = io.ErrUnexpectedEOF
+			err = fmt.Errorf("%w: %w", ErrInvalidResponse, io.ErrUnexpectedEOF)
 		} else if len(unmarshalers) == 0 {
-			err = fmt.Errorf("%w trailing %q", ErrTooLong, str)
+			err = fmt.Errorf("%w: %w trailing %q", ErrInvalidResponse, ErrTooLong, str)
 		} else {
 			err = unmarshalers[0](str[0:2])
 			if err == nil {
@@ -125,3 +125,88 @@ func (qr *QueryResponse) Read(reader ampReader) error {
 	}
 	return err
 }
+
+// UnitResponse reads the state of every zone attached to a unit in reply
+// to a unit query, such as "?10".  Count is the number of zones the unit
+// is expected to report
+type UnitResponse struct {
+	EchoResponse
+	Count  int
+	States []State
+}
+
+func (ur *UnitResponse) Read(reader ampReader) error {
+	err := ur.EchoResponse.Read(reader)
+	for err == nil && len(ur.States) < ur.Count {
+		line := ""
+		line, err = reader.readResponse()
+		if err == nil {
+			line = strings.TrimSpace(strings.TrimRight(line, "#"))
+			if len(line) > 0 && line[0] == '>' {
+				state := State{}
+				err = state.Unmarshal(line[1:])
+				ur.States = append(ur.States, state)
+			} else {
+				err = fmt.Errorf("%w received %q", ErrInvalidResponse, line)
+			}
+		}
+	}
+	return err
+}
+
+// RawResponse collects every line the amplifier sends after the echo
+// of a command, up until the amplifier stops sending
+type RawResponse struct {
+	EchoResponse
+	Lines []string
+}
+
+func (rr *RawResponse) Read(reader ampReader) error {
+	err := rr.EchoResponse.Read(reader)
+	for err == nil {
+		line := ""
+		line, err = reader.readResponse()
+		line = strings.TrimSpace(strings.TrimRight(line, "#"))
+		if line != "" {
+			rr.Lines = append(rr.Lines, line)
+		}
+	}
+
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return err
+}
+
+// ResponseLine is the decoded form of a single line received from the
+// amplifier.  Lines that can't be decoded only have Raw set
+type ResponseLine struct {
+	Raw     string  `json:"raw"`
+	Zone    ZoneID  `json:"zone,omitempty"`
+	Command Command `json:"command,omitempty"`
+	Value   string  `json:"value,omitempty"`
+	State   *State  `json:"state,omitempty"`
+}
+
+// ParseLine attempts to decode a response line as either a command
+// response or a zone state
+func ParseLine(line string) ResponseLine {
+	rl := ResponseLine{Raw: line}
+	str := strings.TrimLeft(line, "<>")
+	cr := &cmdResp{}
+	if cr.Unmarshal(str) != nil {
+		return rl
+	}
+
+	if cr.cmd == ST {
+		state := &State{}
+		if state.Unmarshal(str) != nil {
+			return rl
+		}
+		rl.State = state
+	}
+	rl.Zone = cr.zone
+	rl.Command = cr.cmd
+	rl.Value = cr.value
+	return rl
+}
@@ -291,3 +291,58 @@ func TestQueryResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestRawResponse(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		wantEcho  string
+		wantLines []string
+		wantErr   error
+	}{
+		{"No response", "<11VO20\r\n#", "<11VO20\r\n", nil, nil},
+		{"Query", "?11\r\n#>1100000000130705100301\r\r\n#", "?11\r\n", []string{">1100000000130705100301"}, nil},
+		{"Unit", "?10\r\n#>1100000000130705100301\r\r\n#>1200000000130705100301\r\r\n#", "?10\r\n", []string{">1100000000130705100301", ">1200000000130705100301"}, nil},
+		{"No echo", "", "", nil, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := RawResponse{}
+			reader := testReader{bufio.NewReader(strings.NewReader(test.input))}
+			gotErr := got.Read(reader)
+			if !errors.Is(gotErr, test.wantErr) {
+				t.Errorf("Wanted error %v but got %v", test.wantErr, gotErr)
+			}
+			if got.Echo != test.wantEcho {
+				t.Errorf("Wanted echo %q but got %q", test.wantEcho, got.Echo)
+			}
+			if !reflect.DeepEqual(test.wantLines, got.Lines) {
+				t.Errorf("Wanted lines %q but got %q", test.wantLines, got.Lines)
+			}
+		})
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  ResponseLine
+	}{
+		{"State", ">1100000000130705100301", ResponseLine{">1100000000130705100301", 11, ST, "00000000130705100301", &State{11, false, false, false, false, 13, 7, 5, 10, 3, true}}},
+		{"Command", "<11VO20", ResponseLine{"<11VO20", 11, SetVolume, "20", nil}},
+		{"Short", ">11", ResponseLine{Raw: ">11"}},
+		{"Garbage", "Command Error.", ResponseLine{Raw: "Command Error."}},
+		{"Bad state", ">11000000", ResponseLine{Raw: ">11000000"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := ParseLine(test.input)
+			if !reflect.DeepEqual(test.want, got) {
+				t.Errorf("Wanted %+v got %+v", test.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package monoprice
+
+import "fmt"
+
+// Scene is a named set of zone states that can be recalled together
+type Scene struct {
+	Name  string  `json:"name"`
+	Zones []State `json:"zones"`
+}
+
+// NewScene captures the current state of the given zones
+func NewScene(name string, zones []Zone) (Scene, error) {
+	scene := Scene{Name: name}
+	for _, zone := range zones {
+		state, err := zone.State()
+		if err != nil {
+			return scene, fmt.Errorf("zone %d: %w", zone.ID(), err)
+		}
+		scene.Zones = append(scene.Zones, state)
+	}
+	return scene, nil
+}
+
+// Recall restores every zone in the scene.  Zones in the scene that
+// are not in the list of zones result in ErrInvalidZone
+func (s Scene) Recall(zones []Zone) error {
+	found := make(map[ZoneID]Zone)
+	for _, zone := range zones {
+		found[zone.ID()] = zone
+	}
+
+	for _, state := range s.Zones {
+		zone, ok := found[ZoneID(state.Zone)]
+		if !ok {
+			return fmt.Errorf("%w %d in scene %q", ErrInvalidZone, state.Zone, s.Name)
+		}
+
+		if err := Restore(zone, state); err != nil {
+			return fmt.Errorf("zone %d: %w", state.Zone, err)
+		}
+	}
+	return nil
+}
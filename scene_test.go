@@ -0,0 +1,74 @@
+package monoprice
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+type testZone struct {
+	id    ZoneID
+	state State
+	err   error
+	cmds  []string
+}
+
+func (tz *testZone) ID() ZoneID { return tz.id }
+
+func (tz *testZone) State() (State, error) { return tz.state, tz.err }
+
+func (tz *testZone) SendCommand(cmd Command, arg interface{}) error {
+	str, err := cmd.format(arg)
+	if err == nil {
+		tz.cmds = append(tz.cmds, fmt.Sprintf("%s%s", cmd, str))
+	}
+	return err
+}
+
+func TestSceneRecall(t *testing.T) {
+	tests := []struct {
+		name     string
+		scene    Scene
+		wantCmds []string
+		wantErr  error
+	}{
+		{
+			name:     "Good",
+			scene:    Scene{"test", []State{{Zone: 11, Power: true, Volume: 20, Treble: 7, Bass: 7, Balance: 10, Source: 2}}},
+			wantCmds: []string{"PR01", "MU00", "VO20", "TR07", "BS07", "BL10", "CH02"},
+			wantErr:  nil,
+		},
+		{
+			name:     "Unknown zone",
+			scene:    Scene{"test", []State{{Zone: 12}}},
+			wantCmds: nil,
+			wantErr:  ErrInvalidZone,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			zone := &testZone{id: 11}
+			gotErr := test.scene.Recall([]Zone{zone})
+			if !errors.Is(gotErr, test.wantErr) {
+				t.Errorf("Wanted error %v got %v", test.wantErr, gotErr)
+			}
+
+			if !reflect.DeepEqual(test.wantCmds, zone.cmds) {
+				t.Errorf("Wanted commands %v got %v", test.wantCmds, zone.cmds)
+			}
+		})
+	}
+}
+
+func TestNewScene(t *testing.T) {
+	zone := &testZone{id: 11, state: State{Zone: 11, Volume: 12}}
+	got, err := NewScene("test", []Zone{zone})
+	want := Scene{"test", []State{zone.state}}
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	} else if !reflect.DeepEqual(want, got) {
+		t.Errorf("Wanted %+v got %+v", want, got)
+	}
+}
@@ -0,0 +1,160 @@
+package monoprice
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var ErrReplayMismatch = errors.New("replay mismatch")
+
+const (
+	TX = "tx"
+	RX = "rx"
+)
+
+// TranscriptEntry is a single line of a serial transcript.  Direction is
+// either TX (sent to the amplifier) or RX (received from the amplifier)
+type TranscriptEntry struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"dir"`
+	Data      string    `json:"data"`
+}
+
+type recorder struct {
+	mutex sync.Mutex
+	enc   *json.Encoder
+}
+
+func (rec *recorder) record(direction string, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	rec.enc.Encode(TranscriptEntry{Time: time.Now(), Direction: direction, Data: string(data)})
+}
+
+type recordingWriter struct {
+	io.Writer
+	rec *recorder
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	n, err := rw.Writer.Write(p)
+	rw.rec.record(TX, p[:n])
+	return n, err
+}
+
+type recordingReader struct {
+	io.Reader
+	rec *recorder
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.Reader.Read(p)
+	rr.rec.record(RX, p[:n])
+	return n, err
+}
+
+// RecordOption writes every byte sent to and received from the amplifier
+// to w as JSON lines of TranscriptEntry.  The transcript can be played
+// back with NewReplay
+func RecordOption(w io.Writer) Option {
+	return func(amp *Amplifier) {
+		rec := &recorder{enc: json.NewEncoder(w)}
+		amp.writer = &recordingWriter{amp.writer, rec}
+		amp.reader = bufio.NewReader(&recordingReader{amp.reader, rec})
+	}
+}
+
+// Replay is an io.ReadWriter that plays back a transcript recorded with
+// RecordOption.  Every write must match the next TX entry in the
+// transcript, after which the RX entries that follow it become
+// available to read.  Reading when no data is available returns io.EOF,
+// the same as a serial port read timeout
+type Replay struct {
+	mutex   sync.Mutex
+	entries []TranscriptEntry
+	pending bytes.Buffer
+}
+
+// NewReplay reads a transcript from r
+func NewReplay(r io.Reader) (*Replay, error) {
+	replay := &Replay{}
+	dec := json.NewDecoder(r)
+	for {
+		entry := TranscriptEntry{}
+		err := dec.Decode(&entry)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if entry.Direction != TX && entry.Direction != RX {
+			return nil, fmt.Errorf("%w: unknown direction %q", ErrReplayMismatch, entry.Direction)
+		}
+		replay.entries = append(replay.entries, entry)
+	}
+	replay.queue()
+	return replay, nil
+}
+
+// queue moves RX entries from the head of the transcript into the read
+// buffer
+func (r *Replay) queue() {
+	for len(r.entries) > 0 && r.entries[0].Direction == RX {
+		r.pending.WriteString(r.entries[0].Data)
+		r.entries = r.entries[1:]
+	}
+}
+
+func (r *Replay) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if len(r.entries) == 0 {
+		return 0, fmt.Errorf("%w: unexpected write %q after end of transcript", ErrReplayMismatch, p)
+	}
+
+	if r.entries[0].Data != string(p) {
+		return 0, fmt.Errorf("%w: wanted write %q got %q", ErrReplayMismatch, r.entries[0].Data, p)
+	}
+
+	r.entries = r.entries[1:]
+	r.queue()
+	return len(p), nil
+}
+
+func (r *Replay) Read(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.pending.Len() == 0 {
+		return 0, io.EOF
+	}
+	return r.pending.Read(p)
+}
+
+// Done returns an error if any part of the transcript has not been
+// replayed
+func (r *Replay) Done() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if len(r.entries) > 0 {
+		return fmt.Errorf("%w: %d transcript entries were not replayed, next is %s %q", ErrReplayMismatch, len(r.entries), r.entries[0].Direction, r.entries[0].Data)
+	}
+
+	if r.pending.Len() > 0 {
+		return fmt.Errorf("%w: unread data %q", ErrReplayMismatch, r.pending.String())
+	}
+	return nil
+}
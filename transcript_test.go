@@ -0,0 +1,87 @@
+package monoprice
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	transcript := &bytes.Buffer{}
+	amp := &Amplifier{
+		reader: bufio.NewReader(strings.NewReader("?11\r\n#>1100000000130705100301\r\r\n#")),
+		writer: io.Discard,
+	}
+	RecordOption(transcript)(amp)
+
+	want, err := amp.QueryState(11)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	replay, err := NewReplay(transcript)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	amp = &Amplifier{reader: bufio.NewReader(replay), writer: replay}
+	got, err := amp.QueryState(11)
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	} else if want != got {
+		t.Errorf("Wanted %+v got %+v", want, got)
+	}
+
+	if err := replay.Done(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	_, err = amp.QueryState(12)
+	if !errors.Is(err, ErrReplayMismatch) {
+		t.Errorf("Wanted error %v got %v", ErrReplayMismatch, err)
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	replay, _ := NewReplay(strings.NewReader(`{"dir":"tx","data":"?11\r\n"}` + "\n" + `{"dir":"rx","data":"?11\r\n#"}`))
+	amp := &Amplifier{reader: bufio.NewReader(replay), writer: replay}
+	err := amp.SendCommand(11, SetVolume, 20)
+	if !errors.Is(err, ErrReplayMismatch) {
+		t.Errorf("Wanted error %v got %v", ErrReplayMismatch, err)
+	}
+
+	if err := replay.Done(); !errors.Is(err, ErrReplayMismatch) {
+		t.Errorf("Wanted error %v got %v", ErrReplayMismatch, err)
+	}
+}
+
+func TestReplayInit(t *testing.T) {
+	f, err := os.Open("testdata/init.jsonl")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer f.Close()
+
+	replay, err := NewReplay(f)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	amp, err := New(replay)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	zones := amp.Zones()
+	if len(zones) != 2 || zones[0].ID() != 11 || zones[1].ID() != 12 {
+		t.Errorf("Wanted zones 11 and 12 got %v", zones)
+	}
+
+	if err := replay.Done(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
@@ -13,19 +13,23 @@ var (
 type unmarshaler func(string) error
 
 func intUnmarshaler(receiver *int) unmarshaler {
-	return func(str string) (err error) {
-		*receiver, err = strconv.Atoi(str)
-		return err
+	return func(str string) error {
+		v, err := strconv.Atoi(str)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidResponse, err)
+		}
+		*receiver = v
+		return nil
 	}
 }
 
 func boolUnmarshaler(receiver *bool) unmarshaler {
-	return func(str string) (err error) {
-		if str[0:1] != "0" {
-			return strconv.ErrSyntax
+	return func(str string) error {
+		if len(str) != 2 || str[0] != '0' || (str[1] != '0' && str[1] != '1') {
+			return fmt.Errorf("%w: %w %q", ErrInvalidResponse, strconv.ErrSyntax, str)
 		}
-		*receiver, err = strconv.ParseBool(str[1:])
-		return err
+		*receiver = str[1] == '1'
+		return nil
 	}
 }
 
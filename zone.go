@@ -1,7 +1,5 @@
 package monoprice
 
-import "errors"
-
 type ZoneID int
 
 type Zone interface {
@@ -29,15 +27,10 @@ func (z *zone) ID() ZoneID {
 }
 
 func (z *zone) State() (state State, err error) {
-	for i := 0; i < QueryRetryLimit; i++ {
-		state, err = z.amp.QueryState(z.id)
-		if err == nil || !errors.Is(ErrInvalidZone, err) {
-			break
-		}
-	}
-	if errors.Is(ErrInvalidZone, err) {
-		err = ErrUnknownState
-	}
+	err = z.amp.Transaction(func(tx *Tx) error {
+		state, err = tx.State(z.id)
+		return err
+	})
 	return
 }
 
@@ -45,13 +38,18 @@ func (z *zone) SendCommand(cmd Command, arg interface{}) error {
 	return z.amp.SendCommand(z.id, cmd, arg)
 }
 
-func (z *zone) Restore(state State) (err error) {
+func (z *zone) Restore(state State) error {
+	return Restore(z, state)
+}
+
+// Restore sends the commands needed to return a zone to the given state
+func Restore(z Zone, state State) (err error) {
 	for _, cmd := range []struct {
 		cmd Command
 		arg interface{}
 	}{
-		{SetPower, boolMarshaler(state.Power)},
-		{SetMute, boolMarshaler(state.Mute)},
+		{SetPower, boolMarshaler(state.Power)()},
+		{SetMute, boolMarshaler(state.Mute)()},
 		{SetVolume, state.Volume},
 		{SetTreble, state.Treble},
 		{SetBass, state.Bass},